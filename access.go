@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessTokenTTL is the lifetime (seconds) of the single-use access tokens for browser `EventSource` clients
+var accessTokenTTL = 60
+
+// Kinds of the credentials accepted by the streams, browsers can't set the Authorization header on `EventSource`
+const (
+	credentialBearer      = "bearer"
+	credentialAccessToken = "access_token"
+	credentialCookie      = "cookie"
+)
+
+// accessGrant is the single-use access token issued for the stream `id` (request or batch) and its stream token
+type accessGrant struct {
+	id        string
+	token     string
+	expiresAt int64
+}
+
+var accessTokens sync.Map // map[accessToken string]accessGrant
+
+// cookieSecret signs the stream cookies, the cookies are valid only for this proxy instance like the stream tokens
+var cookieSecret, _ = generateSecureToken(32)
+
+// streamCookieName returns the name of the cookie authorizing the stream `id`
+func streamCookieName(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return "webhook_proxy_" + hex.EncodeToString(sum[:8])
+}
+
+// streamCookieSignature signs the cookie value, bound to the stream token so the cookie is revoked with the token
+func streamCookieSignature(id, token string, expiresAt int64) string {
+	mac := hmac.New(sha256.New, []byte(cookieSecret))
+	mac.Write([]byte(id + "\x00" + token + "\x00" + strconv.FormatInt(expiresAt, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// streamCredential returns the credential provided for the stream `id` and its kind: Authorization header,
+// `access_token` query parameter or the stream cookie. The access token is removed from the request URL, so it's
+// never logged.
+func streamCredential(r *http.Request, id string) (string, string) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		return strings.TrimPrefix(header, "Bearer "), credentialBearer
+	}
+	if query := r.URL.Query(); query.Has("access_token") {
+		accessToken := query.Get("access_token")
+		query.Del("access_token")
+		r.URL.RawQuery = query.Encode()
+		return accessToken, credentialAccessToken
+	}
+	if cookie, err := r.Cookie(streamCookieName(id)); err == nil {
+		return cookie.Value, credentialCookie
+	}
+	return "", ""
+}
+
+// validStreamCredential checks the credential of the kind against the stream token. Access tokens are consumed.
+func validStreamCredential(id string, token *streamToken, credential, kind string) bool {
+	switch kind {
+	case credentialBearer:
+		return subtle.ConstantTimeCompare([]byte(token.token), []byte(credential)) == 1
+	case credentialAccessToken:
+		v, ok := accessTokens.LoadAndDelete(credential)
+		if !ok {
+			return false
+		}
+		grant := v.(accessGrant)
+		return grant.id == id && subtle.ConstantTimeCompare([]byte(grant.token), []byte(token.token)) == 1 &&
+			grant.expiresAt >= time.Now().Unix()
+	case credentialCookie:
+		expires, signature, ok := strings.Cut(credential, ".")
+		expiresAt, err := strconv.ParseInt(expires, 10, 64)
+		if !ok || err != nil || expiresAt < time.Now().Unix() {
+			return false
+		}
+		return hmac.Equal([]byte(signature), []byte(streamCookieSignature(id, token.token, expiresAt)))
+	}
+	return false
+}
+
+// handleCreateAccessToken handles `POST /access-token` route. Exchanges the stream token (Authorization header) for
+// a single-use access token of the request or batch stream, optionally sets the signed stream cookie.
+func handleCreateAccessToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RequestId string `json:"request_id"`
+		BatchId   string `json:"batch_id"`
+		Cookie    bool   `json:"cookie"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || (req.RequestId == "") == (req.BatchId == "") {
+		log.Printf("error decoding create access token request or missing stream id: %v", err)
+		http.Error(w, "Bad request. Either `request_id` or `batch_id` (string) is required.", http.StatusBadRequest)
+		return
+	}
+
+	// Only the stream token itself can be exchanged, not the access tokens or cookies
+	if r.Header.Get("Authorization") == "" {
+		log.Printf("access token requested without authorization header")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id := req.RequestId
+	var requiredToken *streamToken
+	if id != "" {
+		if t, ok := streamsTokens.Load(id); ok {
+			st := t.(streamToken)
+			requiredToken = &st
+		}
+	} else {
+		id = req.BatchId
+		if v, ok := batches.Load(id); ok {
+			requiredToken = &v.(*batch).token
+		}
+	}
+	if !checkStreamToken(w, r, id, requiredToken) {
+		return
+	}
+
+	accessToken, err := generateSecureToken(16)
+	if err != nil {
+		log.Printf("error generating access token (id: %s): %v", id, err)
+		http.Error(w, "cannot generate token", http.StatusInternalServerError)
+		return
+	}
+	expiresAt := min(time.Now().Add(time.Duration(accessTokenTTL)*time.Second).Unix(), requiredToken.expiresAt)
+	accessTokens.Store(accessToken, accessGrant{id: id, token: requiredToken.token, expiresAt: expiresAt})
+
+	if req.Cookie {
+		http.SetCookie(w, &http.Cookie{
+			Name:     streamCookieName(id),
+			Value:    strconv.FormatInt(requiredToken.expiresAt, 10) + "." + streamCookieSignature(id, requiredToken.token, requiredToken.expiresAt),
+			Path:     "/listen",
+			Expires:  time.Unix(requiredToken.expiresAt, 0),
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteNoneMode,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]string{
+		"access_token": accessToken,
+		"expires_at":   strconv.FormatInt(expiresAt, 10),
+	})
+	if err != nil {
+		log.Printf("error responding with access token (id: %s): %v", id, err)
+	}
+}
+
+// cleanupAccessTokens deletes expired access tokens which were never used
+func cleanupAccessTokens() {
+	n := 0
+	accessTokens.Range(func(key, value interface{}) bool {
+		if value.(accessGrant).expiresAt < time.Now().Unix() {
+			accessTokens.Delete(key)
+			n++
+		}
+		return true
+	})
+	if n > 0 {
+		log.Printf("%d expired access tokens, deleting", n)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamCredential(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/listen/asd?keep_alive=10&access_token=secret", nil)
+	credential, kind := streamCredential(req, "asd")
+	if credential != "secret" || kind != credentialAccessToken {
+		t.Errorf("expected access token, got %s (%s)", credential, kind)
+	}
+	if strings.Contains(req.URL.String(), "secret") || req.URL.Query().Get("keep_alive") != "10" {
+		t.Errorf("expected access token removed from the URL, got %s", req.URL)
+	}
+}
+
+func TestHandleCreateAccessToken(t *testing.T) {
+	requestTimeout = 10
+	srv := newTestProxy(t, nil)
+	resp, _ := http.Post(srv.URL+"/token", "application/json", strings.NewReader(`{"request_id": "req1"}`))
+	var token struct{ Token string }
+	_ = json.NewDecoder(resp.Body).Decode(&token)
+	resp.Body.Close()
+
+	createAccessToken := func(body, bearer string) *http.Response {
+		req, _ := http.NewRequest("POST", srv.URL+"/access-token", strings.NewReader(body))
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	listen := func(query string, cookie *http.Cookie) (int, string) {
+		req, _ := http.NewRequest("GET", srv.URL+"/listen/req1?keep_alive=1"+query, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b := make([]byte, 32)
+		n, _ := io.ReadAtLeast(resp.Body, b, 1)
+		return resp.StatusCode, string(b[:n])
+	}
+
+	for body, expectedCode := range map[string]int{
+		`{"request_id": "req1"}`: http.StatusUnauthorized,
+		`{}`:                     http.StatusBadRequest,
+		`{"request_id": "req1", "batch_id": "b1"}`: http.StatusBadRequest,
+	} {
+		if resp = createAccessToken(body, ""); resp.StatusCode != expectedCode {
+			t.Errorf("expected status %d for %s, got %d", expectedCode, body, resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+	if resp = createAccessToken(`{"request_id": "req1"}`, "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status %d for invalid stream token, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// Single-use access token
+	resp = createAccessToken(`{"request_id": "req1", "cookie": true}`, token.Token)
+	var access struct {
+		AccessToken string `json:"access_token"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&access)
+	resp.Body.Close()
+	if code, body := listen("&access_token="+access.AccessToken, nil); code != http.StatusOK || !strings.HasPrefix(body, "data: keep-alive") {
+		t.Errorf("expected stream opened with the access token, got %d: %s", code, body)
+	}
+	if code, _ := listen("&access_token="+access.AccessToken, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected used access token to be refused, got %d", code)
+	}
+
+	// Signed cookie, bound to the stream token
+	cookies := resp.Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || !cookies[0].Secure {
+		t.Fatalf("expected HttpOnly secure stream cookie, got %v", cookies)
+	}
+	if code, _ := listen("", cookies[0]); code != http.StatusOK {
+		t.Errorf("expected stream opened with the cookie, got %d", code)
+	}
+	forged := *cookies[0]
+	forged.Value = strings.Replace(forged.Value, ".", "0.", 1)
+	if code, _ := listen("", &forged); code != http.StatusUnauthorized {
+		t.Errorf("expected forged cookie to be refused, got %d", code)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	srv := newTestProxy(t, nil)
+	corsOrigins, corsCredentials = "https://dashboard.example.com", true
+	t.Cleanup(func() { corsOrigins, corsCredentials = "", false })
+
+	preflight := func(origin string) *http.Response {
+		req, _ := http.NewRequest("OPTIONS", srv.URL+"/listen/req1", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	resp := preflight("https://dashboard.example.com")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "https://dashboard.example.com" ||
+		resp.Header.Get("Access-Control-Allow-Credentials") != "true" || !strings.Contains(resp.Header.Get("Access-Control-Allow-Headers"), "Authorization") {
+		t.Errorf("expected preflight allowed, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp = preflight("https://evil.example.com"); resp.StatusCode != http.StatusForbidden || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected preflight refused, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(`{"request_id": "req1"}`))
+	req.Header.Set("Origin", "https://dashboard.example.com")
+	rr := httptest.NewRecorder()
+	cors(handleCreateToken)(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("Access-Control-Allow-Origin") != "https://dashboard.example.com" {
+		t.Errorf("expected CORS headers on token response, got %d %v", rr.Code, rr.Header())
+	}
+
+	corsOrigins, corsCredentials = "*", false
+	if origin := allowedOrigin("https://any.example.com"); origin != "*" {
+		t.Errorf("expected wildcard origin, got %s", origin)
+	}
+	if err := validateCORS(); err != nil {
+		t.Errorf("expected wildcard without credentials to be valid, got %v", err)
+	}
+
+	// Any site could make credentialed requests
+	corsOrigins, corsCredentials = "https://dashboard.example.com, *", true
+	if err := validateCORS(); err != errWildcardCredentials {
+		t.Errorf("expected wildcard with credentials to be rejected, got %v", err)
+	}
+	if origin := allowedOrigin("https://evil.example.com"); origin != "" {
+		t.Errorf("expected origin not to be reflected, got %s", origin)
+	}
+}
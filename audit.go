@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditLogPath is the file the audit log is appended to, `-` for stdout, empty disables the audit log
+var auditLogPath string
+
+// Audit log events
+const (
+	auditTokenCreated    = "token_created"
+	auditTokenExpired    = "token_expired"
+	auditStreamAuth      = "stream_auth"
+	auditStreamAuthFail  = "stream_auth_failed"
+	auditLockout         = "lockout"
+	auditWebhookReceived = "webhook_received"
+	auditWebhookRejected = "webhook_rejected"
+	auditDelivered       = "delivered"
+	auditExpired         = "expired"
+	auditCancelled       = "cancelled"
+)
+
+// auditEntry is a single line of the audit log. Every entry holds the hash of the previous one, so removed,
+// reordered or modified entries break the chain, see verifyAuditLog.
+type auditEntry struct {
+	Time       string   `json:"time"`
+	Event      string   `json:"event"`
+	RequestId  string   `json:"request_id,omitempty"`
+	BatchId    string   `json:"batch_id,omitempty"`
+	RequestIds []string `json:"request_ids,omitempty"`
+	RemoteAddr string   `json:"remote_addr,omitempty"`
+	// Key is the fingerprint of the credential sent in the Authorization header, the credential itself is not logged
+	Key      string `json:"key,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	// BodyHash is the SHA-256 of the webhook body
+	BodyHash string `json:"body_sha256,omitempty"`
+	Prev     string `json:"prev"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// seal sets the hash of the entry chained to the previous entry hash, returns the JSON line
+func (e *auditEntry) seal(prev string) ([]byte, error) {
+	e.Prev, e.Hash = prev, ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	e.Hash = hex.EncodeToString(sum[:])
+	return json.Marshal(e)
+}
+
+// auditLogger appends hash chained entries as JSON lines
+type auditLogger struct {
+	mu   sync.Mutex
+	w    io.Writer
+	prev string
+}
+
+var auditLog *auditLogger
+
+// openAuditLog opens the audit log for appending, the chain continues from the last entry of the existing file
+func openAuditLog(path string) (*auditLogger, error) {
+	if path == "-" {
+		return &auditLogger{w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLogger{w: f}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e auditEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("invalid audit log entry: %w", err)
+		}
+		a.prev = e.Hash
+	}
+	if err = scanner.Err(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// record appends the entry to the audit log, no-op when the audit log is disabled
+func (a *auditLogger) record(e auditEntry) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := e.seal(a.prev)
+	if err != nil {
+		log.Printf("failed to encode audit log entry: %v\n", err)
+		return
+	}
+	if _, err = a.w.Write(append(line, '\n')); err != nil {
+		log.Printf("failed to write audit log entry: %v\n", err)
+		return
+	}
+	a.prev = e.Hash
+}
+
+// auditRequest records the entry with the client address and credential fingerprint of the request. The address is
+// the connection peer, client supplied headers like `X-Forwarded-For` are not trusted.
+func auditRequest(r *http.Request, e auditEntry) {
+	if auditLog == nil {
+		return
+	}
+	e.RemoteAddr = r.RemoteAddr
+	if credential := r.Header.Get("Authorization"); credential != "" {
+		sum := sha256.Sum256([]byte(strings.TrimPrefix(credential, "Bearer ")))
+		e.Key = hex.EncodeToString(sum[:8])
+	}
+	auditLog.record(e)
+}
+
+// verifyAuditLog checks the hash chain of the audit log, returns the number of valid entries
+func verifyAuditLog(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	n, prev := 0, ""
+	for scanner.Scan() {
+		var e auditEntry
+		d := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&e); err != nil {
+			return n, fmt.Errorf("line %d: invalid entry: %w", n+1, err)
+		}
+		if e.Prev != prev {
+			return n, fmt.Errorf("line %d: chain broken, previous entry hash doesn't match", n+1)
+		}
+		hash := e.Hash
+		if _, err := e.seal(prev); err != nil {
+			return n, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		if e.Hash != hash {
+			return n, fmt.Errorf("line %d: entry hash doesn't match its content", n+1)
+		}
+		prev = hash
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// runAuditVerify implements `webhook-proxy audit-verify <audit log file>`. Verifies the hash chain of the audit log.
+func runAuditVerify(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("audit-verify", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(stderr, "usage: webhook-proxy audit-verify <audit log file>\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "failed to open audit log: %v\n", err)
+		return exitError
+	}
+	defer f.Close()
+	n, err := verifyAuditLog(f)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "audit log verification failed after %d valid entries: %v\n", n, err)
+		return exitError
+	}
+	_, _ = fmt.Fprintf(stdout, "audit log valid, %d entries\n", n)
+	return exitOK
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withAuditLog enables the audit log in a temporary file for the test
+func withAuditLog(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatalf("expected audit log to open, got %v", err)
+	}
+	auditLog = a
+	t.Cleanup(func() {
+		a.w.(*os.File).Close()
+		auditLog = nil
+	})
+	return path
+}
+
+func readAuditLog(t *testing.T, path string) []auditEntry {
+	t.Helper()
+	b, _ := os.ReadFile(path)
+	var entries []auditEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var e auditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid audit log line %s: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	requestTimeout = 10
+	srv := newTestProxy(t, nil)
+	path := withAuditLog(t)
+
+	resp, err := http.Post(srv.URL+"/token", "application/json", strings.NewReader(`{"request_id": "req1"}`))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected token to be created, got %v", err)
+	}
+	var token struct{ Token string }
+	_ = json.NewDecoder(resp.Body).Decode(&token)
+	resp.Body.Close()
+
+	listen := func(token string) int {
+		req, _ := http.NewRequest("GET", srv.URL+"/listen/req1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		_, _ = new(bytes.Buffer).ReadFrom(resp.Body)
+		return resp.StatusCode
+	}
+	if code := listen("wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, code)
+	}
+	req, _ := http.NewRequest("POST", srv.URL+"/webhook", strings.NewReader(`{"request_id": "req1"}`))
+	req.Header.Set("X-BASETEN-SIGNATURE", "xxx")
+	if resp, err = http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+	listen(token.Token)
+
+	// Expired payload and token
+	store.(*InMemStore).store.Store("req2", []Record{{content: []byte("content"), createdAt: time.Now().Add(-time.Hour).Unix()}})
+	streamsTokens.Store("req2", streamToken{token: "a", expiresAt: time.Now().Add(-time.Minute).Unix()})
+	cleanupStore()
+	cleanupTokens()
+
+	expected := []auditEntry{
+		{Event: auditTokenCreated, RequestId: "req1"},
+		{Event: auditStreamAuthFail, RequestId: "req1", Reason: "invalid token"},
+		{Event: auditWebhookReceived, RequestId: "req1", Provider: "baseten"},
+		{Event: auditStreamAuth, RequestId: "req1"},
+		{Event: auditDelivered, RequestId: "req1"},
+		{Event: auditExpired, RequestId: "req2"},
+		{Event: auditTokenExpired, RequestId: "req2"},
+	}
+	entries := readAuditLog(t, path)
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d audit log entries, got %d: %v", len(expected), len(entries), entries)
+	}
+	for n, e := range expected {
+		got := entries[n]
+		if got.Event != e.Event || got.RequestId != e.RequestId || got.Reason != e.Reason || got.Provider != e.Provider {
+			t.Errorf("expected entry %d to be %+v, got %+v", n, e, got)
+		}
+	}
+	if entries[1].Key == "" || strings.Contains(entries[1].Key, "wrong") || entries[1].RemoteAddr == "" {
+		t.Errorf("expected client address and credential fingerprint, got %+v", entries[1])
+	}
+	if len(entries[2].BodyHash) != 64 {
+		t.Errorf("expected webhook body hash, got %s", entries[2].BodyHash)
+	}
+	if n, err := verifyAuditLog(bytes.NewReader(mustReadFile(t, path))); err != nil || n != len(expected) {
+		t.Errorf("expected valid chain of %d entries, got %d (err: %v)", len(expected), n, err)
+	}
+}
+
+func TestAuditLog_WebhookRejected(t *testing.T) {
+	withProviders(t, `[{"name": "baseten", "request_id": {"from": "json", "key": "request_id"},
+		"signature": {"header": "X-BASETEN-SIGNATURE", "prefix": "v1=", "secret": "s"}}]`)
+	resetTestState()
+	path := withAuditLog(t)
+
+	req, _ := http.NewRequest("POST", "/webhook", strings.NewReader(`{"request_id": "req1"}`))
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-BASETEN-SIGNATURE", "v1=invalid")
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	rr := httptest.NewRecorder()
+	handleIncomingWebhook(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 1 || entries[0].Event != auditWebhookRejected || entries[0].Reason != "invalid signature" ||
+		entries[0].Provider != "baseten" || len(entries[0].BodyHash) != 64 {
+		t.Fatalf("expected rejected webhook entry, got %+v", entries)
+	}
+	// The spoofable header isn't recorded
+	if entries[0].RemoteAddr != "192.0.2.1:1234" {
+		t.Errorf("expected peer address, got %s", entries[0].RemoteAddr)
+	}
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	path := withAuditLog(t)
+	auditLog.record(auditEntry{Event: auditTokenCreated, RequestId: "req1"})
+	auditLog.record(auditEntry{Event: auditDelivered, RequestId: "req1"})
+
+	// Reopened log continues the chain
+	auditLog.w.(*os.File).Close()
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog = a
+	auditLog.record(auditEntry{Event: auditExpired, RequestId: "req2"})
+
+	stdout, stderr := strings.Builder{}, strings.Builder{}
+	if code := runAuditVerify([]string{path}, &stdout, &stderr); code != exitOK || !strings.Contains(stdout.String(), "3 entries") {
+		t.Fatalf("expected valid audit log, got %d (stdout: %s, stderr: %s)", code, stdout.String(), stderr.String())
+	}
+
+	lines := strings.SplitAfter(string(mustReadFile(t, path)), "\n")
+	tampered := map[string]string{
+		"modified":    lines[0] + strings.Replace(lines[1], "req1", "req3", 1) + lines[2],
+		"removed":     lines[0] + lines[2],
+		"reordered":   lines[1] + lines[0] + lines[2],
+		"added field": lines[0] + strings.Replace(lines[1], `"event"`, `"extra":1,"event"`, 1) + lines[2],
+	}
+	for name, content := range tampered {
+		if n, err := verifyAuditLog(strings.NewReader(content)); err == nil {
+			t.Errorf("%s: expected verification to fail, got %d valid entries", name, n)
+		}
+	}
+
+	_ = os.WriteFile(path, []byte(tampered["removed"]), 0o600)
+	if code := runAuditVerify([]string{path}, &stdout, &stderr); code != exitError {
+		t.Errorf("expected exit code %d, got %d", exitError, code)
+	}
+	if code := runAuditVerify(nil, &stdout, &stderr); code != exitUsage {
+		t.Errorf("expected exit code %d, got %d", exitUsage, code)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// predictionError is a single entry of the `errors` array of the Baseten webhook payload of a failed prediction
+type predictionError struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// basetenPayload is the known shape of the Baseten async webhook payload
+type basetenPayload struct {
+	RequestId string            `json:"request_id"`
+	Data      json.RawMessage   `json:"data"`
+	Errors    []predictionError `json:"errors"`
+}
+
+// predictionErrors returns the errors of the failed prediction from the Baseten webhook payload and whether the
+// payload is of the known shape
+func predictionErrors(b []byte) ([]predictionError, bool) {
+	var payload basetenPayload
+	if err := json.Unmarshal(b, &payload); err != nil || payload.RequestId == "" || payload.Data == nil {
+		return nil, false
+	}
+	return payload.Errors, true
+}
+
+// withoutMessages returns the errors with codes only, the messages may carry model output
+func withoutMessages(errs []predictionError) []predictionError {
+	codes := make([]predictionError, len(errs))
+	for n, e := range errs {
+		codes[n] = predictionError{Code: e.Code}
+	}
+	return codes
+}
+
+// sendPredictionErrors writes the `error` event with the error codes of the failed prediction to the stream
+func sendPredictionErrors(w http.ResponseWriter, errs []predictionError) error {
+	data, err := json.Marshal(map[string]any{"errors": errs})
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "event: error\ndata: %s\n\n", data); err != nil {
+		return fmt.Errorf("failed to write prediction errors: %w", err)
+	}
+	return nil
+}
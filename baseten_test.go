@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPredictionErrors(t *testing.T) {
+	tests := []struct {
+		body   string
+		errors int
+		known  bool
+	}{
+		{`{"request_id": "req1", "data": {"output": "ok"}, "errors": []}`, 0, true},
+		{`{"request_id": "req1", "data": null, "errors": [{"code": "MODEL_PREDICT_ERROR", "message": "out of memory"}]}`, 1, true},
+		{`{"request_id": "req1", "status": "completed"}`, 0, false},
+		{`{"data": null, "errors": [{"code": "MODEL_PREDICT_ERROR"}]}`, 0, false},
+		{`not json`, 0, false},
+	}
+	for _, test := range tests {
+		errs, known := predictionErrors([]byte(test.body))
+		if len(errs) != test.errors || known != test.known {
+			t.Errorf("expected %d errors (known: %v) for %s, got %v (known: %v)", test.errors, test.known, test.body, errs, known)
+		}
+	}
+}
+
+func TestHandleClientStream_PredictionFailed(t *testing.T) {
+	resetTestState()
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+	registerRequest("asd", "a")
+
+	failures := testutil.ToFloat64(promPredictionResults.WithLabelValues("failure"))
+	successes := testutil.ToFloat64(promPredictionResults.WithLabelValues("success"))
+	body := `{"request_id": "asd", "data": null, "errors": [{"code": "MODEL_PREDICT_ERROR", "message": "out of memory"}]}`
+	if code := postTestWebhook(body); code != http.StatusOK {
+		t.Fatalf("expected webhook to be accepted, got %d", code)
+	}
+	if n := testutil.ToFloat64(promPredictionResults.WithLabelValues("failure")); n != failures+1 {
+		t.Errorf("expected failure counted, got %v", n-failures)
+	}
+	if n := testutil.ToFloat64(promPredictionResults.WithLabelValues("success")); n != successes {
+		t.Errorf("expected no success counted, got %v", n-successes)
+	}
+
+	req, _ := http.NewRequest("GET", "/listen/asd", nil)
+	req.SetPathValue("request_id", "asd")
+	req.Header.Add("Authorization", "Bearer a")
+	rr := httptest.NewRecorder()
+	handleClientStream(context.Background())(rr, req)
+
+	// The message stays in the payload only
+	expected := "data: " + body + "\n\ndata: signature=xxx\n\n" +
+		"event: error\ndata: {\"errors\":[{\"code\":\"MODEL_PREDICT_ERROR\"}]}\n\n" +
+		"data: eot\n\n"
+	if rr.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/requests/asd/status", nil)
+	req.SetPathValue("request_id", "asd")
+	req.Header.Add("Authorization", "Bearer a")
+	rr = httptest.NewRecorder()
+	handleRequestStatus(rr, req)
+	if !strings.Contains(rr.Body.String(), `"state":"delivered"`) || !strings.Contains(rr.Body.String(), `"errors":[{"code":"MODEL_PREDICT_ERROR"}]`) {
+		t.Errorf("expected delivered status with errors, got %s", rr.Body.String())
+	}
+}
+
+func TestHandleClientStream_PredictionFailedRedacted(t *testing.T) {
+	transform, _ := newPayloadTransform(nil, []string{"errors"})
+	resetTestState()
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix(), transform: transform})
+	postTestWebhook(`{"request_id": "asd", "data": null, "errors": [{"code": "MODEL_PREDICT_ERROR", "message": "secret prompt"}]}`)
+
+	records, _ := store.Get(context.Background(), "asd")
+	if len(records) != 1 || records[0].predictionErrors[0].Message != "" {
+		t.Errorf("expected error codes only next to the payload, got %+v", records)
+	}
+	req, _ := http.NewRequest("GET", "/listen/asd", nil)
+	req.SetPathValue("request_id", "asd")
+	req.Header.Add("Authorization", "Bearer a")
+	rr := httptest.NewRecorder()
+	handleClientStream(context.Background())(rr, req)
+	if strings.Contains(rr.Body.String(), "secret prompt") || !strings.Contains(rr.Body.String(), `{"errors":[{"code":"MODEL_PREDICT_ERROR"}]}`) {
+		t.Errorf("expected redacted payload with error codes, got %q", rr.Body.String())
+	}
+}
+
+func TestHandleIncomingWebhook_PredictionSucceeded(t *testing.T) {
+	withStatusField(t, "status")
+	resetTestState()
+
+	successes := testutil.ToFloat64(promPredictionResults.WithLabelValues("success"))
+	postTestWebhook(`{"request_id": "asd", "data": {"output": "ok"}, "errors": []}`)
+	// Progress events and other payload shapes are not counted
+	postTestWebhook(`{"request_id": "asd", "data": {}, "status": "in_progress"}`)
+	postTestWebhook(`{"request_id": "qwe"}`)
+	if n := testutil.ToFloat64(promPredictionResults.WithLabelValues("success")); n != successes+1 {
+		t.Errorf("expected single success counted, got %v", n-successes)
+	}
+
+	records, _ := store.Get(context.Background(), "asd")
+	if len(records) != 2 || len(records[0].predictionErrors) != 0 || len(records[1].predictionErrors) != 0 {
+		t.Errorf("expected records without errors, got %+v", records)
+	}
+}
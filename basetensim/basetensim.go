@@ -0,0 +1,228 @@
+// Package basetensim implements a fake Baseten async inference server for local end-to-end testing.
+//
+// The server exposes `async_predict` compatible endpoints, responds with a generated request ID and after
+// a configurable delay posts a signed webhook (success or error payload) to the `webhook_endpoint` supplied
+// in the prediction request, the same way Baseten does.
+package basetensim
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/flowaicom/webhook-proxy/client"
+)
+
+// Error is a single entry of the `errors` array of the Baseten webhook payload.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Payload is the Baseten async webhook payload.
+type Payload struct {
+	RequestId    string          `json:"request_id"`
+	ModelId      string          `json:"model_id"`
+	DeploymentId string          `json:"deployment_id"`
+	Type         string          `json:"type"`
+	Time         string          `json:"time"`
+	Data         json.RawMessage `json:"data"`
+	Errors       []Error         `json:"errors"`
+}
+
+// Responder computes the prediction result for the model input. Returning errors produces the failed
+// prediction payload shape (`data: null` and non-empty `errors`).
+type Responder func(requestId string, modelInput json.RawMessage) (data any, errs []Error)
+
+// EchoResponder returns the model input as the prediction output.
+func EchoResponder(_ string, modelInput json.RawMessage) (any, []Error) {
+	return map[string]json.RawMessage{"output": modelInput}, nil
+}
+
+// ErrorResponder fails every prediction with the given error.
+func ErrorResponder(code, message string) Responder {
+	return func(string, json.RawMessage) (any, []Error) {
+		return nil, []Error{{Code: code, Message: message}}
+	}
+}
+
+// Delivery describes a single webhook delivery attempt made by the Server.
+type Delivery struct {
+	RequestId  string
+	Endpoint   string
+	Payload    []byte
+	StatusCode int
+	Err        error
+}
+
+// Server is a fake Baseten async inference server. Configure the exported fields before serving requests.
+type Server struct {
+	// Secret signs the webhooks (`X-BASETEN-SIGNATURE` header)
+	Secret string
+	// APIKey, when set, is required in the `Authorization: Api-Key <key>` header of prediction requests
+	APIKey string
+	// Delay between accepting the prediction request and posting the webhook
+	Delay time.Duration
+	// Retries is the number of additional delivery attempts after a failed (non-2xx) webhook delivery
+	Retries      int
+	RetryDelay   time.Duration
+	ModelId      string
+	DeploymentId string
+	Respond      Responder
+	HTTPClient   *http.Client
+
+	wg         sync.WaitGroup
+	mu         sync.Mutex
+	deliveries []Delivery
+}
+
+// New creates a Server signing webhooks with secret and echoing model input after delay.
+func New(secret string, delay time.Duration) *Server {
+	return &Server{
+		Secret:       secret,
+		Delay:        delay,
+		Retries:      2,
+		RetryDelay:   100 * time.Millisecond,
+		ModelId:      "sim-model",
+		DeploymentId: "sim-deployment",
+		Respond:      EchoResponder,
+		HTTPClient:   http.DefaultClient,
+	}
+}
+
+// Handler returns the routes of the Baseten async inference API served by the Server.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /production/async_predict", s.handleAsyncPredict)
+	mux.HandleFunc("POST /environments/{environment}/async_predict", s.handleAsyncPredict)
+	mux.HandleFunc("POST /deployment/{deployment_id}/async_predict", s.handleAsyncPredict)
+	return mux
+}
+
+// Wait blocks until all scheduled webhooks are delivered (or failed).
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+// Deliveries returns the webhook delivery attempts made so far.
+func (s *Server) Deliveries() []Delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Delivery(nil), s.deliveries...)
+}
+
+func (s *Server) handleAsyncPredict(w http.ResponseWriter, r *http.Request) {
+	if s.APIKey != "" && r.Header.Get("Authorization") != "Api-Key "+s.APIKey {
+		http.Error(w, `{"error": "unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		ModelInput      json.RawMessage `json:"model_input"`
+		WebhookEndpoint string          `json:"webhook_endpoint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.WebhookEndpoint == "" {
+		http.Error(w, `{"error": "model_input and webhook_endpoint are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	requestId, err := newRequestId()
+	if err != nil {
+		http.Error(w, `{"error": "internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		time.Sleep(s.Delay)
+		s.deliver(requestId, req.WebhookEndpoint, req.ModelInput)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"request_id": requestId})
+}
+
+// deliver posts the signed webhook with the prediction result, retrying failed deliveries
+func (s *Server) deliver(requestId, endpoint string, modelInput json.RawMessage) {
+	body, err := s.payload(requestId, modelInput)
+	if err != nil {
+		s.record(Delivery{RequestId: requestId, Endpoint: endpoint, Err: err})
+		return
+	}
+
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(s.RetryDelay)
+		}
+		d := Delivery{RequestId: requestId, Endpoint: endpoint, Payload: body}
+		d.StatusCode, d.Err = s.post(endpoint, body)
+		s.record(d)
+		if d.Err == nil && d.StatusCode >= 200 && d.StatusCode < 300 {
+			return
+		}
+		log.Printf("basetensim: webhook delivery failed (request_id: %s, status: %d, err: %v)\n", requestId, d.StatusCode, d.Err)
+	}
+}
+
+// payload builds the webhook body in the Baseten format
+func (s *Server) payload(requestId string, modelInput json.RawMessage) ([]byte, error) {
+	data, errs := s.Respond(requestId, modelInput)
+	p := Payload{
+		RequestId:    requestId,
+		ModelId:      s.ModelId,
+		DeploymentId: s.DeploymentId,
+		Type:         "async_request_completed",
+		Time:         time.Now().UTC().Format(time.RFC3339Nano),
+		Data:         json.RawMessage("null"),
+		Errors:       errs,
+	}
+	if p.Errors == nil {
+		p.Errors = []Error{}
+	}
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("encoding prediction output: %w", err)
+		}
+		p.Data = b
+	}
+	return json.Marshal(p)
+}
+
+func (s *Server) post(endpoint string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-BASETEN-SIGNATURE", client.Sign(s.Secret, body))
+
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func (s *Server) record(d Delivery) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries = append(s.deliveries, d)
+}
+
+func newRequestId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	h := hex.EncodeToString(b)
+	return fmt.Sprintf("%s-%s-%s-%s-%s", h[0:8], h[8:12], h[12:16], h[16:20], h[20:]), nil
+}
@@ -0,0 +1,82 @@
+package basetensim
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flowaicom/webhook-proxy/client"
+)
+
+func TestServer_DeliversSignedWebhook(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- b
+	}))
+	defer webhook.Close()
+
+	sim := New("secret", 0)
+	sim.APIKey = "key"
+	srv := httptest.NewServer(sim.Handler())
+	defer srv.Close()
+
+	body := []byte(`{"model_input": {"x": 1}, "webhook_endpoint": "` + webhook.URL + `"}`)
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/environments/production/async_predict", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Api-Key key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected successful async_predict, got %v (err: %v)", resp, err)
+	}
+	var decoded struct {
+		RequestId string `json:"request_id"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&decoded)
+	sim.Wait()
+
+	r, b := <-received, <-bodies
+	if !client.VerifySignature("secret", b, r.Header.Get("X-BASETEN-SIGNATURE")) {
+		t.Errorf("expected valid signature for %s", b)
+	}
+	var p Payload
+	if err = json.Unmarshal(b, &p); err != nil || p.RequestId != decoded.RequestId || p.Type != "async_request_completed" {
+		t.Errorf("unexpected webhook payload %s", b)
+	}
+}
+
+func TestServer_RequiresAPIKey(t *testing.T) {
+	sim := New("secret", 0)
+	sim.APIKey = "key"
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/production/async_predict", bytes.NewBufferString(`{}`))
+	sim.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+func TestServer_RetriesFailedDelivery(t *testing.T) {
+	attempts := 0
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer webhook.Close()
+
+	sim := New("secret", 0)
+	sim.RetryDelay = 0
+	sim.deliver("req1", webhook.URL, json.RawMessage(`{}`))
+
+	d := sim.Deliveries()
+	if len(d) != 2 || d[0].StatusCode != http.StatusServiceUnavailable || d[1].StatusCode != http.StatusOK {
+		t.Errorf("expected failed and then successful delivery, got %+v", d)
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxBatchSize is the maximum number of request IDs in a single batch
+var maxBatchSize = 1000
+
+// batch is a set of requests listened to over a single stream with a single token
+type batch struct {
+	token      streamToken
+	requestIds []string
+
+	mu        sync.Mutex
+	completed map[string]bool
+	cancelled map[string]bool
+}
+
+var (
+	batches        sync.Map // map[batchId string]*batch
+	requestBatches sync.Map // map[requestId string]batchId string
+)
+
+// batchOf returns the batch the request belongs to
+func batchOf(requestId string) (*batch, bool) {
+	batchId, ok := requestBatches.Load(requestId)
+	if !ok {
+		return nil, false
+	}
+	b, ok := batches.Load(batchId)
+	if !ok {
+		return nil, false
+	}
+	return b.(*batch), true
+}
+
+// inBatch returns whether the request is already covered by a batch token
+func inBatch(requestId string) bool {
+	_, ok := requestBatches.Load(requestId)
+	return ok
+}
+
+// complete marks the request result as delivered, returns whether all results of the batch are delivered
+func (b *batch) complete(requestId string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.completed[requestId] = true
+	return len(b.completed) == len(b.requestIds)
+}
+
+// cancel marks the request as cancelled, returns whether all results of the batch are delivered or cancelled
+func (b *batch) cancel(requestId string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.completed[requestId] = true
+	b.cancelled[requestId] = true
+	return len(b.completed) == len(b.requestIds)
+}
+
+func (b *batch) isCompleted(requestId string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.completed[requestId]
+}
+
+// summary returns IDs of the requests with delivered results, of the cancelled ones and of those which never
+// completed
+func (b *batch) summary() (completed, cancelled, missing []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	completed, missing = []string{}, []string{}
+	for _, requestId := range b.requestIds {
+		if b.cancelled[requestId] {
+			cancelled = append(cancelled, requestId)
+		} else if b.completed[requestId] {
+			completed = append(completed, requestId)
+		} else {
+			missing = append(missing, requestId)
+		}
+	}
+	return completed, cancelled, missing
+}
+
+// deleteBatch removes the batch and releases its request IDs
+func deleteBatch(batchId string) {
+	v, ok := batches.LoadAndDelete(batchId)
+	if !ok {
+		return
+	}
+	for _, requestId := range v.(*batch).requestIds {
+		requestBatches.CompareAndDelete(requestId, batchId)
+	}
+	promActiveTokens.Dec()
+}
+
+// handleCreateBatch handles `POST /batch` route. Accepts `request_ids` array in JSON body, generates a single token
+// for listening to all of them over `/listen/batch/{batch_id}` stream. Accepts the same optional overrides
+// as `POST /token`.
+func handleCreateBatch(w http.ResponseWriter, r *http.Request) {
+	if predictOnly {
+		http.Error(w, predictOnlyMessage, http.StatusForbidden)
+		return
+	}
+	var req struct {
+		RequestIds []string `json:"request_ids"`
+		tokenOverrides
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.RequestIds) == 0 {
+		log.Printf("error decoding create batch request or request ids are empty: %v", err)
+		http.Error(w, "Bad request. Field `request_ids` (array of strings) is required.", http.StatusBadRequest)
+		return
+	}
+	if len(req.RequestIds) > maxBatchSize {
+		log.Printf("batch of %d requests exceeds the limit", len(req.RequestIds))
+		http.Error(w, fmt.Sprintf("Bad request. At most %d `request_ids` are allowed in a batch.", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	// Drop duplicates, keep the order
+	seen := map[string]bool{}
+	requestIds := make([]string, 0, len(req.RequestIds))
+	for _, requestId := range req.RequestIds {
+		if requestId == "" {
+			http.Error(w, "Bad request. Field `request_ids` must not contain empty strings.", http.StatusBadRequest)
+			return
+		}
+		if !seen[requestId] {
+			seen[requestId] = true
+			requestIds = append(requestIds, requestId)
+		}
+	}
+
+	st, err := newStreamToken(req.tokenOverrides)
+	if errors.Is(err, errNegativeOverride) {
+		log.Printf("negative duration requested for batch")
+		http.Error(w, negativeOverrideMessage, http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errInvalidTransform) {
+		log.Printf("invalid payload transformation requested for batch")
+		http.Error(w, invalidTransformMessage, http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errInvalidPublicKey) {
+		log.Printf("%v, requested for batch", err)
+		http.Error(w, invalidPublicKeyMessage, http.StatusBadRequest)
+		return
+	}
+	batchId, idErr := generateSecureToken(8)
+	if err != nil || idErr != nil {
+		log.Printf("error generating batch token: %v", errors.Join(err, idErr))
+		http.Error(w, "cannot generate token", http.StatusInternalServerError)
+		return
+	}
+
+	// Claim the request IDs, release the already claimed ones on conflict. The ID is reserved before the token is
+	// checked, so a concurrent `POST /token` sees either the reservation or the token.
+	claimMu.Lock()
+	for n, requestId := range requestIds {
+		_, exists := requestBatches.LoadOrStore(requestId, batchId)
+		if !exists {
+			if _, exists = streamsTokens.Load(requestId); exists {
+				requestBatches.Delete(requestId)
+			}
+		}
+		if exists {
+			for _, claimed := range requestIds[:n] {
+				requestBatches.Delete(claimed)
+			}
+			claimMu.Unlock()
+			log.Printf("token already exists (request_id: %s)", requestId)
+			http.Error(w, "token already exists for request_id "+requestId, http.StatusConflict)
+			return
+		}
+	}
+
+	batches.Store(batchId, &batch{token: st, requestIds: requestIds, completed: map[string]bool{}, cancelled: map[string]bool{}})
+	claimMu.Unlock()
+	promActiveTokens.Inc()
+	for _, requestId := range requestIds {
+		registerRequest(requestId, st.token)
+	}
+	auditRequest(r, auditEntry{Event: auditTokenCreated, BatchId: batchId, RequestIds: requestIds})
+	log.Printf("created batch %s of %d requests", batchId, len(requestIds))
+
+	res := st.response()
+	res["batch_id"] = batchId
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("error responding with batch token (batch_id: %s): %v", batchId, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleBatchStream handles `GET /listen/batch/{batch_id}` route, streams results of all requests in the batch
+// tagged with their request IDs as they arrive
+func handleBatchStream(ctx context.Context) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		batchId := r.PathValue("batch_id")
+		log.Printf("new batch listener, batch_id: %s\n", batchId)
+
+		// Auth
+		var b *batch
+		var requiredToken *streamToken
+		if v, ok := batches.Load(batchId); ok {
+			b = v.(*batch)
+			requiredToken = &b.token
+		}
+		if !checkStreamToken(w, r, batchId, requiredToken) {
+			return
+		}
+
+		keepAlive, err := negotiateKeepAlive(r)
+		if err != nil {
+			log.Printf("invalid keep-alive interval requested (batch_id: %s): %v\n", batchId, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Create stream
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			log.Printf("failed to create stream, batch_id: %s\n", batchId)
+			http.Error(w, "failed to open stream, try again later", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		r = r.WithContext(withStreamToken(r.Context(), b.token.token))
+		batchListenLoop(w, r, batchId, b, flusher, keepAlive, ctx)
+	}
+}
+
+// batchListenLoop holds the batch stream connection, streams the results of the batch requests until all of them
+// are delivered or the stream times out. Ends with the summary of completed and missing requests.
+func batchListenLoop(w http.ResponseWriter, r *http.Request, batchId string, b *batch, flusher http.Flusher, keepAlive time.Duration, ctx context.Context) {
+	ticker := listenerTimers.schedule(keepAlive, true)
+	timeout := listenerTimers.schedule(b.token.streamTimeout(), false)
+	defer listenerTimers.stop(ticker)
+	defer listenerTimers.stop(timeout)
+
+	// Instrument
+	promOpenClientConnections.Inc()
+	promTotalClientConnections.Inc()
+	defer promOpenClientConnections.Dec()
+
+	// Subscribe to every request not delivered yet, notifications are fanned in to `ready`
+	done := make(chan struct{})
+	defer close(done)
+	ready := make(chan string)
+	backlogs := map[string][]Record{}
+	for _, requestId := range b.requestIds {
+		if b.isCompleted(requestId) {
+			continue
+		}
+		records, updates, unsubscribe, err := store.Subscribe(r.Context(), requestId)
+		if errors.Is(err, errStaleStreamToken) {
+			log.Printf("response bound to the previous token (batch_id: %s, request_id: %s)\n", batchId, requestId)
+			http.Error(w, "response bound to the previous token", http.StatusGone)
+			return
+		}
+		if err != nil {
+			log.Printf("failed to retrieve response for (batch_id: %s, request_id: %s): %v\n", batchId, requestId, err)
+			promStoreErrors.WithLabelValues("subscribe").Inc()
+			http.Error(w, "failed to retrieve response", http.StatusInternalServerError)
+			return
+		}
+		defer unsubscribe()
+		backlogs[requestId] = records
+		go func() {
+			for {
+				select {
+				case <-updates:
+					select {
+					case ready <- requestId:
+					case <-done:
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	// Number of events already sent per request
+	sent := map[string]int{}
+	allDone := len(backlogs) == 0
+	for _, requestId := range b.requestIds {
+		if records, ok := backlogs[requestId]; ok && !allDone {
+			finished, err := sendBatchEvents(w, r, b, requestId, records, flusher)
+			if err != nil {
+				log.Printf("failed to respond to batch %s: %v\n", batchId, err)
+				return
+			}
+			sent[requestId] = len(records)
+			allDone = finished
+		}
+	}
+
+	for !allDone {
+		select {
+		case <-r.Context().Done():
+			log.Printf("batch client %s disconnected\n", batchId)
+			return
+		case requestId := <-ready:
+			if b.isCompleted(requestId) {
+				continue
+			}
+			records, err := store.Get(r.Context(), requestId)
+			if errors.Is(err, ErrNotFound) || len(records) < sent[requestId] {
+				continue
+			}
+			if err != nil {
+				log.Printf("failed to retrieve events for (batch_id: %s, request_id: %s): %v\n", batchId, requestId, err)
+				promStoreErrors.WithLabelValues("get").Inc()
+				sendBatchSummary(w, batchId, b, flusher)
+				closeClientConnection(w, batchId, flusher, "store error")
+				return
+			}
+			if allDone, err = sendBatchEvents(w, r, b, requestId, records[sent[requestId]:], flusher); err != nil {
+				log.Printf("failed to respond to batch %s: %v\n", batchId, err)
+				return
+			}
+			sent[requestId] = len(records)
+		case <-ticker.C:
+			if _, err := fmt.Fprintf(w, "data: keep-alive\n\n"); err != nil {
+				log.Printf("failed to ping client (batch_id: %s): %v\n", batchId, err)
+				return
+			}
+			flusher.Flush()
+		case <-timeout.C:
+			sendBatchSummary(w, batchId, b, flusher)
+			closeClientConnection(w, batchId, flusher, "timeout")
+			promTimedOutClients.Inc()
+			return
+		case <-ctx.Done():
+			sendBatchSummary(w, batchId, b, flusher)
+			closeClientConnection(w, batchId, flusher, "context done")
+			return
+		}
+	}
+
+	log.Printf("all results of batch %s delivered\n", batchId)
+	sendBatchSummary(w, batchId, b, flusher)
+	if _, err := fmt.Fprintf(w, "data: eot\n\n"); err != nil {
+		log.Printf("failed to write end of transmision response (batch_id: %s): %v\n", batchId, err)
+	}
+	flusher.Flush()
+	deleteBatch(batchId)
+}
+
+// sendBatchEvents streams the request events tagged with the request ID, until the terminal one. The delivered
+// result is removed from the store. Returns true when all results of the batch are delivered.
+func sendBatchEvents(w http.ResponseWriter, r *http.Request, b *batch, requestId string, records []Record, flusher http.Flusher) (bool, error) {
+	if len(records) > 0 {
+		transitionRequest(requestId, stateStreaming)
+	}
+	for _, record := range records {
+		if _, err := fmt.Fprintf(w, "data: request_id=%s\n\n", requestId); err != nil {
+			return false, fmt.Errorf("failed to write response: %w", err)
+		}
+		if record.cancelled {
+			if _, err := fmt.Fprintf(w, "data: cancelled\n\n"); err != nil {
+				return false, fmt.Errorf("failed to write cancellation: %w", err)
+			}
+			flusher.Flush()
+			return b.cancel(requestId), nil
+		}
+		if err := sendClientEvent(w, record, b.token, flusher); err != nil {
+			return false, err
+		}
+		if record.progress {
+			continue
+		}
+
+		allDone := b.complete(requestId)
+		transitionRequest(requestId, stateDelivered)
+		auditRequest(r, auditEntry{Event: auditDelivered, RequestId: requestId, BatchId: r.PathValue("batch_id")})
+		markConsumed(requestId)
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), storeTimeout)
+		err := store.Delete(ctx, requestId)
+		cancel()
+		if err != nil {
+			log.Printf("payload delivered but failed to delete it from the store (request_id: %s): %v\n", requestId, err)
+			promStoreErrors.WithLabelValues("delete").Inc()
+		}
+		return allDone, nil
+	}
+	return false, nil
+}
+
+// sendBatchSummary sends IDs of the requests with delivered results, of the cancelled ones and of those which never
+// completed
+func sendBatchSummary(w http.ResponseWriter, batchId string, b *batch, flusher http.Flusher) {
+	var summary struct {
+		Completed []string `json:"completed"`
+		Cancelled []string `json:"cancelled,omitempty"`
+		Missing   []string `json:"missing"`
+	}
+	summary.Completed, summary.Cancelled, summary.Missing = b.summary()
+	data, _ := json.Marshal(summary)
+	if _, err := fmt.Fprintf(w, "data: summary=%s\n\n", data); err != nil {
+		log.Printf("failed to send summary (batch_id: %s): %v\n", batchId, err)
+		return
+	}
+	flusher.Flush()
+}
+
+// cleanupBatches deletes batches with expired tokens
+func cleanupBatches() {
+	n := 0
+	batches.Range(func(key, value interface{}) bool {
+		if b := value.(*batch); b.token.expiresAt < time.Now().Unix() {
+			_, _, missing := b.summary()
+			for _, requestId := range missing {
+				expireRequest(requestId)
+			}
+			deleteBatch(key.(string))
+			auditLog.record(auditEntry{Event: auditTokenExpired, BatchId: key.(string)})
+			n++
+		}
+		return true
+	})
+	if n > 0 {
+		log.Printf("%d expired batches, deleting", n)
+	}
+}
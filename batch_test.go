@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// createTestBatch creates a batch with the handler and returns its ID and token
+func createTestBatch(t *testing.T, body string) (string, string) {
+	t.Helper()
+	req, _ := http.NewRequest("POST", "/batch", bytes.NewBufferString(body))
+	rr := httptest.NewRecorder()
+	handleCreateBatch(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d (response body: %s)", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var res struct {
+		BatchId string `json:"batch_id"`
+		Token   string `json:"token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil || res.BatchId == "" || res.Token == "" {
+		t.Fatalf("expected batch id and token, got %s (err: %v)", rr.Body.String(), err)
+	}
+	return res.BatchId, res.Token
+}
+
+func listenTestBatch(batchId, token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/listen/batch/"+batchId, nil)
+	req.SetPathValue("batch_id", batchId)
+	req.Header.Add("Authorization", "Bearer "+token)
+
+	rr := httptest.NewRecorder()
+	handleBatchStream(context.Background())(rr, req)
+	return rr
+}
+
+func TestHandleCreateBatch(t *testing.T) {
+	maxBatchSize = 3
+	defer func() { maxBatchSize = 1000 }()
+
+	tests := []struct {
+		body         string
+		expectedCode int
+	}{
+		{`{"request_ids": ["req1", "req2", "req1"]}`, http.StatusOK},
+		{`{"request_ids": []}`, http.StatusBadRequest},
+		{`{"request_ids": ["req3", ""]}`, http.StatusBadRequest},
+		{`{"request_ids": ["req3", "req4", "req5", "req6"]}`, http.StatusBadRequest},
+		{`{"request_ids": ["req3"], "timeout": -1}`, http.StatusBadRequest},
+		{`{"request_id": "req3"}`, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		resetTestState()
+		req, _ := http.NewRequest("POST", "/batch", bytes.NewBufferString(test.body))
+		rr := httptest.NewRecorder()
+		handleCreateBatch(rr, req)
+		if rr.Code != test.expectedCode {
+			t.Errorf("expected status %d for %s, got %d (response body: %s)", test.expectedCode, test.body, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestHandleCreateBatch_Conflict(t *testing.T) {
+	resetTestState()
+	streamsTokens.Store("req3", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+
+	req, _ := http.NewRequest("POST", "/batch", bytes.NewBufferString(`{"request_ids": ["req1", "req2", "req3"]}`))
+	rr := httptest.NewRecorder()
+	handleCreateBatch(rr, req)
+	if rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), "req3") {
+		t.Errorf("expected status %d naming req3, got %d (response body: %s)", http.StatusConflict, rr.Code, rr.Body.String())
+	}
+
+	// Already claimed request IDs are released
+	if inBatch("req1") || inBatch("req2") || inBatch("req3") {
+		t.Errorf("expected request IDs of the rejected batch to be released")
+	}
+
+	// Single token can't be created for a request in batch
+	createTestBatch(t, `{"request_ids": ["req1", "req2"]}`)
+	req, _ = http.NewRequest("POST", "/token", bytes.NewBufferString(`{"request_id": "req2"}`))
+	rr = httptest.NewRecorder()
+	handleCreateToken(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected status %d, got %d", http.StatusConflict, rr.Code)
+	}
+}
+
+func TestHandleCreateBatch_ConcurrentToken(t *testing.T) {
+	resetTestState()
+
+	// The request ID is claimed either by the batch or by the single token, never both
+	for n := 0; n < 200; n++ {
+		requestId := "req" + strconv.Itoa(n)
+		codes := make([]int, 2)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", "/batch", bytes.NewBufferString(`{"request_ids": ["`+requestId+`"]}`))
+			rr := httptest.NewRecorder()
+			handleCreateBatch(rr, req)
+			codes[0] = rr.Code
+		}()
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", "/token", bytes.NewBufferString(`{"request_id": "`+requestId+`"}`))
+			rr := httptest.NewRecorder()
+			handleCreateToken(rr, req)
+			codes[1] = rr.Code
+		}()
+		wg.Wait()
+		if codes[0] == http.StatusOK && codes[1] == http.StatusOK {
+			t.Fatalf("expected single claim of %s, both batch and token were created", requestId)
+		}
+	}
+}
+
+func TestHandleBatchStream(t *testing.T) {
+	resetTestState()
+	requestTimeout = 10
+
+	batchId, token := createTestBatch(t, `{"request_ids": ["req1", "req2"]}`)
+
+	// req2 result is already waiting, req1 sends progress first
+	store.Append(context.Background(), "req2", Record{content: []byte("result2"), signature: "s2"})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		store.Append(context.Background(), "req1", Record{content: []byte("progress1"), signature: "s1", progress: true})
+		time.Sleep(100 * time.Millisecond)
+		store.Append(context.Background(), "req1", Record{content: []byte("result1"), signature: "s1"})
+	}()
+
+	rr := listenTestBatch(batchId, token)
+	expectedBody := "data: request_id=req2\n\ndata: result2\n\ndata: signature=s2\n\n" +
+		"data: request_id=req1\n\ndata: progress1\n\ndata: signature=s1\n\n" +
+		"data: request_id=req1\n\ndata: result1\n\ndata: signature=s1\n\n" +
+		"data: summary={\"completed\":[\"req1\",\"req2\"],\"missing\":[]}\n\n" +
+		"data: eot\n\n"
+	if rr.Body.String() != expectedBody {
+		t.Errorf("expected body %q, got %q", expectedBody, rr.Body.String())
+	}
+
+	// Batch and delivered results are removed
+	if _, ok := batches.Load(batchId); ok || inBatch("req1") {
+		t.Errorf("expected batch to be deleted")
+	}
+	if _, err := store.Get(context.Background(), "req2"); err == nil {
+		t.Errorf("expected delivered result to be deleted from the store")
+	}
+}
+
+func TestHandleBatchStream_TimeoutSummary(t *testing.T) {
+	resetTestState()
+	requestTimeout = 1
+
+	batchId, token := createTestBatch(t, `{"request_ids": ["req1", "req2"]}`)
+	store.Append(context.Background(), "req1", Record{content: []byte("result1"), signature: "s1"})
+
+	rr := listenTestBatch(batchId, token)
+	expected := "data: summary={\"completed\":[\"req1\"],\"missing\":[\"req2\"]}\n\ndata: server gone\n\n"
+	if !strings.HasSuffix(rr.Body.String(), expected) {
+		t.Errorf("expected body ending with %q, got %q", expected, rr.Body.String())
+	}
+
+	// Reconnecting client gets only the missing results
+	store.Append(context.Background(), "req2", Record{content: []byte("result2"), signature: "s2"})
+	requestTimeout = 10
+	rr = listenTestBatch(batchId, token)
+	if strings.Contains(rr.Body.String(), "result1") || !strings.Contains(rr.Body.String(), "data: result2") || !strings.HasSuffix(rr.Body.String(), "data: eot\n\n") {
+		t.Errorf("expected only the missing result after reconnecting, got %q", rr.Body.String())
+	}
+}
+
+func TestHandleBatchStream_Unauthorized(t *testing.T) {
+	resetTestState()
+	batchId, _ := createTestBatch(t, `{"request_ids": ["req1"]}`)
+
+	for _, id := range []string{batchId, "unknown"} {
+		rr := listenTestBatch(id, "wrong")
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	}
+}
+
+func TestCleanupBatches(t *testing.T) {
+	resetTestState()
+	requestBatches.Store("req1", "expired")
+	batches.Store("expired", &batch{token: streamToken{expiresAt: time.Now().Unix() - 1}, requestIds: []string{"req1"}, completed: map[string]bool{}})
+	requestBatches.Store("req2", "active")
+	batches.Store("active", &batch{token: streamToken{expiresAt: time.Now().Unix() + 60}, requestIds: []string{"req2"}, completed: map[string]bool{}})
+
+	cleanupBatches()
+	if _, ok := batches.Load("expired"); ok || inBatch("req1") {
+		t.Errorf("expected expired batch to be deleted")
+	}
+	if _, ok := batches.Load("active"); !ok || !inBatch("req2") {
+		t.Errorf("expected active batch to be kept")
+	}
+}
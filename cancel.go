@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	// cancelURL is the upstream URL template the cancellations are propagated to with `DELETE`, `{request_id}` is
+	// replaced with the request ID. Cancellations are not propagated when empty.
+	cancelURL string
+	// cancelAPIKey authorizes the upstream cancel requests (`Authorization: Api-Key «key»`)
+	cancelAPIKey string
+)
+
+// Outcomes of the cancellation propagated to the upstream
+const (
+	upstreamCancelled = "cancelled"
+	upstreamFailed    = "failed"
+	upstreamDisabled  = "disabled"
+)
+
+// handleCancelRequest handles `DELETE /requests/{request_id}` route. Authorized with the stream token of the request
+// or its batch. Ends the streams of the request with the `cancelled` event, discards the webhooks received later and
+// propagates the cancellation to the upstream cancel URL, if configured.
+func handleCancelRequest(w http.ResponseWriter, r *http.Request) {
+	requestId := r.PathValue("request_id")
+	var requiredToken *streamToken
+	if t, ok := streamsTokens.Load(requestId); ok {
+		st := t.(streamToken)
+		requiredToken = &st
+	} else if b, ok := batchOf(requestId); ok {
+		requiredToken = &b.token
+	}
+	if !checkStreamToken(w, r, requestId, requiredToken) {
+		return
+	}
+
+	done, err := cancelDelivery(requestId)
+	if errors.Is(err, errCancelledWebhook) {
+		http.Error(w, "already cancelled", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errConsumedWebhook) {
+		http.Error(w, "already delivered", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errCompletedDelivery) {
+		http.Error(w, "already completed", http.StatusConflict)
+		return
+	}
+
+	// The final result already stored would still be delivered to the next listener, it's too late to cancel. The
+	// replay log misses the results stored before restart, they are looked up in the store.
+	ctx := withStreamToken(r.Context(), requiredToken.token)
+	completed, err := hasFinalResult(ctx, requestId)
+	if err != nil {
+		done(false)
+		log.Printf("failed to retrieve events for (request_id: %s): %v\n", requestId, err)
+		promStoreErrors.WithLabelValues("get").Inc()
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if completed {
+		done(false)
+		http.Error(w, "already completed", http.StatusConflict)
+		return
+	}
+
+	// The cancellation marker ends the streams of the current and later listeners until the retention passes
+	record := Record{cancelled: true, retention: requiredToken.recordRetention()}
+	if err = store.Append(ctx, requestId, record); err != nil {
+		done(false)
+		log.Printf("failed to store cancellation (request_id: %s): %v\n", requestId, err)
+		promStoreErrors.WithLabelValues("put").Inc()
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	done(true)
+
+	// The upstream is notified even when the client leaves meanwhile
+	upstream := cancelUpstream(context.WithoutCancel(r.Context()), requestId)
+	log.Printf("request cancelled (request_id: %s, upstream: %s)\n", requestId, upstream)
+	promCancelledRequests.WithLabelValues(upstream).Inc()
+	transitionRequest(requestId, stateCancelled)
+	auditRequest(r, auditEntry{Event: auditCancelled, RequestId: requestId, Reason: "upstream " + upstream})
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]string{"request_id": requestId, "upstream": upstream})
+	if err != nil {
+		log.Printf("error responding to cancellation (request_id: %s): %v\n", requestId, err)
+	}
+}
+
+// hasFinalResult reports whether the final result of the request is stored, waiting for the client
+func hasFinalResult(ctx context.Context, requestId string) (bool, error) {
+	records, err := store.Get(ctx, requestId)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, record := range records {
+		if !record.progress && !record.cancelled {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// cancelUpstream propagates the cancellation to the upstream cancel URL and returns the outcome
+func cancelUpstream(ctx context.Context, requestId string) string {
+	if cancelURL == "" {
+		return upstreamDisabled
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, strings.ReplaceAll(cancelURL, "{request_id}", url.PathEscape(requestId)), nil)
+	if err != nil {
+		log.Printf("error creating upstream cancel request (request_id: %s): %v\n", requestId, err)
+		return upstreamFailed
+	}
+	if cancelAPIKey != "" {
+		req.Header.Set("Authorization", "Api-Key "+cancelAPIKey)
+	}
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		log.Printf("upstream cancel request failed (request_id: %s): %v\n", requestId, err)
+		return upstreamFailed
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxPredictResponseSize))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("upstream cancel request rejected with status %d (request_id: %s)\n", resp.StatusCode, requestId)
+		return upstreamFailed
+	}
+	return upstreamCancelled
+}
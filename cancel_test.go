@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flowaicom/webhook-proxy/client"
+)
+
+// withCancelUpstream configures the upstream cancel URL to a stand-in responding with status, the requested paths
+// are sent to the returned channel
+func withCancelUpstream(t *testing.T, status int) <-chan string {
+	t.Helper()
+	cancelled := make(chan string, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.Header.Get("Authorization") != "Api-Key key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		cancelled <- r.URL.Path
+		w.WriteHeader(status)
+	}))
+	cancelURL, cancelAPIKey = upstream.URL+"/v1/models/model/async_request/{request_id}", "key"
+	t.Cleanup(func() {
+		upstream.Close()
+		cancelURL, cancelAPIKey = "", ""
+	})
+	return cancelled
+}
+
+func cancelTestRequest(requestId, token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("DELETE", "/requests/"+requestId, nil)
+	req.SetPathValue("request_id", requestId)
+	req.Header.Add("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	handleCancelRequest(rr, req)
+	return rr
+}
+
+func TestCancel(t *testing.T) {
+	requestTimeout = 10
+	proxy := newTestProxy(t, nil)
+	upstream := withCancelUpstream(t, http.StatusOK)
+
+	c := client.New(proxy.URL, client.WithTimeout(5*time.Second))
+	token, err := c.CreateToken(context.Background(), "req1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	listenErr := make(chan error, 1)
+	go func() {
+		_, err := c.Listen(context.Background(), "req1", token.Token)
+		listenErr <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err = c.Cancel(context.Background(), "req1", "invalid"); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("expected unauthorized, got %v", err)
+	}
+	upstreamCancelled, err := c.Cancel(context.Background(), "req1", token.Token)
+	if err != nil || !upstreamCancelled {
+		t.Fatalf("expected request cancelled upstream, got %v, %v", upstreamCancelled, err)
+	}
+	if path := <-upstream; path != "/v1/models/model/async_request/req1" {
+		t.Errorf("unexpected upstream cancel path %s", path)
+	}
+
+	select {
+	case err = <-listenErr:
+		if !errors.Is(err, client.ErrCancelled) {
+			t.Errorf("expected listener to end with cancellation, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected listener to end")
+	}
+
+	// Repeated cancellation is refused, the webhook received later is acknowledged and discarded
+	if _, err = c.Cancel(context.Background(), "req1", token.Token); !errors.Is(err, client.ErrCancelled) {
+		t.Errorf("expected already cancelled, got %v", err)
+	}
+	if code := postTestWebhook(`{"request_id": "req1"}`); code != http.StatusOK {
+		t.Errorf("expected webhook to be acknowledged, got %d", code)
+	}
+	records, _ := store.Get(context.Background(), "req1")
+	if len(records) != 1 || !records[0].cancelled {
+		t.Errorf("expected only cancellation stored, got %+v", records)
+	}
+
+	// Later listeners are notified until the retention passes
+	if _, err = c.Listen(context.Background(), "req1", token.Token); !errors.Is(err, client.ErrCancelled) {
+		t.Errorf("expected cancellation, got %v", err)
+	}
+}
+
+func TestCancel_UpstreamFailure(t *testing.T) {
+	proxy := newTestProxy(t, nil)
+	withCancelUpstream(t, http.StatusInternalServerError)
+
+	c := client.New(proxy.URL)
+	token, _ := c.CreateToken(context.Background(), "req1")
+	upstreamCancelled, err := c.Cancel(context.Background(), "req1", token.Token)
+	if err != nil || upstreamCancelled {
+		t.Errorf("expected request cancelled without upstream, got %v, %v", upstreamCancelled, err)
+	}
+	if code := postTestWebhook(`{"request_id": "req1"}`); code != http.StatusOK {
+		t.Errorf("expected webhook to be acknowledged, got %d", code)
+	}
+}
+
+func TestCancel_Batch(t *testing.T) {
+	resetTestState()
+	requestTimeout = 10
+	batchId, token := createTestBatch(t, `{"request_ids": ["req1", "req2"]}`)
+	postTestWebhook(`{"request_id": "req1"}`)
+
+	// Cancellation of a request ends its part of the batch stream
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancelTestRequest("req2", token)
+	}()
+	rr := listenTestBatch(batchId, token)
+	expected := "data: request_id=req2\n\ndata: cancelled\n\n" +
+		"data: summary={\"completed\":[\"req1\"],\"cancelled\":[\"req2\"],\"missing\":[]}\n\ndata: eot\n\n"
+	if !strings.HasSuffix(rr.Body.String(), expected) {
+		t.Errorf("expected batch stream to end with %q, got %q", expected, rr.Body.String())
+	}
+
+	// The batch token stays valid, but the delivered result can't be cancelled anymore
+	batches.Store(batchId, &batch{token: streamToken{token: token, expiresAt: time.Now().Unix() + 60}, requestIds: []string{"req1"}, completed: map[string]bool{}})
+	requestBatches.Store("req1", batchId)
+	if rr = cancelTestRequest("req1", token); rr.Code != http.StatusConflict || rr.Body.String() != "already delivered\n" {
+		t.Errorf("expected cancellation of the delivered result to be refused, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestCancel_AfterFinalResult(t *testing.T) {
+	resetTestState()
+	streamsTokens.Store("req1", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+	postTestWebhook(`{"request_id": "req1", "data": {"output": "ok"}}`)
+
+	// Nobody listened yet, but the result is already there
+	if rr := cancelTestRequest("req1", "a"); rr.Code != http.StatusConflict || rr.Body.String() != "already completed\n" {
+		t.Errorf("expected cancellation of the stored result to be refused, got %d %s", rr.Code, rr.Body.String())
+	}
+	records, _ := store.Get(context.Background(), "req1")
+	if len(records) != 1 || records[0].cancelled {
+		t.Errorf("expected only the result stored, got %+v", records)
+	}
+	if l := lifecycles["req1"]; l == nil || l.state != stateWebhookReceived {
+		t.Errorf("expected webhook_received, got %+v", l)
+	}
+
+	// The result is still delivered
+	if rr := listenWithToken("req1", "a", "10.0.0.1:1234"); !strings.Contains(rr.Body.String(), `"output": "ok"`) {
+		t.Errorf("expected result delivered, got %q", rr.Body.String())
+	}
+}
+
+// blockingStore holds Append until proceed is closed, the calls in flight are signalled on appending
+type blockingStore struct {
+	Store
+	appending chan struct{}
+	proceed   chan struct{}
+	err       error
+}
+
+func (b blockingStore) Append(ctx context.Context, requestId string, record Record) error {
+	b.appending <- struct{}{}
+	<-b.proceed
+	if b.err != nil {
+		return b.err
+	}
+	return b.Store.Append(ctx, requestId, record)
+}
+
+func TestCancel_WebhookInFlight(t *testing.T) {
+	resetTestState()
+	streamsTokens.Store("req1", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+	blocking := blockingStore{Store: store, appending: make(chan struct{}), proceed: make(chan struct{})}
+	store = blocking
+
+	// The final result claimed before the cancellation is stored, the cancellation is refused
+	code := make(chan int, 1)
+	go func() { code <- postTestWebhook(`{"request_id": "req1", "data": {"output": "ok"}}`) }()
+	<-blocking.appending
+	if rr := cancelTestRequest("req1", "a"); rr.Code != http.StatusConflict || rr.Body.String() != "already completed\n" {
+		t.Errorf("expected cancellation of the result in flight to be refused, got %d %s", rr.Code, rr.Body.String())
+	}
+	close(blocking.proceed)
+	if c := <-code; c != http.StatusOK {
+		t.Errorf("expected webhook to be stored, got %d", c)
+	}
+	records, _ := store.Get(context.Background(), "req1")
+	if len(records) != 1 || records[0].cancelled {
+		t.Errorf("expected only the result stored, got %+v", records)
+	}
+}
+
+func TestCancel_WebhookDuringFailedCancel(t *testing.T) {
+	resetTestState()
+	streamsTokens.Store("req1", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+	inMem := store
+	blocking := blockingStore{Store: inMem, appending: make(chan struct{}), proceed: make(chan struct{}), err: errStoreUnavailable}
+	store = blocking
+
+	// The webhook received while cancelling is retried by the provider, so it isn't lost when the cancellation fails
+	code := make(chan int, 1)
+	go func() { code <- cancelTestRequest("req1", "a").Code }()
+	<-blocking.appending
+	if c := postTestWebhook(`{"request_id": "req1"}`); c != http.StatusServiceUnavailable {
+		t.Errorf("expected webhook to be retried later, got %d", c)
+	}
+	close(blocking.proceed)
+	if c := <-code; c != http.StatusServiceUnavailable {
+		t.Fatalf("expected cancellation to fail, got %d", c)
+	}
+
+	store = inMem
+	if c := postTestWebhook(`{"request_id": "req1"}`); c != http.StatusOK {
+		t.Errorf("expected retried webhook to be accepted, got %d", c)
+	}
+	records, _ := store.Get(context.Background(), "req1")
+	if len(records) != 1 || records[0].cancelled {
+		t.Errorf("expected only the result stored, got %+v", records)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flowaicom/webhook-proxy/basetensim"
+	"github.com/flowaicom/webhook-proxy/client"
+)
+
+// Exit codes of the subcommands
+const (
+	exitOK               = 0
+	exitError            = 1
+	exitUsage            = 2
+	exitTimeout          = 3
+	exitServerGone       = 4
+	exitUnauthorized     = 5
+	exitInvalidSignature = 6
+)
+
+// runSubcommand runs the CLI subcommand named in args[0] and reports whether such subcommand exists.
+func runSubcommand(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	switch args[0] {
+	case "wait":
+		return runWait(args[1:], os.Stdout, os.Stderr), true
+	case "send":
+		return runSend(args[1:], os.Stdout, os.Stderr), true
+	case "simulate":
+		return runSimulate(args[1:], os.Stderr), true
+	case "loadtest":
+		return runLoadTest(args[1:], os.Stdout, os.Stderr), true
+	case "audit-verify":
+		return runAuditVerify(args[1:], os.Stdout, os.Stderr), true
+	}
+	return 0, false
+}
+
+// runWait implements `webhook-proxy wait <request_id>`. Obtains a stream token (unless provided), listens for the
+// webhook payload and prints it to stdout.
+func runWait(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("wait", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	proxyURL := fs.String("proxy-url", "http://localhost:8000", "webhook proxy base URL")
+	token := fs.String("token", "", "existing stream token, a new one is requested when empty")
+	secret := fs.String("secret", os.Getenv("BASETEN_WEBHOOK_SECRET"), "webhook secret for signature verification, defaults to BASETEN_WEBHOOK_SECRET env variable. Not verified when empty.")
+	timeout := fs.Int("timeout", 0, "maximum waiting time in seconds, 0 means no client-side limit")
+	pretty := fs.Bool("pretty", false, "pretty print the JSON payload")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(stderr, "usage: webhook-proxy wait [flags] <request_id>\n")
+		fs.PrintDefaults()
+	}
+
+	positional, err := parseInterspersed(fs, args)
+	if err != nil || len(positional) != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	requestId := positional[0]
+
+	c := client.New(*proxyURL, client.WithSecret(*secret), client.WithTimeout(time.Duration(*timeout)*time.Second))
+	ctx := context.Background()
+	if *token == "" {
+		t, err := c.CreateToken(ctx, requestId)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "failed to create stream token: %v\n", err)
+			return exitCodeFor(err)
+		}
+		*token = t.Token
+	}
+
+	res, err := c.Listen(ctx, requestId, *token)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "failed to receive webhook payload: %v\n", err)
+		return exitCodeFor(err)
+	}
+
+	payload := res.Payload
+	if *pretty {
+		var b bytes.Buffer
+		if err = json.Indent(&b, payload, "", "  "); err == nil {
+			payload = b.Bytes()
+		}
+	}
+	_, _ = fmt.Fprintf(stdout, "%s\n", payload)
+	return exitOK
+}
+
+// runSend implements `webhook-proxy send <request_id>`. Posts a Baseten-like test webhook signed with the secret.
+func runSend(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	proxyURL := fs.String("proxy-url", "http://localhost:8000", "webhook proxy base URL")
+	secret := fs.String("secret", os.Getenv("BASETEN_WEBHOOK_SECRET"), "webhook secret used to sign the payload, defaults to BASETEN_WEBHOOK_SECRET env variable")
+	data := fs.String("data", `{"output": "test"}`, "JSON value of the `data` field of the webhook payload")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(stderr, "usage: webhook-proxy send [flags] <request_id>\n")
+		fs.PrintDefaults()
+	}
+
+	positional, err := parseInterspersed(fs, args)
+	if err != nil || len(positional) != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	if !json.Valid([]byte(*data)) {
+		_, _ = fmt.Fprintf(stderr, "-data is not valid JSON\n")
+		return exitUsage
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"request_id":    positional[0],
+		"model_id":      "test",
+		"deployment_id": "test",
+		"type":          "async_request_completed",
+		"time":          time.Now().UTC().Format(time.RFC3339Nano),
+		"data":          json.RawMessage(*data),
+		"errors":        []any{},
+	})
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "failed to encode payload: %v\n", err)
+		return exitError
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*proxyURL, "/")+"/webhook", bytes.NewReader(body))
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "failed to create request: %v\n", err)
+		return exitError
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-BASETEN-SIGNATURE", client.Sign(*secret, body))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "failed to send webhook: %v\n", err)
+		return exitError
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		_, _ = fmt.Fprintf(stderr, "webhook rejected with status %d: %s\n", resp.StatusCode, strings.TrimSpace(string(b)))
+		return exitError
+	}
+
+	_, _ = fmt.Fprintf(stdout, "%s\n", body)
+	return exitOK
+}
+
+// runSimulate implements `webhook-proxy simulate`. Serves a fake Baseten async inference API delivering signed
+// webhooks, until interrupted.
+func runSimulate(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	addr := fs.String("addr", "0.0.0.0:8001", "address and port to listen on")
+	secret := fs.String("secret", os.Getenv("BASETEN_WEBHOOK_SECRET"), "webhook secret used to sign the payloads, defaults to BASETEN_WEBHOOK_SECRET env variable")
+	apiKey := fs.String("api-key", "", "API key required in `Authorization: Api-Key` header, not required when empty")
+	delay := fs.Duration("delay", 5*time.Second, "delay between the prediction request and the webhook delivery")
+	fail := fs.String("fail", "", "when set, every prediction fails with this error message")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return exitUsage
+	}
+
+	sim := basetensim.New(*secret, *delay)
+	sim.APIKey = *apiKey
+	if *fail != "" {
+		sim.Respond = basetensim.ErrorResponder("MODEL_PREDICT_ERROR", *fail)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: *addr, Handler: sim.Handler()}
+	go func() {
+		<-ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+
+	_, _ = fmt.Fprintf(stderr, "simulating Baseten async inference on %s (POST /production/async_predict)\n", *addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		_, _ = fmt.Fprintf(stderr, "simulator server error: %v\n", err)
+		return exitError
+	}
+	sim.Wait()
+	return exitOK
+}
+
+// parseInterspersed parses flags placed both before and after positional arguments and returns the positional ones
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func exitCodeFor(err error) int {
+	switch {
+	case errors.Is(err, client.ErrTimeout):
+		return exitTimeout
+	case errors.Is(err, client.ErrServerGone):
+		return exitServerGone
+	case errors.Is(err, client.ErrUnauthorized), errors.Is(err, client.ErrTokenExists):
+		return exitUnauthorized
+	case errors.Is(err, client.ErrInvalidSignature):
+		return exitInvalidSignature
+	}
+	return exitError
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunSendAndWait(t *testing.T) {
+	requestTimeout = 10
+	srv := newTestProxy(t, nil)
+
+	stdout, stderr := strings.Builder{}, strings.Builder{}
+	if code := runSend([]string{"-proxy-url", srv.URL, "-secret", "s", "-data", `{"output": 42}`, "req1"}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("expected send exit code %d, got %d (stderr: %s)", exitOK, code, stderr.String())
+	}
+
+	stdout.Reset()
+	if code := runWait([]string{"req1", "-proxy-url", srv.URL, "-secret", "s", "-pretty"}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("expected wait exit code %d, got %d (stderr: %s)", exitOK, code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "\"output\": 42") || !strings.Contains(stdout.String(), "\n  \"request_id\": \"req1\"") {
+		t.Errorf("expected pretty printed payload, got %s", stdout.String())
+	}
+}
+
+func TestRunWait_ExitCodes(t *testing.T) {
+	tests := []struct {
+		name         string
+		timeout      int
+		args         []string
+		prepare      func()
+		expectedCode int
+	}{
+		{"usage", 10, []string{}, nil, exitUsage},
+		{"timeout", 10, []string{"-timeout", "1", "req1"}, nil, exitTimeout},
+		{"server gone", 0, []string{"req1"}, nil, exitServerGone},
+		{"unauthorized", 10, []string{"-token", "wrong", "req1"}, func() {
+			streamsTokens.Store("req1", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+		}, exitUnauthorized},
+		{"invalid signature", 10, []string{"-secret", "s", "req1"}, func() {
+			store.Append(context.Background(), "req1", Record{content: []byte(`{"request_id": "req1"}`), signature: "v1=invalid"})
+		}, exitInvalidSignature},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requestTimeout = test.timeout
+			srv := newTestProxy(t, nil)
+			if test.prepare != nil {
+				test.prepare()
+			}
+
+			stdout, stderr := strings.Builder{}, strings.Builder{}
+			code := runWait(append([]string{"-proxy-url", srv.URL}, test.args...), &stdout, &stderr)
+			if code != test.expectedCode {
+				t.Errorf("expected exit code %d, got %d (stderr: %s)", test.expectedCode, code, stderr.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,640 @@
+// Package client implements the webhook proxy token/listen protocol.
+//
+// A typical flow requests a stream token for a Baseten request ID, opens the `/listen` SSE stream and waits
+// for the webhook payload to be delivered:
+//
+//	c := client.New("https://proxy.example.com", client.WithSecret(webhookSecret))
+//	res, err := c.Wait(ctx, requestId)
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrTimeout is returned when the result was not delivered within the client timeout.
+	ErrTimeout = errors.New("webhook proxy: timed out waiting for result")
+	// ErrServerGone is returned when the proxy closed the stream with `server gone`, either because it's shutting
+	// down or because the server-side stream timeout was exceeded.
+	ErrServerGone = errors.New("webhook proxy: server gone")
+	// ErrUnauthorized is returned when the proxy rejected the stream token.
+	ErrUnauthorized = errors.New("webhook proxy: unauthorized")
+	// ErrTokenExists is returned when a token was already generated for the request ID.
+	ErrTokenExists = errors.New("webhook proxy: token already exists")
+	// ErrCancelled is returned when the request was cancelled with Client.Cancel, or the cancellation was refused
+	// because the request was already cancelled.
+	ErrCancelled = errors.New("webhook proxy: request cancelled")
+	// ErrUnknownRequest is returned by Client.Status when the proxy doesn't know the request ID, or the token is not
+	// the one the request was registered with.
+	ErrUnknownRequest = errors.New("webhook proxy: unknown request")
+	// ErrInvalidSignature is returned when the payload signature doesn't match the configured secret.
+	ErrInvalidSignature = errors.New("webhook proxy: invalid payload signature")
+	// ErrTransformFailed is returned when the proxy withheld the payload because it couldn't apply the token
+	// projection or redact fields to it.
+	ErrTransformFailed = errors.New("webhook proxy: payload transformation failed")
+)
+
+// PredictionError is returned when the prediction failed upstream, the final payload carried the Baseten errors.
+// The payload is still returned in the Result.
+type PredictionError struct {
+	RequestId string
+	Errors    []PredictionErrorDetail
+}
+
+// PredictionErrorDetail is a single Baseten prediction error. The proxy sends the codes only, Message is read from
+// the payload, so it's empty when the payload stays encrypted or the errors are redacted from it.
+type PredictionErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *PredictionError) Error() string {
+	details := make([]string, len(e.Errors))
+	for n, d := range e.Errors {
+		details[n] = d.Code
+		if d.Message != "" {
+			details[n] += ": " + d.Message
+		}
+	}
+	return fmt.Sprintf("webhook proxy: prediction %s failed: %s", e.RequestId, strings.Join(details, "; "))
+}
+
+// addMessages fills the error messages from the `errors` array of the Baseten payload, matched by position and code
+func (e *PredictionError) addMessages(payload []byte) {
+	var decoded struct {
+		Errors []PredictionErrorDetail `json:"errors"`
+	}
+	if json.Unmarshal(payload, &decoded) != nil {
+		return
+	}
+	for n := range e.Errors {
+		if n < len(decoded.Errors) && decoded.Errors[n].Code == e.Errors[n].Code {
+			e.Errors[n].Message = decoded.Errors[n].Message
+		}
+	}
+}
+
+// StatusError is returned when the proxy responds with an unexpected HTTP status code.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook proxy: unexpected status %d: %s", e.StatusCode, e.Body)
+}
+
+// Token is a stream token allowing to connect to the `/listen` endpoint for a single request ID.
+type Token struct {
+	Token     string
+	ExpiresAt time.Time
+}
+
+// Event is a single webhook payload streamed by the proxy, either a partial/progress result or the final one.
+type Event struct {
+	Payload   []byte
+	Signature string
+	// Transformed is set when the proxy applied the token projection/redaction to the payload. The signature
+	// belongs to the original payload and can't be verified.
+	Transformed bool
+	// Encrypted is set when the payload is sealed to the client public key and no private key was configured with
+	// WithPrivateKey to decrypt it. Payload is the JSON encoded Envelope, see Open.
+	Encrypted bool
+}
+
+// Result is the final webhook payload delivered by the proxy.
+type Result struct {
+	RequestId string
+	Payload   []byte
+	Signature string
+	// Events are all payloads received for the request in order, the last one being the final payload.
+	Events []Event
+}
+
+// Client talks to a webhook proxy instance. Use New to create one.
+type Client struct {
+	baseURL        string
+	httpClient     *http.Client
+	secret         string
+	timeout        time.Duration
+	idleTimeout    time.Duration
+	reconnectDelay time.Duration
+	maxReconnects  int
+	onEvent        func(Event)
+	privateKey     crypto.PrivateKey
+}
+
+// Option configures the Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for all requests. The client must not have a global timeout set,
+// as it would interrupt the long-lived stream.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithSecret enables payload signature verification with the Baseten webhook secret.
+func WithSecret(secret string) Option {
+	return func(c *Client) { c.secret = secret }
+}
+
+// WithTimeout sets the maximum time Wait and Listen block for the result. Zero means no client-side limit.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.timeout = d }
+}
+
+// WithIdleTimeout sets how long the stream may stay silent (no keep-alive or data) before reconnecting.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *Client) { c.idleTimeout = d }
+}
+
+// WithReconnect sets the maximum number of reconnection attempts after the stream drops and the delay between them.
+func WithReconnect(maxReconnects int, delay time.Duration) Option {
+	return func(c *Client) {
+		c.maxReconnects = maxReconnects
+		c.reconnectDelay = delay
+	}
+}
+
+// WithEventHandler sets a function called with every event as soon as it's received, including the progress
+// events preceding the final payload. The signature is verified before the call when the secret is set.
+func WithEventHandler(fn func(Event)) Option {
+	return func(c *Client) { c.onEvent = fn }
+}
+
+// WithPrivateKey enables end-to-end payload encryption. CreateToken sends the public key of the private key
+// (*ecdh.PrivateKey with X25519 curve or *rsa.PrivateKey) to the proxy, which seals the payloads to it, and Listen
+// decrypts them before the signature is verified.
+func WithPrivateKey(key crypto.PrivateKey) Option {
+	return func(c *Client) { c.privateKey = key }
+}
+
+// New creates a Client for the proxy available at baseURL.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:        strings.TrimSuffix(baseURL, "/"),
+		httpClient:     http.DefaultClient,
+		timeout:        0,
+		idleTimeout:    30 * time.Second,
+		reconnectDelay: time.Second,
+		maxReconnects:  3,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Wait requests a stream token for requestId and blocks until the webhook payload is delivered.
+func (c *Client) Wait(ctx context.Context, requestId string) (*Result, error) {
+	token, err := c.CreateToken(ctx, requestId)
+	if err != nil {
+		return nil, err
+	}
+	return c.Listen(ctx, requestId, token.Token)
+}
+
+// CreateToken requests a new stream token for requestId.
+func (c *Client) CreateToken(ctx context.Context, requestId string) (Token, error) {
+	fields, err := c.tokenFields()
+	if err != nil {
+		return Token{}, err
+	}
+	fields["request_id"] = requestId
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return Token{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/token", strings.NewReader(string(body)))
+	if err != nil {
+		return Token{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return Token{}, err
+	}
+	defer resp.Body.Close()
+
+	if err = checkStatus(resp); err != nil {
+		return Token{}, err
+	}
+
+	var decoded struct {
+		Token     string `json:"token"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return Token{}, fmt.Errorf("webhook proxy: decoding token response: %w", err)
+	}
+	return parseToken(decoded.Token, decoded.ExpiresAt)
+}
+
+// tokenFields returns the token request fields derived from the client options
+func (c *Client) tokenFields() (map[string]any, error) {
+	fields := map[string]any{}
+	if c.privateKey != nil {
+		pub, err := publicKeyOf(c.privateKey)
+		if err != nil {
+			return nil, err
+		}
+		pem, err := MarshalPublicKey(pub)
+		if err != nil {
+			return nil, err
+		}
+		fields["public_key"] = string(pem)
+	}
+	return fields, nil
+}
+
+func parseToken(token, expires string) (Token, error) {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return Token{}, fmt.Errorf("webhook proxy: invalid token expiration %q: %w", expires, err)
+	}
+	return Token{Token: token, ExpiresAt: time.Unix(expiresAt, 0)}, nil
+}
+
+// Predict starts the prediction through the proxy `POST /predict`, which forwards the `async_predict` request to the
+// configured upstream with apiKey and the proxy webhook as `webhook_endpoint`. Returns the request ID with its stream
+// token, so no one else can claim the request ID.
+func (c *Client) Predict(ctx context.Context, apiKey string, request any) (string, Token, error) {
+	b, err := json.Marshal(request)
+	if err != nil {
+		return "", Token{}, err
+	}
+	var fields map[string]any
+	if err = json.Unmarshal(b, &fields); err != nil {
+		return "", Token{}, fmt.Errorf("webhook proxy: prediction request must be a JSON object: %w", err)
+	}
+	if fields["webhook_proxy"], err = c.tokenFields(); err != nil {
+		return "", Token{}, err
+	}
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return "", Token{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/predict", bytes.NewReader(body))
+	if err != nil {
+		return "", Token{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Api-Key "+apiKey)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", Token{}, err
+	}
+	defer resp.Body.Close()
+	if err = checkStatus(resp); err != nil {
+		return "", Token{}, err
+	}
+
+	var decoded struct {
+		RequestId string `json:"request_id"`
+		Token     string `json:"token"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return "", Token{}, fmt.Errorf("webhook proxy: decoding predict response: %w", err)
+	}
+	token, err := parseToken(decoded.Token, decoded.ExpiresAt)
+	return decoded.RequestId, token, err
+}
+
+// Cancel cancels the request with its stream token (or the batch token). The proxy ends the streams of the request
+// with ErrCancelled, discards its webhooks and propagates the cancellation upstream, if configured. Returns whether
+// the upstream cancellation succeeded, false also when it's not configured.
+func (c *Client) Cancel(ctx context.Context, requestId, token string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.baseURL+"/requests/"+url.PathEscape(requestId), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if strings.TrimSpace(string(b)) == "already cancelled" {
+			return false, ErrCancelled
+		}
+		return false, &StatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+	if err = checkStatus(resp); err != nil {
+		return false, err
+	}
+
+	var decoded struct {
+		Upstream string `json:"upstream"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return false, fmt.Errorf("webhook proxy: decoding cancel response: %w", err)
+	}
+	return decoded.Upstream == "cancelled", nil
+}
+
+// Status is the lifecycle state of the request, e.g. `registered`, `webhook_received`, `streaming`, `delivered`,
+// `expired` or `cancelled`.
+type Status struct {
+	State string
+	// History holds the time the request entered every state, in order
+	History []StatusTransition
+}
+
+// StatusTransition is the time the request entered the state.
+type StatusTransition struct {
+	State string
+	At    time.Time
+}
+
+// Status returns the lifecycle state of the request authorized with its stream token. When the prediction failed,
+// the status is returned with *PredictionError.
+func (c *Client) Status(ctx context.Context, requestId, token string) (*Status, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/requests/"+url.PathEscape(requestId)+"/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrUnknownRequest
+	}
+	if err = checkStatus(resp); err != nil {
+		return nil, err
+	}
+
+	var decoded struct {
+		State   string `json:"state"`
+		History []struct {
+			State string `json:"state"`
+			At    string `json:"at"`
+		} `json:"history"`
+		Errors []PredictionErrorDetail `json:"errors"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("webhook proxy: decoding status response: %w", err)
+	}
+	status := &Status{State: decoded.State}
+	for _, t := range decoded.History {
+		at, err := strconv.ParseInt(t.At, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("webhook proxy: invalid transition time %q: %w", t.At, err)
+		}
+		status.History = append(status.History, StatusTransition{State: t.State, At: time.Unix(at, 0)})
+	}
+	if len(decoded.Errors) > 0 {
+		return status, &PredictionError{RequestId: requestId, Errors: decoded.Errors}
+	}
+	return status, nil
+}
+
+// Listen opens the `/listen` stream for requestId and blocks until the final webhook payload is delivered.
+// Progress events received meanwhile are passed to the event handler and collected in Result.Events.
+// Dropped or idle connections are re-established up to the configured number of reconnects.
+func (c *Client) Listen(ctx context.Context, requestId, token string) (*Result, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	// Events received before a reconnect are kept, the proxy streams them again from the beginning
+	res := &Result{RequestId: requestId}
+	for attempt := 0; ; attempt++ {
+		err := c.listenOnce(ctx, res, token)
+		if ctx.Err() != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, ErrTimeout
+			}
+			return nil, ctx.Err()
+		}
+		var predictionErr *PredictionError
+		if errors.Is(err, ErrInvalidSignature) || errors.As(err, &predictionErr) {
+			return res, err
+		}
+		if !errors.Is(err, errStreamDropped) {
+			if err != nil {
+				return nil, err
+			}
+			return res, nil
+		}
+		if attempt >= c.maxReconnects {
+			return nil, err
+		}
+
+		select {
+		case <-time.After(c.reconnectDelay):
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, ErrTimeout
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// errStreamDropped signals that the stream ended without a terminal event and can be reconnected.
+var errStreamDropped = errors.New("webhook proxy: stream dropped")
+
+// listenOnce reads a single stream connection into res, skipping the events already received before
+func (c *Client) listenOnce(ctx context.Context, res *Result, token string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Idle watchdog, covers both waiting for the response headers and silence on an open stream
+	var idled atomic.Bool
+	idle := time.AfterFunc(c.idleTimeout, func() {
+		idled.Store(true)
+		cancel()
+	})
+	defer idle.Stop()
+	dropped := func(err error) error {
+		if idled.Load() {
+			return fmt.Errorf("%w: no data received for %s", errStreamDropped, c.idleTimeout)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: %v", errStreamDropped, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/listen/"+res.RequestId, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return dropped(err)
+	}
+	defer resp.Body.Close()
+
+	if err = checkStatus(resp); err != nil {
+		return err
+	}
+
+	events := make(chan sseEvent)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- readEvents(ctx, resp.Body, events)
+	}()
+
+	// Events streamed over this connection, the payload waits for its signature to complete the event
+	received := 0
+	var payload []byte
+	transformed := false
+	encrypted := ""
+	var predictionErr *PredictionError
+	for {
+		select {
+		case <-ctx.Done():
+			return dropped(ctx.Err())
+		case err = <-readErr:
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return dropped(err)
+		case event := <-events:
+			idle.Reset(c.idleTimeout)
+			data := event.data
+			switch {
+			case event.name == "error":
+				predictionErr = &PredictionError{RequestId: res.RequestId}
+				var decoded struct {
+					Errors []PredictionErrorDetail `json:"errors"`
+				}
+				if err = json.Unmarshal([]byte(data), &decoded); err != nil {
+					return fmt.Errorf("webhook proxy: decoding prediction errors: %w", err)
+				}
+				for _, d := range decoded.Errors {
+					if d.Code == "TRANSFORM_FAILED" {
+						return ErrTransformFailed
+					}
+				}
+				predictionErr.Errors = decoded.Errors
+			case data == "keep-alive":
+			case data == "server gone":
+				return ErrServerGone
+			case data == "cancelled":
+				return ErrCancelled
+			case data == "eot":
+				if res.Payload == nil {
+					return dropped(errors.New("end of transmission without payload"))
+				}
+				if predictionErr != nil {
+					predictionErr.addMessages(res.Payload)
+					return predictionErr
+				}
+				return nil
+			case data == "transformed=true":
+				transformed = true
+			case strings.HasPrefix(data, "encrypted="):
+				encrypted = strings.TrimPrefix(data, "encrypted=")
+			case strings.HasPrefix(data, "signature="):
+				received++
+				eventTransformed, eventEncrypted := transformed, encrypted != ""
+				transformed, encrypted = false, ""
+				if received <= len(res.Events) {
+					continue
+				}
+				if eventEncrypted && c.privateKey != nil {
+					decrypted, err := Open(c.privateKey, payload)
+					if err != nil {
+						return err
+					}
+					payload, eventEncrypted = decrypted, false
+				}
+				event := Event{Payload: payload, Signature: strings.TrimPrefix(data, "signature="), Transformed: eventTransformed, Encrypted: eventEncrypted}
+				res.Events = append(res.Events, event)
+				res.Payload, res.Signature = event.Payload, event.Signature
+				if c.secret != "" && !event.Transformed && !event.Encrypted && !VerifySignature(c.secret, event.Payload, event.Signature) {
+					return ErrInvalidSignature
+				}
+				if c.onEvent != nil {
+					c.onEvent(event)
+				}
+			default:
+				payload = []byte(data)
+			}
+		}
+	}
+}
+
+// sseEvent is a single event of the SSE stream, name is empty for the default `message` events
+type sseEvent struct {
+	name string
+	data string
+}
+
+// readEvents parses the SSE stream and sends every event to the events channel.
+// Multiple `data:` lines within one event are joined with a new line, as defined by the SSE specification.
+func readEvents(ctx context.Context, r io.Reader, events chan<- sseEvent) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	var name string
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(data) == 0 {
+				name = ""
+				continue
+			}
+			select {
+			case events <- sseEvent{name: name, data: strings.Join(data, "\n")}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			name, data = "", data[:0]
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data = append(data, strings.TrimPrefix(value, " "))
+		} else if value, ok = strings.CutPrefix(line, "event:"); ok {
+			name = strings.TrimPrefix(value, " ")
+		}
+	}
+	return scanner.Err()
+}
+
+func checkStatus(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusConflict:
+		return ErrTokenExists
+	default:
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &StatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+}
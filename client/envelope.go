@@ -0,0 +1,207 @@
+package client
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// Schemes of the payloads sealed to the client public key, sent in the `encrypted=` event of the stream.
+const (
+	// SchemeX25519 derives the AES-256-GCM key with HKDF-SHA256 from an ephemeral X25519 key agreement.
+	SchemeX25519 = "x25519-hkdf-sha256-aes256gcm"
+	// SchemeRSA wraps a random AES-256-GCM key with RSA-OAEP-SHA256.
+	SchemeRSA = "rsa-oaep-sha256-aes256gcm"
+)
+
+// minRSABits is the minimum accepted RSA key size
+const minRSABits = 2048
+
+var (
+	// ErrUnsupportedKey is returned for keys other than X25519 and RSA (2048 bits at least).
+	ErrUnsupportedKey = errors.New("webhook proxy: unsupported key, expected X25519 or RSA")
+	// ErrDecryption is returned when the sealed payload can't be opened with the private key.
+	ErrDecryption = errors.New("webhook proxy: payload decryption failed")
+)
+
+// Envelope is the JSON encoded payload sealed to the client public key. Key is the ephemeral X25519 public key
+// or the RSA wrapped content key.
+type Envelope struct {
+	Scheme     string `json:"scheme"`
+	Key        []byte `json:"key"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// ParsePublicKey parses PEM encoded (PKIX, `PUBLIC KEY` block) X25519 or RSA public key.
+func ParsePublicKey(b []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("webhook proxy: expected PEM encoded public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = KeyScheme(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// MarshalPublicKey encodes X25519 or RSA public key in the PEM format accepted by the proxy.
+func MarshalPublicKey(key crypto.PublicKey) ([]byte, error) {
+	if _, err := KeyScheme(key); err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// KeyScheme returns the scheme of the payloads sealed to the public key.
+func KeyScheme(key crypto.PublicKey) (string, error) {
+	switch k := key.(type) {
+	case *ecdh.PublicKey:
+		if k.Curve() == ecdh.X25519() {
+			return SchemeX25519, nil
+		}
+	case *rsa.PublicKey:
+		if k.N.BitLen() >= minRSABits {
+			return SchemeRSA, nil
+		}
+	}
+	return "", ErrUnsupportedKey
+}
+
+// Seal encrypts the payload to the public key, returns JSON encoded Envelope.
+func Seal(key crypto.PublicKey, payload []byte) ([]byte, error) {
+	scheme, err := KeyScheme(key)
+	if err != nil {
+		return nil, err
+	}
+
+	env := Envelope{Scheme: scheme}
+	var contentKey []byte
+	switch k := key.(type) {
+	case *ecdh.PublicKey:
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := ephemeral.ECDH(k)
+		if err != nil {
+			return nil, err
+		}
+		env.Key = ephemeral.PublicKey().Bytes()
+		contentKey = hkdfSHA256(shared, append(env.Key, k.Bytes()...), scheme)
+	case *rsa.PublicKey:
+		contentKey = make([]byte, 32)
+		if _, err = rand.Read(contentKey); err != nil {
+			return nil, err
+		}
+		if env.Key, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, k, contentKey, []byte(scheme)); err != nil {
+			return nil, err
+		}
+	}
+
+	aead, err := newGCM(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	env.Nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(env.Nonce); err != nil {
+		return nil, err
+	}
+	env.Ciphertext = aead.Seal(nil, env.Nonce, payload, []byte(scheme))
+	return json.Marshal(env)
+}
+
+// Open decrypts the JSON encoded Envelope with the private key (*ecdh.PrivateKey or *rsa.PrivateKey).
+func Open(key crypto.PrivateKey, envelope []byte) ([]byte, error) {
+	var env Envelope
+	if err := json.Unmarshal(envelope, &env); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+
+	var contentKey []byte
+	switch k := key.(type) {
+	case *ecdh.PrivateKey:
+		if env.Scheme != SchemeX25519 || k.Curve() != ecdh.X25519() {
+			return nil, fmt.Errorf("%w: scheme %s doesn't match the key", ErrDecryption, env.Scheme)
+		}
+		ephemeral, err := ecdh.X25519().NewPublicKey(env.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDecryption, err)
+		}
+		shared, err := k.ECDH(ephemeral)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDecryption, err)
+		}
+		contentKey = hkdfSHA256(shared, append(env.Key, k.PublicKey().Bytes()...), env.Scheme)
+	case *rsa.PrivateKey:
+		if env.Scheme != SchemeRSA {
+			return nil, fmt.Errorf("%w: scheme %s doesn't match the key", ErrDecryption, env.Scheme)
+		}
+		var err error
+		if contentKey, err = rsa.DecryptOAEP(sha256.New(), nil, k, env.Key, []byte(env.Scheme)); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDecryption, err)
+		}
+	default:
+		return nil, ErrUnsupportedKey
+	}
+
+	aead, err := newGCM(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("%w: invalid nonce", ErrDecryption)
+	}
+	payload, err := aead.Open(nil, env.Nonce, env.Ciphertext, []byte(env.Scheme))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+	return payload, nil
+}
+
+// publicKeyOf returns the public key of X25519 or RSA private key
+func publicKeyOf(key crypto.PrivateKey) (crypto.PublicKey, error) {
+	switch k := key.(type) {
+	case *ecdh.PrivateKey:
+		return k.PublicKey(), nil
+	case *rsa.PrivateKey:
+		return &k.PublicKey, nil
+	}
+	return nil, ErrUnsupportedKey
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// hkdfSHA256 derives 32 bytes key with HKDF (RFC 5869) extract and single expand step
+func hkdfSHA256(secret, salt []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
@@ -0,0 +1,27 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Sign computes the Baseten webhook signature (`v1=<hex HMAC-SHA256>`) of payload with secret.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks the `X-BASETEN-SIGNATURE` value against payload. The header may contain several
+// comma separated signatures (e.g. during secret rotation), any of them matching is sufficient.
+func VerifySignature(secret string, payload []byte, signature string) bool {
+	expected := []byte(Sign(secret, payload))
+	for _, s := range strings.Split(signature, ",") {
+		if hmac.Equal([]byte(strings.TrimSpace(s)), expected) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
+
+	"github.com/flowaicom/webhook-proxy/client"
 )
 
 func handleClientStream(ctx context.Context) func(w http.ResponseWriter, r *http.Request) {
@@ -15,7 +20,16 @@ func handleClientStream(ctx context.Context) func(w http.ResponseWriter, r *http
 		log.Printf("new listener, request_id: %s\n", requestId)
 
 		// Auth
-		if ok := authClientStream(w, r, requestId); !ok {
+		token, ok := authClientStream(w, r, requestId)
+		if !ok {
+			return
+		}
+
+		// Keep-alive interval, optionally negotiated by the client
+		keepAlive, err := negotiateKeepAlive(r)
+		if err != nil {
+			log.Printf("invalid keep-alive interval requested (request_id: %s): %v\n", requestId, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
@@ -31,71 +45,173 @@ func handleClientStream(ctx context.Context) func(w http.ResponseWriter, r *http
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Connection", "keep-alive")
 
-		clientListenLoop(w, r, requestId, flusher, ctx)
+		r = r.WithContext(withStreamToken(r.Context(), token.token))
+		clientListenLoop(w, r, requestId, flusher, keepAlive, token, ctx)
 	}
 }
 
-// authClientStream checks provided Bearer token and validates it with the expected (previously generated) stream token
-func authClientStream(w http.ResponseWriter, r *http.Request, requestId string) bool {
-	// Auth
-	providedToken := r.Header.Get("Authorization")
-	if providedToken == "" {
-		log.Printf("client connected without authorization header: %s\n", requestId)
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return false
+// negotiateKeepAlive returns the keep-alive interval requested with the `keep_alive` query parameter (seconds),
+// or the default one if the parameter is not present
+func negotiateKeepAlive(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("keep_alive")
+	if v == "" {
+		return time.Duration(keepAliveInterval) * time.Second, nil
 	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < minKeepAliveInterval || seconds > maxKeepAliveInterval {
+		return 0, fmt.Errorf("query parameter `keep_alive` must be a number of seconds between %d and %d", minKeepAliveInterval, maxKeepAliveInterval)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
 
+// authClientStream checks provided Bearer token and validates it with the expected (previously generated) stream token
+func authClientStream(w http.ResponseWriter, r *http.Request, requestId string) (streamToken, bool) {
 	t, ok := streamsTokens.Load(requestId)
 	if !ok {
-		log.Printf("client connected but no token found for request_id: %s\n", requestId)
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return false
+		return streamToken{}, checkStreamToken(w, r, requestId, nil)
 	}
-
 	requiredToken := t.(streamToken)
+	return requiredToken, checkStreamToken(w, r, requestId, &requiredToken)
+}
+
+// checkStreamToken validates the credential provided for the stream `id` (request or batch) with the required
+// token, nil if no token was generated. Responds with 401 when invalid.
+func checkStreamToken(w http.ResponseWriter, r *http.Request, id string, requiredToken *streamToken) bool {
+	err := authorizeStream(r, id, requiredToken)
+	if err == nil {
+		return true
+	}
+	if err.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(err.retryAfter.Seconds())))
+	}
+	http.Error(w, err.message, err.status)
+	return false
+}
+
+// streamAuthError is the refused stream authorization, the status and message of the response
+type streamAuthError struct {
+	status     int
+	message    string
+	retryAfter time.Duration
+}
+
+// authorizeStream validates the credential provided for the stream `id` like checkStreamToken, returns the error
+// to respond with when invalid
+func authorizeStream(r *http.Request, id string, requiredToken *streamToken) *streamAuthError {
+	unauthorized := &streamAuthError{status: http.StatusUnauthorized, message: "unauthorized"}
+
+	// Locked out clients are refused before the token is checked, so guessing can't continue
+	ip := clientIP(r)
+	if remaining := lockedOut(id, ip); remaining > 0 {
+		log.Printf("client locked out after failed authorizations: %s (ip: %s)\n", id, ip)
+		auditStreamAccess(r, id, auditStreamAuthFail, "locked out")
+		return &streamAuthError{status: http.StatusTooManyRequests, message: "too many failed authorizations", retryAfter: remaining}
+	}
+
+	credential, kind := streamCredential(r, id)
+	if credential == "" {
+		log.Printf("client connected without credentials: %s\n", id)
+		auditStreamAccess(r, id, auditStreamAuthFail, "missing credentials")
+		return unauthorized
+	}
 
-	if requiredToken.token != strings.TrimPrefix(providedToken, "Bearer ") {
-		log.Printf("client provided invalid token for request_id: %s\n", requestId)
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return false
+	if requiredToken == nil {
+		log.Printf("client connected but no token found for: %s\n", id)
+		auditStreamAccess(r, id, auditStreamAuthFail, "no token")
+		recordAuthFailure(r, id, ip)
+		return unauthorized
+	}
+
+	if !validStreamCredential(id, requiredToken, credential, kind) {
+		log.Printf("client provided invalid token (%s) for: %s\n", kind, id)
+		auditStreamAccess(r, id, auditStreamAuthFail, "invalid token")
+		recordAuthFailure(r, id, ip)
+		return unauthorized
 	}
 
 	if requiredToken.expiresAt < time.Now().Unix() {
-		log.Printf("client provided expired token for request_id: %s\n", requestId)
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return false
+		log.Printf("client provided expired token for: %s\n", id)
+		auditStreamAccess(r, id, auditStreamAuthFail, "expired token")
+		return unauthorized
 	}
 
-	return true
+	auditStreamAccess(r, id, auditStreamAuth, "")
+	recordAuthSuccess(id)
+	return nil
+}
+
+// auditStreamAccess records the stream authorization outcome, `id` is the batch ID on batch streams
+func auditStreamAccess(r *http.Request, id, event, reason string) {
+	auditRequest(r, streamAuditEntry(r, id, event, reason))
+}
+
+// streamAuditEntry returns the audit entry of the stream, `id` is the batch ID on batch streams
+func streamAuditEntry(r *http.Request, id, event, reason string) auditEntry {
+	e := auditEntry{Event: event, RequestId: id, Reason: reason}
+	if r.PathValue("batch_id") != "" {
+		e.RequestId, e.BatchId = "", id
+	}
+	return e
 }
 
-// clientListenLoop holds user http stream connection, streams response when webhook response is available
-func clientListenLoop(w http.ResponseWriter, r *http.Request, requestId string, flusher http.Flusher, ctx context.Context) {
-	ticker := time.NewTicker(5 * time.Second)
-	timeout := time.NewTimer(time.Duration(requestTimeout) * time.Second)
-	defer ticker.Stop()
-	defer timeout.Stop()
+// clientListenLoop holds user http stream connection, streams response when webhook response is available.
+// Keep-alive and timeout events are scheduled on the shared listenerTimers wheel.
+func clientListenLoop(w http.ResponseWriter, r *http.Request, requestId string, flusher http.Flusher, keepAlive time.Duration, token streamToken, ctx context.Context) {
+	ticker := listenerTimers.schedule(keepAlive, true)
+	timeout := listenerTimers.schedule(token.streamTimeout(), false)
+	defer listenerTimers.stop(ticker)
+	defer listenerTimers.stop(timeout)
 
 	// Instrument
 	promOpenClientConnections.Inc()
 	promTotalClientConnections.Inc()
 	defer promOpenClientConnections.Dec()
 
-	// Check if request payload is already there and awaiting
-	_, err := store.Get(requestId)
-	if err == nil {
-		sendClientResponse(w, requestId, flusher)
+	// Backlog of the events received before the client connected, new ones are announced on `updates`
+	records, updates, unsubscribe, err := store.Subscribe(r.Context(), requestId)
+	if errors.Is(err, errStaleStreamToken) {
+		log.Printf("response bound to the previous token (request_id: %s)\n", requestId)
+		http.Error(w, "response bound to the previous token", http.StatusGone)
 		return
 	}
+	if err != nil {
+		log.Printf("failed to retrieve response for (request_id: %s): %v\n", requestId, err)
+		promStoreErrors.WithLabelValues("subscribe").Inc()
+		http.Error(w, "failed to retrieve response", http.StatusInternalServerError)
+		return
+	}
+	defer unsubscribe()
 
+	// Number of events already sent to the client
+	sent := 0
 	for {
+		done, err := sendClientEvents(w, r, requestId, records[sent:], token, flusher)
+		if err != nil {
+			log.Printf("failed to respond to request %s: %v\n", requestId, err)
+			return
+		}
+		if done {
+			return
+		}
+		sent = len(records)
+
 		select {
 		case <-r.Context().Done():
 			log.Printf("client %s disconnected\n", requestId)
 			return
-		case <-store.Await(requestId):
-			sendClientResponse(w, requestId, flusher)
-			return
+		case <-updates:
+			records, err = store.Get(r.Context(), requestId)
+			if errors.Is(err, ErrNotFound) || len(records) < sent {
+				// Another listener completed the stream and removed the log meanwhile
+				closeClientConnection(w, requestId, flusher, "delivered to another listener")
+				return
+			}
+			if err != nil {
+				log.Printf("failed to retrieve events for (request_id: %s): %v\n", requestId, err)
+				promStoreErrors.WithLabelValues("get").Inc()
+				closeClientConnection(w, requestId, flusher, "store error")
+				return
+			}
 		case <-ticker.C:
 			if _, err := fmt.Fprintf(w, "data: keep-alive\n\n"); err != nil {
 				log.Printf("failed to ping client (request_id: %s): %v\n", requestId, err)
@@ -113,32 +229,155 @@ func clientListenLoop(w http.ResponseWriter, r *http.Request, requestId string,
 	}
 }
 
-// sendClientResponse responds to client with the actual webhook payload when it's received
-func sendClientResponse(w http.ResponseWriter, requestId string, flusher http.Flusher) {
-	log.Printf("responding to request %s\n", requestId)
-	record, err := store.Get(requestId)
+// sendClientEvents streams the events to client in order, until the terminal one. Returns true when the terminal
+// event was sent and the stream is complete.
+func sendClientEvents(w http.ResponseWriter, r *http.Request, requestId string, records []Record, token streamToken, flusher http.Flusher) (bool, error) {
+	if len(records) > 0 && !records[0].cancelled {
+		transitionRequest(requestId, stateStreaming)
+	}
+	for _, record := range records {
+		if record.cancelled {
+			return true, sendClientCancelled(w, requestId, flusher)
+		}
+		if !record.progress {
+			return true, sendClientResponse(w, r, requestId, record, token, flusher)
+		}
+		log.Printf("sending progress event to request %s\n", requestId)
+		if err := sendClientEvent(w, record, token, flusher); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// deliveredPayload is the webhook payload as delivered to the client
+type deliveredPayload struct {
+	content     []byte
+	transformed bool
+	// scheme the payload is sealed with to the client public key, empty when not sealed
+	scheme string
+}
+
+// deliverPayload seals the payload to the client public key or applies the payload transformation of the token
+func deliverPayload(record Record, token streamToken) (deliveredPayload, error) {
+	if token.publicKey != nil {
+		p := deliveredPayload{content: record.content}
+		// Payloads received before the token was created are sealed on delivery
+		if !record.sealed {
+			sealed, err := client.Seal(token.publicKey, record.content)
+			if err != nil {
+				return p, fmt.Errorf("failed to seal payload: %w", err)
+			}
+			p.content = sealed
+		}
+		p.scheme, _ = client.KeyScheme(token.publicKey)
+		return p, nil
+	}
+	if !token.transform.empty() {
+		c, err := token.transform.apply(record.content)
+		if err != nil {
+			// The original payload may hold the redacted fields, so it's never sent instead
+			return deliveredPayload{}, fmt.Errorf("%w: %v", errTransformFailed, err)
+		}
+		return deliveredPayload{content: c, transformed: true}, nil
+	}
+	return deliveredPayload{content: record.content}, nil
+}
+
+// sendData writes the content as single event, every line of it in a separate `data` field, so the line breaks of
+// the content don't end the event. Clients join the fields with line breaks.
+func sendData(w io.Writer, content []byte) error {
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if _, err := fmt.Fprintf(w, "data: %s\n", line); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// sendClientEvent writes single webhook payload followed by its signature to the stream. Transformed payload is
+// marked with `transformed=true` event, payload sealed to the client public key with `encrypted=«scheme»` event.
+// The signature applies to the original payload. Payload of the failed prediction is followed by the `error` event.
+// Payload which can't be transformed is withheld, only the `error` event with the TRANSFORM_FAILED code is sent.
+func sendClientEvent(w http.ResponseWriter, record Record, token streamToken, flusher http.Flusher) error {
+	p, err := deliverPayload(record, token)
+	if errors.Is(err, errTransformFailed) {
+		if werr := sendPredictionErrors(w, []predictionError{{Code: transformFailedCode}}); werr != nil {
+			return werr
+		}
+		flusher.Flush()
+	}
 	if err != nil {
-		log.Printf("failed to retrieve response for (request_id: %s): %v\n", requestId, err)
-		http.Error(w, "failed to retrieve response", http.StatusInternalServerError)
-		return
+		return err
 	}
-	if _, err = fmt.Fprintf(w, "data: %s\n\ndata: signature=%s\n\n", record.content, record.signature); err != nil {
-		log.Printf("failed to write response (request_id: %s): %v\n", requestId, err)
-		return
+	marker := ""
+	if p.scheme != "" {
+		marker = "encrypted=" + p.scheme
+	} else if p.transformed {
+		marker = "transformed=true"
+	}
+
+	if err := sendData(w, p.content); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	if marker != "" {
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", marker); err != nil {
+			return fmt.Errorf("failed to write response: %w", err)
+		}
+	}
+	if _, err := fmt.Fprintf(w, "data: signature=%s\n\n", record.signature); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	if len(record.predictionErrors) > 0 {
+		if err := sendPredictionErrors(w, record.predictionErrors); err != nil {
+			return err
+		}
 	}
 	flusher.Flush()
-	if _, err = fmt.Fprintf(w, "data: eot\n\n"); err != nil {
-		log.Printf("failed to write end of transmision response (request_id: %s): %v\n", requestId, err)
-		return
+	return nil
+}
+
+// sendClientResponse responds to client with the final webhook payload and ends the stream
+func sendClientResponse(w http.ResponseWriter, r *http.Request, requestId string, record Record, token streamToken, flusher http.Flusher) error {
+	log.Printf("responding to request %s\n", requestId)
+	if err := sendClientEvent(w, record, token, flusher); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "data: eot\n\n"); err != nil {
+		return fmt.Errorf("failed to write end of transmision response: %w", err)
 	}
 	flusher.Flush()
+	return completeDelivery(r, requestId)
+}
 
-	// Cleanup
-	store.Delete(requestId)
+// completeDelivery cleans up after the final payload is delivered to the client: the token and the stored payloads
+// are deleted, later webhooks are discarded as re-deliveries
+func completeDelivery(r *http.Request, requestId string) error {
+	// The payload is already delivered, so the client leaving must not interrupt the cleanup
+	auditRequest(r, auditEntry{Event: auditDelivered, RequestId: requestId})
+	transitionRequest(requestId, stateDelivered)
+	markConsumed(requestId)
 	streamsTokens.Delete(requestId)
 	promActiveTokens.Dec()
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), storeTimeout)
+	defer cancel()
+	if err := store.Delete(ctx, requestId); err != nil {
+		promStoreErrors.WithLabelValues("delete").Inc()
+		return fmt.Errorf("payload delivered but failed to delete it from the store: %w", err)
+	}
 
-	return
+	return nil
+}
+
+// sendClientCancelled ends the stream of the cancelled request with the `cancelled` event
+func sendClientCancelled(w http.ResponseWriter, requestId string, flusher http.Flusher) error {
+	log.Printf("request %s cancelled, closing client connection\n", requestId)
+	if _, err := fmt.Fprintf(w, "data: cancelled\n\n"); err != nil {
+		return fmt.Errorf("failed to write cancellation: %w", err)
+	}
+	flusher.Flush()
+	return nil
 }
 
 func closeClientConnection(w http.ResponseWriter, requestId string, flusher http.Flusher, reason string) {
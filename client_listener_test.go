@@ -2,14 +2,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestHandleClientStream_NoAuthHeader(t *testing.T) {
@@ -53,7 +60,7 @@ func TestHandleClientStream_InvalidTokens(t *testing.T) {
 
 	// Pre-fill streams tokens map
 	streamsTokens = sync.Map{}
-	streamsTokens.Store("asd", streamToken{"xxxxxx", time.Now().Add(-20 * time.Minute).Unix()})
+	streamsTokens.Store("asd", streamToken{token: "xxxxxx", expiresAt: time.Now().Add(-20 * time.Minute).Unix()})
 
 	// Catch logs output
 	s := strings.Builder{}
@@ -80,7 +87,7 @@ func TestHandleClientStream_InvalidToken(t *testing.T) {
 
 	// Pre-fill streams tokens map
 	streamsTokens = sync.Map{}
-	streamsTokens.Store("asd", streamToken{"yyyyyy", time.Now().Unix()})
+	streamsTokens.Store("asd", streamToken{token: "yyyyyy", expiresAt: time.Now().Unix()})
 
 	// Catch logs output
 	s := strings.Builder{}
@@ -107,10 +114,10 @@ func TestHandleClientStream_WebhookResponseAlreadyPresent(t *testing.T) {
 
 	// Pre-fill streams tokens map
 	streamsTokens = sync.Map{}
-	streamsTokens.Store("asd", streamToken{"a", time.Now().Unix()})
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Unix()})
 
 	store = NewInMemStore() // Initialize store
-	store.Put("asd", Record{[]byte("content"), "signature", 0})
+	store.Append(context.Background(), "asd", Record{content: []byte("content"), signature: "signature"})
 
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(handleClientStream(context.Background()))
@@ -122,7 +129,7 @@ func TestHandleClientStream_WebhookResponseAlreadyPresent(t *testing.T) {
 	}
 
 	// Confirm that token and store entry are deleted
-	if _, err := store.Get("asd"); err == nil {
+	if _, err := store.Get(context.Background(), "asd"); err == nil {
 		t.Errorf("expected store entry to be gone but it's still present")
 	}
 	if _, ok := streamsTokens.Load("asd"); ok {
@@ -138,7 +145,7 @@ func TestHandleClientStream_CloseStreamTimeout(t *testing.T) {
 
 	// Pre-fill streams tokens map
 	streamsTokens = sync.Map{}
-	streamsTokens.Store("asd", streamToken{"a", time.Now().Unix()})
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Unix()})
 
 	store = NewInMemStore() // Initialize store
 	requestTimeout = 0      // Set request timeout (seconds)
@@ -168,7 +175,7 @@ func TestHandleClientStream_ContextDone(t *testing.T) {
 
 	// Pre-fill streams tokens map
 	streamsTokens = sync.Map{}
-	streamsTokens.Store("asd", streamToken{"a", time.Now().Unix()})
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Unix()})
 
 	store = NewInMemStore() // Initialize store
 	requestTimeout = 10     // Set request timeout (seconds)
@@ -207,7 +214,7 @@ func TestHandleClientStream_RequestContextDone(t *testing.T) {
 
 	// Pre-fill streams tokens map
 	streamsTokens = sync.Map{}
-	streamsTokens.Store("asd", streamToken{"a", time.Now().Unix()})
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Unix()})
 
 	store = NewInMemStore() // Initialize store
 	requestTimeout = 10     // Set request timeout (seconds)
@@ -243,7 +250,7 @@ func TestHandleClientStream_SendResponse(t *testing.T) {
 
 	// Pre-fill streams tokens map
 	streamsTokens = sync.Map{}
-	streamsTokens.Store("asd", streamToken{"a", time.Now().Unix()})
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Unix()})
 
 	store = NewInMemStore() // Initialize store
 	requestTimeout = 10     // Set request timeout (seconds)
@@ -255,7 +262,7 @@ func TestHandleClientStream_SendResponse(t *testing.T) {
 	go func() {
 		tc := time.NewTimer(100 * time.Millisecond)
 		<-tc.C
-		store.Put("asd", Record{[]byte("content"), "signature", 0})
+		store.Append(context.Background(), "asd", Record{content: []byte("content"), signature: "signature"})
 	}()
 
 	handler.ServeHTTP(rr, req)
@@ -265,10 +272,290 @@ func TestHandleClientStream_SendResponse(t *testing.T) {
 	}
 
 	// Confirm that token and store entry are deleted
-	if _, err := store.Get("asd"); err == nil {
+	if _, err := store.Get(context.Background(), "asd"); err == nil {
 		t.Errorf("expected store entry to be gone but it's still present")
 	}
 	if _, ok := streamsTokens.Load("asd"); ok {
 		t.Errorf("expected stream token to be gone but it's still present")
 	}
 }
+
+func TestHandleClientStream_MultiLinePayload(t *testing.T) {
+	resetTestState()
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+	store.Append(context.Background(), "asd", Record{content: []byte("{\n  \"output\": \"ok\"\n}"), signature: "signature"})
+
+	rr := listenWithToken("asd", "a", "10.0.0.1:1234")
+	expectedBody := "data: {\ndata:   \"output\": \"ok\"\ndata: }\n\ndata: signature=signature\n\ndata: eot\n\n"
+	if rr.Body.String() != expectedBody {
+		t.Errorf("expected every payload line in its own data field %q, got %q", expectedBody, rr.Body.String())
+	}
+}
+
+func TestHandleClientStream_ProgressEvents(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/listen/asd", nil)
+	req.SetPathValue("request_id", "asd")
+	req.Header.Add("Authorization", "Bearer a")
+
+	streamsTokens = sync.Map{}
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+	store = NewInMemStore()
+	requestTimeout = 10
+
+	// Backlog received before the client connected, the rest is delivered while listening
+	store.Append(context.Background(), "asd", Record{content: []byte("progress1"), signature: "s1", progress: true})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		store.Append(context.Background(), "asd", Record{content: []byte("progress2"), signature: "s2", progress: true})
+		time.Sleep(100 * time.Millisecond)
+		store.Append(context.Background(), "asd", Record{content: []byte("final"), signature: "s3"})
+	}()
+
+	rr := httptest.NewRecorder()
+	handleClientStream(context.Background())(rr, req)
+
+	expectedBody := "data: progress1\n\ndata: signature=s1\n\n" +
+		"data: progress2\n\ndata: signature=s2\n\n" +
+		"data: final\n\ndata: signature=s3\n\ndata: eot\n\n"
+	if rr.Body.String() != expectedBody {
+		t.Errorf("expected body %q, got %q", expectedBody, rr.Body.String())
+	}
+	if _, err := store.Get(context.Background(), "asd"); err == nil {
+		t.Errorf("expected store entry to be gone but it's still present")
+	}
+}
+
+// benchmarkListen measures the whole /listen path (auth, stream setup, delivery, cleanup) for a request whose
+// webhook payload is already waiting in the store
+func benchmarkListen(requestId string) {
+	req, _ := http.NewRequest("GET", "/listen/"+requestId, nil)
+	req.SetPathValue("request_id", requestId)
+	req.Header.Add("Authorization", "Bearer a")
+	streamsTokens.Store(requestId, streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+	store.Append(context.Background(), requestId, Record{content: []byte(`{"request_id": "` + requestId + `"}`), signature: "signature"})
+
+	rr := httptest.NewRecorder()
+	handleClientStream(context.Background())(rr, req)
+}
+
+func BenchmarkHandleClientStream(b *testing.B) {
+	streamsTokens = sync.Map{}
+	store = NewInMemStore()
+	requestTimeout = 10
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkListen(strconv.Itoa(i))
+	}
+}
+
+func BenchmarkHandleClientStreamParallel(b *testing.B) {
+	streamsTokens = sync.Map{}
+	store = NewInMemStore()
+	requestTimeout = 10
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	var n atomic.Int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			benchmarkListen(strconv.FormatInt(n.Add(1), 10))
+		}
+	})
+}
+
+// BenchmarkHandleClientStreamIdleListeners measures the delivery to a waiting listener while thousands of other
+// listeners are connected and idle, waiting for their webhooks
+func BenchmarkHandleClientStreamIdleListeners(b *testing.B) {
+	streamsTokens = sync.Map{}
+	store = NewInMemStore()
+	requestTimeout = 600
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	const idle = 5000
+	open := testutil.ToFloat64(promOpenClientConnections)
+	ctx, cancel := context.WithCancel(context.Background())
+	var listeners sync.WaitGroup
+	for i := 0; i < idle; i++ {
+		requestId := "idle-" + strconv.Itoa(i)
+		req, _ := http.NewRequest("GET", "/listen/"+requestId, nil)
+		req.SetPathValue("request_id", requestId)
+		req.Header.Add("Authorization", "Bearer a")
+		streamsTokens.Store(requestId, streamToken{token: "a", expiresAt: time.Now().Add(time.Hour).Unix()})
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			handleClientStream(ctx)(httptest.NewRecorder(), req)
+		}()
+	}
+	for testutil.ToFloat64(promOpenClientConnections) < open+idle {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	goroutines := runtime.NumGoroutine()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		requestId := strconv.Itoa(i)
+		req, _ := http.NewRequest("GET", "/listen/"+requestId, nil)
+		req.SetPathValue("request_id", requestId)
+		req.Header.Add("Authorization", "Bearer a")
+		streamsTokens.Store(requestId, streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handleClientStream(ctx)(httptest.NewRecorder(), req)
+		}()
+		store.Append(context.Background(), requestId, Record{content: []byte(`{"request_id": "` + requestId + `"}`), signature: "signature"})
+		<-done
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(goroutines), "goroutines")
+	b.ReportMetric(float64(m.HeapInuse)/(1<<20), "heap-MiB")
+
+	cancel()
+	listeners.Wait()
+}
+
+func TestHandleClientStream_NegotiatedKeepAlive(t *testing.T) {
+	// Prepare request
+	req, _ := http.NewRequest("GET", "/listen/asd?keep_alive=1", nil)
+	req.SetPathValue("request_id", "asd")
+	req.Header.Add("Authorization", "Bearer a")
+
+	// Pre-fill streams tokens map
+	streamsTokens = sync.Map{}
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+
+	store = NewInMemStore() // Initialize store
+	requestTimeout = 10     // Set request timeout (seconds)
+
+	rr := httptest.NewRecorder()
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := http.HandlerFunc(handleClientStream(ctx))
+
+	// Cancel context after the first keep-alive is due
+	go func() {
+		tc := time.NewTimer(1500 * time.Millisecond)
+		<-tc.C
+		cancel()
+	}()
+
+	handler.ServeHTTP(rr, req)
+	expectedBody := "data: keep-alive\n\ndata: server gone\n\n"
+	if rr.Code != http.StatusOK || rr.Body.String() != expectedBody {
+		t.Errorf("expected body '%s', got %s", expectedBody, rr.Body.String())
+	}
+}
+
+func TestHandleClientStream_InvalidKeepAlive(t *testing.T) {
+	for _, v := range []string{"0", "abc", "3600"} {
+		req, _ := http.NewRequest("GET", "/listen/asd?keep_alive="+v, nil)
+		req.SetPathValue("request_id", "asd")
+		req.Header.Add("Authorization", "Bearer a")
+
+		streamsTokens = sync.Map{}
+		streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+
+		rr := httptest.NewRecorder()
+		handleClientStream(context.Background())(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d for keep_alive=%s, got %d", http.StatusBadRequest, v, rr.Code)
+		}
+	}
+}
+
+func TestHandleClientStream_UnsubscribesOnDisconnect(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/listen/asd", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	req = req.WithContext(ctx)
+	req.SetPathValue("request_id", "asd")
+	req.Header.Add("Authorization", "Bearer a")
+
+	streamsTokens = sync.Map{}
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+
+	s := NewInMemStore()
+	store = s
+	requestTimeout = 10
+
+	rr := httptest.NewRecorder()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	handleClientStream(context.Background())(rr, req)
+
+	// Webhook delivered after the listener left must not block
+	done := make(chan struct{})
+	go func() {
+		store.Append(context.Background(), "asd", Record{content: []byte("content"), signature: "signature"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("webhook delivery blocked after the listener disconnected")
+	}
+	if len(s.listeners) != 0 {
+		t.Errorf("expected listener to be unregistered, got %d", len(s.listeners))
+	}
+}
+
+func TestHandleClientStream_StoreFailure(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/listen/asd", nil)
+	req.SetPathValue("request_id", "asd")
+	req.Header.Add("Authorization", "Bearer a")
+
+	streamsTokens = sync.Map{}
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+	store = failingStore{}
+
+	rr := httptest.NewRecorder()
+	handleClientStream(context.Background())(rr, req)
+	if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), "failed to retrieve response") {
+		t.Errorf("expected status %d, got %d (response body: %s)", http.StatusInternalServerError, rr.Code, rr.Body.String())
+	}
+}
+
+func TestSendClientResponse_DeleteFailure(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/listen/asd", nil)
+	streamsTokens = sync.Map{}
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+	store = failingStore{}
+
+	rr := httptest.NewRecorder()
+	err := sendClientResponse(rr, req, "asd", Record{content: []byte("content"), signature: "signature"}, streamToken{}, rr)
+	if err == nil || !errors.Is(err, errStoreUnavailable) {
+		t.Errorf("expected store failure to be reported, got %v", err)
+	}
+	if !strings.Contains(rr.Body.String(), "data: eot") {
+		t.Errorf("expected payload to be delivered, got %s", rr.Body.String())
+	}
+}
+
+func TestHandleClientStream_RequestedTimeout(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/listen/asd", nil)
+	req.SetPathValue("request_id", "asd")
+	req.Header.Add("Authorization", "Bearer a")
+
+	streamsTokens = sync.Map{}
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix(), timeout: 200 * time.Millisecond})
+	store = NewInMemStore()
+	requestTimeout = 10
+
+	s := strings.Builder{}
+	log.SetOutput(&s)
+
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	handleClientStream(context.Background())(rr, req)
+	if elapsed := time.Since(start); elapsed > 2*time.Second || !strings.Contains(s.String(), "reason: timeout") {
+		t.Errorf("expected client requested timeout after 200ms, got %s (logs: %s)", elapsed, s.String())
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+// Test Go client package against the real handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flowaicom/webhook-proxy/client"
+)
+
+// resetTestState replaces the store and the request state shared by the handlers with empty ones
+func resetTestState() {
+	store = NewInMemStore()
+	deliveries = map[string]*deliveryLog{}
+	streamsTokens, batches, requestBatches = sync.Map{}, sync.Map{}, sync.Map{}
+	lockouts = map[string]*lockout{}
+	lifecycles = map[string]*lifecycle{}
+	accessTokens = sync.Map{}
+}
+
+// newTestProxy starts the proxy handlers on a local test server with a fresh store and tokens map
+func newTestProxy(t *testing.T, wrap func(http.Handler) http.Handler) *httptest.Server {
+	t.Helper()
+	resetTestState()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var handler http.Handler = newServeMux(ctx)
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+	srv := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		cancel()
+		srv.Close()
+		streamsTokens = sync.Map{}
+	})
+	return srv
+}
+
+func TestClient_Wait(t *testing.T) {
+	requestTimeout = 10
+	srv := newTestProxy(t, nil)
+	payload := []byte(`{"request_id": "req1", "data": {"output": "ok"}}`)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		store.Append(context.Background(), "req1", Record{content: payload, signature: client.Sign("secret", payload)})
+	}()
+
+	c := client.New(srv.URL, client.WithSecret("secret"), client.WithTimeout(5*time.Second))
+	res, err := c.Wait(context.Background(), "req1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if string(res.Payload) != string(payload) {
+		t.Errorf("expected payload %s, got %s", payload, res.Payload)
+	}
+	if res.RequestId != "req1" {
+		t.Errorf("expected request id req1, got %s", res.RequestId)
+	}
+}
+
+func TestClient_MultiLinePayload(t *testing.T) {
+	requestTimeout = 10
+	srv := newTestProxy(t, nil)
+	payload := []byte("{\n  \"request_id\": \"req1\",\n\n  \"data\": {\"output\": \"ok\"}\n}\n")
+	store.Append(context.Background(), "req1", Record{content: payload, signature: client.Sign("secret", payload)})
+
+	c := client.New(srv.URL, client.WithSecret("secret"), client.WithTimeout(5*time.Second))
+	res, err := c.Wait(context.Background(), "req1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if string(res.Payload) != string(payload) {
+		t.Errorf("expected payload %q, got %q", payload, res.Payload)
+	}
+}
+
+func TestClient_ProgressEvents(t *testing.T) {
+	withStatusField(t, "status")
+	requestTimeout = 10
+	srv := newTestProxy(t, nil)
+	payloads := [][]byte{
+		[]byte(`{"request_id": "req1", "status": "in_progress", "data": {"step": 1}}`),
+		[]byte(`{"request_id": "req1", "status": "in_progress", "data": {"step": 2}}`),
+		[]byte(`{"request_id": "req1", "status": "completed", "data": {"output": "ok"}}`),
+	}
+
+	// The first event is already waiting, the rest is delivered through the webhook handler
+	store.Append(context.Background(), "req1", Record{content: payloads[0], signature: client.Sign("secret", payloads[0]), progress: true})
+	go func() {
+		for _, payload := range payloads[1:] {
+			time.Sleep(100 * time.Millisecond)
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+"/webhook", bytes.NewReader(payload))
+			req.Header.Set("X-BASETEN-SIGNATURE", client.Sign("secret", payload))
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	var handled []string
+	c := client.New(srv.URL, client.WithSecret("secret"), client.WithTimeout(5*time.Second), client.WithEventHandler(func(e client.Event) {
+		handled = append(handled, string(e.Payload))
+	}))
+	res, err := c.Wait(context.Background(), "req1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if string(res.Payload) != string(payloads[2]) {
+		t.Errorf("expected final payload %s, got %s", payloads[2], res.Payload)
+	}
+	if len(res.Events) != 3 || len(handled) != 3 {
+		t.Fatalf("expected 3 events collected and handled, got %d and %d", len(res.Events), len(handled))
+	}
+	for n, payload := range payloads {
+		if handled[n] != string(payload) {
+			t.Errorf("expected event %d to be %s, got %s", n, payload, handled[n])
+		}
+	}
+}
+
+func TestClient_InvalidSignature(t *testing.T) {
+	requestTimeout = 10
+	srv := newTestProxy(t, nil)
+	store.Append(context.Background(), "req1", Record{content: []byte(`{"request_id": "req1"}`), signature: "v1=deadbeef"})
+
+	c := client.New(srv.URL, client.WithSecret("secret"))
+	if _, err := c.Wait(context.Background(), "req1"); !errors.Is(err, client.ErrInvalidSignature) {
+		t.Errorf("expected ErrInvalidSignature, got %v", err)
+	}
+}
+
+func TestClient_TransformedEvent(t *testing.T) {
+	requestTimeout = 10
+	srv := newTestProxy(t, nil)
+	transform, _ := newPayloadTransform(nil, []string{"prompt"})
+	streamsTokens.Store("req1", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix(), transform: transform})
+	payload := []byte(`{"request_id": "req1", "prompt": "secret"}`)
+	store.Append(context.Background(), "req1", Record{content: payload, signature: client.Sign("secret", payload)})
+
+	c := client.New(srv.URL, client.WithSecret("secret"))
+	res, err := c.Listen(context.Background(), "req1", "a")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if string(res.Payload) != `{"request_id":"req1"}` || !res.Events[0].Transformed {
+		t.Errorf("expected transformed payload, got %s (transformed: %v)", res.Payload, res.Events[0].Transformed)
+	}
+}
+
+func TestClient_TransformFailed(t *testing.T) {
+	requestTimeout = 10
+	srv := newTestProxy(t, nil)
+	transform, _ := newPayloadTransform(nil, []string{"prompt"})
+	streamsTokens.Store("req1", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix(), transform: transform})
+	store.Append(context.Background(), "req1", Record{content: []byte(`{"prompt": "secret"`), signature: "s"})
+
+	c := client.New(srv.URL)
+	if res, err := c.Listen(context.Background(), "req1", "a"); !errors.Is(err, client.ErrTransformFailed) || res != nil {
+		t.Errorf("expected ErrTransformFailed, got %v %v", res, err)
+	}
+}
+
+func TestClient_Unauthorized(t *testing.T) {
+	srv := newTestProxy(t, nil)
+	streamsTokens.Store("req1", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+
+	c := client.New(srv.URL)
+	if _, err := c.Listen(context.Background(), "req1", "b"); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("expected ErrUnauthorized, got %v", err)
+	}
+}
+
+func TestClient_TokenExists(t *testing.T) {
+	srv := newTestProxy(t, nil)
+	streamsTokens.Store("req1", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+
+	c := client.New(srv.URL)
+	if _, err := c.CreateToken(context.Background(), "req1"); !errors.Is(err, client.ErrTokenExists) {
+		t.Errorf("expected ErrTokenExists, got %v", err)
+	}
+}
+
+func TestClient_ServerGone(t *testing.T) {
+	requestTimeout = 0
+	srv := newTestProxy(t, nil)
+
+	c := client.New(srv.URL)
+	if _, err := c.Wait(context.Background(), "req1"); !errors.Is(err, client.ErrServerGone) {
+		t.Errorf("expected ErrServerGone, got %v", err)
+	}
+}
+
+func TestClient_Timeout(t *testing.T) {
+	requestTimeout = 10
+	srv := newTestProxy(t, nil)
+
+	c := client.New(srv.URL, client.WithTimeout(200*time.Millisecond))
+	if _, err := c.Wait(context.Background(), "req1"); !errors.Is(err, client.ErrTimeout) {
+		t.Errorf("expected ErrTimeout, got %v", err)
+	}
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	requestTimeout = 10
+	var dropped sync.Once
+	srv := newTestProxy(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Drop the first stream connection without any terminal event
+			first := false
+			dropped.Do(func() { first = r.Method == http.MethodGet })
+			if first {
+				w.Header().Set("Content-Type", "text/event-stream")
+				_, _ = w.Write([]byte("data: keep-alive\n\n"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	payload := []byte(`{"request_id": "req1"}`)
+	streamsTokens.Store("req1", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+	store.Append(context.Background(), "req1", Record{content: payload, signature: "sig"})
+
+	c := client.New(srv.URL, client.WithReconnect(1, 10*time.Millisecond))
+	res, err := c.Listen(context.Background(), "req1", "a")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if string(res.Payload) != string(payload) || res.Signature != "sig" {
+		t.Errorf("expected payload %s with signature sig, got %s with signature %s", payload, res.Payload, res.Signature)
+	}
+}
+
+func TestClient_IdleReconnectExhausted(t *testing.T) {
+	requestTimeout = 10
+	srv := newTestProxy(t, nil)
+	streamsTokens.Store("req1", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+
+	c := client.New(srv.URL, client.WithIdleTimeout(50*time.Millisecond), client.WithReconnect(1, 10*time.Millisecond))
+	if _, err := c.Listen(context.Background(), "req1", "a"); err == nil || errors.Is(err, client.ErrTimeout) {
+		t.Errorf("expected dropped stream error, got %v", err)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	payload := []byte(`{"request_id": "req1"}`)
+	sig := client.Sign("secret", payload)
+
+	if !client.VerifySignature("secret", payload, sig) {
+		t.Errorf("expected signature %s to be valid", sig)
+	}
+	if !client.VerifySignature("secret", payload, "v1=old, "+sig) {
+		t.Errorf("expected one of multiple signatures to be valid")
+	}
+	if client.VerifySignature("other", payload, sig) {
+		t.Errorf("expected signature with different secret to be invalid")
+	}
+}
+
+func TestClient_EndToEndEncryption(t *testing.T) {
+	withStatusField(t, "status")
+	x25519Key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	payloads := [][]byte{
+		[]byte(`{"request_id": "req1", "status": "in_progress"}`),
+		[]byte(`{"request_id": "req1", "status": "completed", "data": {"output": "sensitive"}}`),
+	}
+
+	for name, key := range map[string]crypto.PrivateKey{"x25519": x25519Key, "rsa": rsaKey} {
+		t.Run(name, func(t *testing.T) {
+			requestTimeout = 10
+			srv := newTestProxy(t, nil)
+
+			var sealed [][]byte
+			inner := store
+			store = storeFunc{Store: inner, onAppend: func(r Record) { sealed = append(sealed, r.content) }}
+
+			// Progress payload received before the token is sealed on delivery, the final one on receipt
+			inner.Append(context.Background(), "req1", Record{content: payloads[0], signature: client.Sign("secret", payloads[0]), progress: true})
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				req, _ := http.NewRequest(http.MethodPost, srv.URL+"/webhook", bytes.NewReader(payloads[1]))
+				req.Header.Set("X-BASETEN-SIGNATURE", client.Sign("secret", payloads[1]))
+				if resp, err := http.DefaultClient.Do(req); err == nil {
+					resp.Body.Close()
+				}
+			}()
+
+			c := client.New(srv.URL, client.WithSecret("secret"), client.WithPrivateKey(key), client.WithTimeout(5*time.Second))
+			res, err := c.Wait(context.Background(), "req1")
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if len(res.Events) != 2 || string(res.Events[0].Payload) != string(payloads[0]) || string(res.Payload) != string(payloads[1]) {
+				t.Errorf("expected decrypted payloads, got %v", res.Events)
+			}
+			if len(sealed) != 1 || bytes.Contains(sealed[0], []byte("sensitive")) {
+				t.Errorf("expected payload sealed before storing, got %s", sealed)
+			}
+		})
+	}
+}
+
+// storeFunc calls onAppend with every record appended to the store
+type storeFunc struct {
+	Store
+	onAppend func(Record)
+}
+
+func (s storeFunc) Append(ctx context.Context, requestId string, record Record) error {
+	s.onAppend(record)
+	return s.Store.Append(ctx, requestId, record)
+}
+
+func TestEnvelope(t *testing.T) {
+	key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	otherKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	pem, _ := client.MarshalPublicKey(key.PublicKey())
+	pub, err := client.ParsePublicKey(pem)
+	if err != nil {
+		t.Fatalf("expected public key to parse, got %v", err)
+	}
+
+	envelope, _ := client.Seal(pub, []byte("payload"))
+	if payload, err := client.Open(key, envelope); err != nil || string(payload) != "payload" {
+		t.Errorf("expected payload, got %s (err: %v)", payload, err)
+	}
+	if _, err = client.Open(otherKey, envelope); !errors.Is(err, client.ErrDecryption) {
+		t.Errorf("expected ErrDecryption with another key, got %v", err)
+	}
+
+	weakKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	if _, err = client.MarshalPublicKey(&weakKey.PublicKey); !errors.Is(err, client.ErrUnsupportedKey) {
+		t.Errorf("expected ErrUnsupportedKey for 1024 bit RSA key, got %v", err)
+	}
+}
+
+func TestHandleCreateToken_InvalidPublicKey(t *testing.T) {
+	key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	pem, _ := client.MarshalPublicKey(key.PublicKey())
+	for _, body := range []map[string]any{
+		{"request_id": "asd", "public_key": "not a key"},
+		{"request_id": "asd", "public_key": string(pem), "redact": []string{"data"}},
+	} {
+		streamsTokens = sync.Map{}
+		b, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/token", bytes.NewReader(b))
+		rr := httptest.NewRecorder()
+		handleCreateToken(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d for %s, got %d", http.StatusBadRequest, b, rr.Code)
+		}
+	}
+}
+
+func TestClient_Status(t *testing.T) {
+	requestTimeout = 10
+	srv := newTestProxy(t, nil)
+	c := client.New(srv.URL, client.WithTimeout(5*time.Second))
+
+	if _, err := c.Status(context.Background(), "req1", ""); !errors.Is(err, client.ErrUnknownRequest) {
+		t.Errorf("expected unknown request, got %v", err)
+	}
+
+	token, _ := c.CreateToken(context.Background(), "req1")
+	status, err := c.Status(context.Background(), "req1", token.Token)
+	if err != nil || status.State != "registered" || len(status.History) != 1 || status.History[0].At.IsZero() {
+		t.Errorf("expected registered, got %+v %v", status, err)
+	}
+
+	postTestWebhook(`{"request_id": "req1", "data": null, "errors": [{"code": "MODEL_PREDICT_ERROR", "message": "out of memory"}]}`)
+	res, err := c.Listen(context.Background(), "req1", token.Token)
+	var predictionErr *client.PredictionError
+	if !errors.As(err, &predictionErr) || res == nil || predictionErr.RequestId != "req1" || predictionErr.Errors[0].Message != "out of memory" {
+		t.Fatalf("expected prediction error with the payload, got %v %v", res, err)
+	}
+
+	status, err = c.Status(context.Background(), "req1", token.Token)
+	if !errors.As(err, &predictionErr) || status == nil || status.State != "delivered" {
+		t.Errorf("expected delivered with prediction error, got %+v %v", status, err)
+	}
+}
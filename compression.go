@@ -0,0 +1,198 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressThreshold is the minimum size in bytes of webhook payloads compressed in the store, 0 disables compression
+var compressThreshold = 0
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// compressingStore is a Store decorator compressing record content with zstd at rest. Content smaller than
+// the threshold or not compressible is stored as is.
+type compressingStore struct {
+	Store
+	threshold int
+}
+
+func newCompressingStore(s Store, threshold int) *compressingStore {
+	return &compressingStore{Store: s, threshold: threshold}
+}
+
+func (c *compressingStore) Append(ctx context.Context, requestId string, record Record) error {
+	if len(record.content) >= c.threshold {
+		compressed := zstdEncoder.EncodeAll(record.content, nil)
+		if len(compressed) < len(record.content) {
+			promCompressionRatio.WithLabelValues("store").Observe(float64(len(record.content)) / float64(len(compressed)))
+			record.content, record.compressed = compressed, true
+		}
+	}
+	return c.Store.Append(ctx, requestId, record)
+}
+
+func (c *compressingStore) Get(ctx context.Context, requestId string) ([]Record, error) {
+	records, err := c.Store.Get(ctx, requestId)
+	if err != nil {
+		return nil, err
+	}
+	return decompressRecords(records)
+}
+
+func (c *compressingStore) Subscribe(ctx context.Context, requestId string) ([]Record, <-chan struct{}, func(), error) {
+	records, updates, unsubscribe, err := c.Store.Subscribe(ctx, requestId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if records, err = decompressRecords(records); err != nil {
+		unsubscribe()
+		return nil, nil, nil, err
+	}
+	return records, updates, unsubscribe, nil
+}
+
+// decompressRecords returns copy of the records with decompressed content
+func decompressRecords(records []Record) ([]Record, error) {
+	out := make([]Record, len(records))
+	for n, record := range records {
+		if record.compressed {
+			content, err := zstdDecoder.DecodeAll(record.content, nil)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decompress record: %w", err)
+			}
+			record.content, record.compressed = content, false
+		}
+		out[n] = record
+	}
+	return out, nil
+}
+
+// acceptsGzip returns whether the client accepts gzip content encoding
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, _, _ = strings.Cut(enc, ";")
+		if strings.EqualFold(strings.TrimSpace(enc), "gzip") {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipStreamWriter compresses the response stream, every flush sends the events written so far to the client
+type gzipStreamWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+	// written counts uncompressed bytes
+	written int
+}
+
+// countingWriter counts bytes written to the underlying writer
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
+func (g *gzipStreamWriter) WriteHeader(code int) {
+	g.Header().Del("Content-Length")
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipStreamWriter) Write(p []byte) (int, error) {
+	n, err := g.gz.Write(p)
+	g.written += n
+	return n, err
+}
+
+func (g *gzipStreamWriter) Flush() {
+	_ = g.gz.Flush()
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// gzipStream serves gzip compressed streams to clients sending `Accept-Encoding: gzip`
+func gzipStream(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		counter := &countingWriter{w: w}
+		gz, _ := gzip.NewWriterLevel(counter, gzip.BestSpeed)
+		g := &gzipStreamWriter{ResponseWriter: w, gz: gz}
+		defer func() {
+			_ = gz.Close()
+			if counter.n > 0 {
+				promCompressionRatio.WithLabelValues("stream").Observe(float64(g.written) / float64(counter.n))
+			}
+		}()
+		next(g, r)
+	}
+}
+
+// gzipBodyLimit bounds decompressed webhook bodies, protects against decompression bombs
+var gzipBodyLimit int64 = 64 << 20
+
+var (
+	// errInvalidEncoding is returned by readWebhookBody when the body can't be decompressed
+	errInvalidEncoding = errors.New("invalid gzip encoded body")
+	// errBodyTooLarge is returned by readWebhookBody when the decompressed body exceeds gzipBodyLimit
+	errBodyTooLarge = errors.New("decompressed body too large")
+)
+
+// countingReader counts bytes read from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// readWebhookBody reads the webhook body, decompressed if sent with `Content-Encoding: gzip`
+func readWebhookBody(r *http.Request) ([]byte, error) {
+	if !strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		return io.ReadAll(r.Body)
+	}
+
+	counter := &countingReader{r: r.Body}
+	gz, err := gzip.NewReader(counter)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidEncoding, err)
+	}
+	defer gz.Close()
+	b, err := io.ReadAll(io.LimitReader(gz, gzipBodyLimit+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidEncoding, err)
+	}
+	if int64(len(b)) > gzipBodyLimit {
+		return nil, errBodyTooLarge
+	}
+	if counter.n > 0 {
+		promCompressionRatio.WithLabelValues("webhook").Observe(float64(len(b)) / float64(counter.n))
+	}
+	return b, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressingStoreConformance(t *testing.T) {
+	testStoreConformance(t, func() Store { return newCompressingStore(NewInMemStore(), 1) })
+}
+
+func TestCompressingStore_Threshold(t *testing.T) {
+	inner := NewInMemStore()
+	s := newCompressingStore(inner, 100)
+	large := []byte(`{"request_id": "req1", "data": "` + strings.Repeat("evaluation ", 100) + `"}`)
+
+	_ = s.Append(context.Background(), "req1", Record{content: []byte(`{"request_id": "req1"}`)})
+	_ = s.Append(context.Background(), "req1", Record{content: large})
+
+	stored, _ := inner.Get(context.Background(), "req1")
+	if stored[0].compressed || !stored[1].compressed || len(stored[1].content) >= len(large) {
+		t.Errorf("expected only the payload above threshold to be compressed, got compressed=%v,%v", stored[0].compressed, stored[1].compressed)
+	}
+
+	got, err := s.Get(context.Background(), "req1")
+	if err != nil || !bytes.Equal(got[1].content, large) || got[1].compressed {
+		t.Errorf("expected decompressed payload, got %s (err: %v)", got[1].content, err)
+	}
+}
+
+func gzipBytes(b []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, _ = gz.Write(b)
+	_ = gz.Close()
+	return buf.Bytes()
+}
+
+func TestHandleIncomingWebhook_GzipBody(t *testing.T) {
+	resetTestState()
+	body := `{"request_id": "asd"}`
+
+	req, _ := http.NewRequest("POST", "/webhook", bytes.NewReader(gzipBytes([]byte(body))))
+	req.Header.Set("X-BASETEN-SIGNATURE", "xxx")
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	handleIncomingWebhook(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v (response body: %s)", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	records, err := store.Get(context.Background(), "asd")
+	if err != nil || string(records[0].content) != body {
+		t.Errorf("expected decompressed body stored, got %v (err: %v)", records, err)
+	}
+
+	// Not gzip
+	req, _ = http.NewRequest("POST", "/webhook", bytes.NewBufferString(body))
+	req.Header.Set("X-BASETEN-SIGNATURE", "xxx")
+	req.Header.Set("Content-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	handleIncomingWebhook(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandleIncomingWebhook_GzipBodyTooLarge(t *testing.T) {
+	resetTestState()
+	gzipBodyLimit = 18
+	defer func() { gzipBodyLimit = 64 << 20 }()
+
+	for body, expected := range map[string]int{
+		`{"request_id":"asd"}`: http.StatusRequestEntityTooLarge,
+		`{"request_id":"a"}`:   http.StatusOK,
+	} {
+		req, _ := http.NewRequest("POST", "/webhook", bytes.NewReader(gzipBytes([]byte(body))))
+		req.Header.Set("X-BASETEN-SIGNATURE", "xxx")
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		handleIncomingWebhook(rr, req)
+		if rr.Code != expected {
+			t.Errorf("expected status %d for %d bytes body, got %d", expected, len(body), rr.Code)
+		}
+	}
+
+	// Truncated body is not stored
+	if _, err := store.Get(context.Background(), "asd"); err == nil {
+		t.Errorf("expected oversized body not to be stored")
+	}
+}
+
+func TestHandleClientStream_Gzip(t *testing.T) {
+	resetTestState()
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+	store.Append(context.Background(), "asd", Record{content: []byte("content"), signature: "signature"})
+
+	req, _ := http.NewRequest("GET", "/listen/asd", nil)
+	req.SetPathValue("request_id", "asd")
+	req.Header.Add("Authorization", "Bearer a")
+	req.Header.Add("Accept-Encoding", "deflate, gzip;q=0.9")
+
+	rr := httptest.NewRecorder()
+	gzipStream(handleClientStream(context.Background()))(rr, req)
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip content encoding, got headers %v", rr.Header())
+	}
+
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatalf("expected gzip stream, got err: %v", err)
+	}
+	b, _ := io.ReadAll(gz)
+	expectedBody := "data: content\n\ndata: signature=signature\n\ndata: eot\n\n"
+	if string(b) != expectedBody {
+		t.Errorf("expected body %q, got %q", expectedBody, b)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var (
+	// corsOrigins is the comma separated list of origins allowed to call the token and stream endpoints from
+	// browsers, `*` allows any origin. CORS is disabled when empty.
+	corsOrigins string
+	// corsCredentials allows browsers to send cookies with the cross-origin requests
+	corsCredentials bool
+)
+
+var errWildcardCredentials = errors.New("-cors-origins `*` can't be combined with -cors-credentials, list the origins instead")
+
+// corsOriginList returns the configured origins
+func corsOriginList() []string {
+	origins := strings.Split(corsOrigins, ",")
+	for n := range origins {
+		origins[n] = strings.TrimSpace(origins[n])
+	}
+	return origins
+}
+
+// validateCORS rejects the wildcard origin with credentials, which would let any site make credentialed requests
+func validateCORS() error {
+	if corsCredentials && corsOrigins != "" && slices.Contains(corsOriginList(), "*") {
+		return errWildcardCredentials
+	}
+	return nil
+}
+
+// allowedOrigin returns the value of the Access-Control-Allow-Origin header for the request origin, empty when
+// the origin is not allowed
+func allowedOrigin(origin string) string {
+	if origin == "" || corsOrigins == "" {
+		return ""
+	}
+	origins := corsOriginList()
+	switch {
+	case slices.Contains(origins, origin):
+		return origin
+	case slices.Contains(origins, "*") && !corsCredentials:
+		return "*"
+	}
+	return ""
+}
+
+// cors sets the CORS headers of the responses to allowed origins
+func cors(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		if origin := allowedOrigin(r.Header.Get("Origin")); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if corsCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		next(w, r)
+	}
+}
+
+// handleCORSPreflight responds to the `OPTIONS` preflight requests of allowed origins
+func handleCORSPreflight(w http.ResponseWriter, r *http.Request) {
+	if w.Header().Get("Access-Control-Allow-Origin") == "" {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,95 @@
+package main
+
+// End-to-end flow against the fake Baseten server: async_predict -> /token -> /listen -> /webhook -> delivery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flowaicom/webhook-proxy/basetensim"
+	"github.com/flowaicom/webhook-proxy/client"
+)
+
+// asyncPredict starts a prediction on the simulator with the proxy webhook endpoint and returns the request ID
+func asyncPredict(t *testing.T, simURL, proxyURL, modelInput string) string {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{
+		"webhook_endpoint": proxyURL + "/webhook",
+		"model_input":      json.RawMessage(modelInput),
+	})
+	resp, err := http.Post(simURL+"/production/async_predict", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("async_predict request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var decoded struct {
+		RequestId string `json:"request_id"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&decoded); err != nil || decoded.RequestId == "" {
+		t.Fatalf("async_predict returned no request id (status %d): %v", resp.StatusCode, err)
+	}
+	return decoded.RequestId
+}
+
+func TestEndToEnd_Success(t *testing.T) {
+	requestTimeout = 10
+	proxy := newTestProxy(t, nil)
+	sim := basetensim.New("secret", 200*time.Millisecond)
+	simSrv := httptest.NewServer(sim.Handler())
+	defer simSrv.Close()
+
+	requestId := asyncPredict(t, simSrv.URL, proxy.URL, `{"prompt": "hi"}`)
+
+	c := client.New(proxy.URL, client.WithSecret("secret"), client.WithTimeout(5*time.Second))
+	res, err := c.Wait(context.Background(), requestId)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var payload basetensim.Payload
+	if err = json.Unmarshal(res.Payload, &payload); err != nil {
+		t.Fatalf("expected Baseten payload, got %s: %v", res.Payload, err)
+	}
+	if payload.RequestId != requestId || string(payload.Data) != `{"output":{"prompt":"hi"}}` || len(payload.Errors) != 0 {
+		t.Errorf("unexpected payload delivered: %s", res.Payload)
+	}
+
+	sim.Wait()
+	if d := sim.Deliveries(); len(d) != 1 || d[0].StatusCode != http.StatusOK {
+		t.Errorf("expected single successful delivery, got %+v", d)
+	}
+}
+
+func TestEndToEnd_WebhookBeforeListen(t *testing.T) {
+	requestTimeout = 10
+	proxy := newTestProxy(t, nil)
+	sim := basetensim.New("secret", 0)
+	sim.Respond = basetensim.ErrorResponder("MODEL_PREDICT_ERROR", "out of memory")
+	simSrv := httptest.NewServer(sim.Handler())
+	defer simSrv.Close()
+
+	requestId := asyncPredict(t, simSrv.URL, proxy.URL, `{}`)
+	sim.Wait()
+
+	c := client.New(proxy.URL, client.WithSecret("secret"), client.WithTimeout(5*time.Second))
+	res, err := c.Wait(context.Background(), requestId)
+	var predictionErr *client.PredictionError
+	if !errors.As(err, &predictionErr) || len(predictionErr.Errors) != 1 || predictionErr.Errors[0].Code != "MODEL_PREDICT_ERROR" {
+		t.Fatalf("expected prediction error, got %v", err)
+	}
+
+	var payload basetensim.Payload
+	if err = json.Unmarshal(res.Payload, &payload); err != nil {
+		t.Fatalf("expected Baseten payload, got %s: %v", res.Payload, err)
+	}
+	if string(payload.Data) != "null" || len(payload.Errors) != 1 || payload.Errors[0].Message != "out of memory" {
+		t.Errorf("expected error payload, got %s", res.Payload)
+	}
+}
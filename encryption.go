@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	// encryptionKeysFile is the file with the keys encrypting webhook payloads at rest, see loadEncryptionKeys
+	encryptionKeysFile string
+	// encryptionTokenBound derives per-request keys from the stream token, so the store contents (backups, a shared
+	// backend) can't be decrypted with the keys alone. It doesn't protect against access to the proxy process, which
+	// holds both the keys and the tokens of the undelivered requests in memory.
+	encryptionTokenBound bool
+)
+
+var (
+	errUnknownEncryptionKey = errors.New("record encrypted with unknown key")
+	errMissingStreamToken   = errors.New("record encrypted with stream token bound key, but the token is not provided")
+	// errStaleStreamToken is returned for the records bound to the previous stream token of the request, the token
+	// created after it expired can't decrypt them
+	errStaleStreamToken = errors.New("record encrypted with key bound to another stream token")
+)
+
+// encryptionKeys is the key ring used for encryption at rest. Records are encrypted with the primary key and
+// decrypted with the key of the ID stored in the record, so keys can be rotated by adding a new primary key and
+// keeping the old ones until the records encrypted with them expire.
+type encryptionKeys struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// loadEncryptionKeys parses keys in `«key id»:«base64 AES key»` format separated by new lines or commas, from the file
+// or from the PROXY_ENCRYPTION_KEYS env variable when the path is empty. The first key is the primary one.
+// Returns nil when no keys are configured.
+func loadEncryptionKeys(path string) (*encryptionKeys, error) {
+	raw := os.Getenv("PROXY_ENCRYPTION_KEYS")
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		raw = string(b)
+	}
+
+	var k *encryptionKeys
+	for _, entry := range strings.FieldsFunc(raw, func(r rune) bool { return r == '\n' || r == ',' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("encryption key must be in `«key id»:«base64 key»` format")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s: %w", id, err)
+		}
+		if _, err = aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("encryption key %s: %w", id, err)
+		}
+		if k == nil {
+			k = &encryptionKeys{primary: id, keys: map[string][]byte{}}
+		}
+		if _, ok = k.keys[id]; ok {
+			return nil, fmt.Errorf("duplicate encryption key %s", id)
+		}
+		k.keys[id] = key
+	}
+	return k, nil
+}
+
+type streamTokenCtxKey struct{}
+
+// withStreamToken attaches the stream token of the request to the context, for deriving token bound keys
+func withStreamToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, streamTokenCtxKey{}, token)
+}
+
+func streamTokenFrom(ctx context.Context) string {
+	token, _ := ctx.Value(streamTokenCtxKey{}).(string)
+	return token
+}
+
+// encryptingStore is a Store decorator encrypting record content with AES-GCM at rest. The request ID is
+// authenticated with the content, so records can't be swapped between requests.
+type encryptingStore struct {
+	Store
+	keys *encryptionKeys
+	// tokenBound derives per-request keys from the stream token, when it is known at the time the record is stored
+	tokenBound bool
+}
+
+func newEncryptingStore(s Store, keys *encryptionKeys, tokenBound bool) *encryptingStore {
+	return &encryptingStore{Store: s, keys: keys, tokenBound: tokenBound}
+}
+
+// aead returns the cipher for the record key, derived from the stream token for token bound records
+func (e *encryptingStore) aead(ctx context.Context, requestId, keyId string, tokenBound bool) (cipher.AEAD, error) {
+	key, ok := e.keys.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errUnknownEncryptionKey, keyId)
+	}
+	if tokenBound {
+		token := streamTokenFrom(ctx)
+		if token == "" {
+			return nil, errMissingStreamToken
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(requestId + "\x00" + token))
+		key = mac.Sum(nil)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (e *encryptingStore) Append(ctx context.Context, requestId string, record Record) error {
+	tokenBound := e.tokenBound && streamTokenFrom(ctx) != ""
+	aead, err := e.aead(ctx, requestId, e.keys.primary, tokenBound)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(record.content)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	record.content = aead.Seal(nonce, nonce, record.content, []byte(requestId))
+	record.keyId, record.tokenBound = e.keys.primary, tokenBound
+	return e.Store.Append(ctx, requestId, record)
+}
+
+func (e *encryptingStore) Get(ctx context.Context, requestId string) ([]Record, error) {
+	records, err := e.Store.Get(ctx, requestId)
+	if err != nil {
+		return nil, err
+	}
+	return e.decryptRecords(ctx, requestId, records)
+}
+
+func (e *encryptingStore) Subscribe(ctx context.Context, requestId string) ([]Record, <-chan struct{}, func(), error) {
+	records, updates, unsubscribe, err := e.Store.Subscribe(ctx, requestId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if records, err = e.decryptRecords(ctx, requestId, records); err != nil {
+		unsubscribe()
+		return nil, nil, nil, err
+	}
+	return records, updates, unsubscribe, nil
+}
+
+// decryptRecords returns copy of the records with decrypted content
+func (e *encryptingStore) decryptRecords(ctx context.Context, requestId string, records []Record) ([]Record, error) {
+	out := make([]Record, len(records))
+	for n, record := range records {
+		if record.keyId != "" {
+			aead, err := e.aead(ctx, requestId, record.keyId, record.tokenBound)
+			if err != nil {
+				return nil, err
+			}
+			if len(record.content) < aead.NonceSize() {
+				return nil, errors.New("failed to decrypt record: content too short")
+			}
+			nonce, sealed := record.content[:aead.NonceSize()], record.content[aead.NonceSize():]
+			content, err := aead.Open(nil, nonce, sealed, []byte(requestId))
+			if err != nil && record.tokenBound {
+				return nil, fmt.Errorf("failed to decrypt record: %w", errStaleStreamToken)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt record: %w", err)
+			}
+			record.content, record.keyId, record.tokenBound = content, "", false
+		}
+		out[n] = record
+	}
+	return out, nil
+}
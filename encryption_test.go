@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testEncryptionKeys(t *testing.T, config string) *encryptionKeys {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadEncryptionKeys(path)
+	if err != nil || keys == nil {
+		t.Fatalf("expected keys to load, got %v", err)
+	}
+	return keys
+}
+
+var (
+	testKey1 = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	testKey2 = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+)
+
+func TestEncryptingStoreConformance(t *testing.T) {
+	keys := testEncryptionKeys(t, "k1:"+testKey1)
+	testStoreConformance(t, func() Store { return newEncryptingStore(NewInMemStore(), keys, false) })
+	testStoreConformance(t, func() Store { return newCompressingStore(newEncryptingStore(NewInMemStore(), keys, true), 1) })
+}
+
+func TestLoadEncryptionKeys(t *testing.T) {
+	t.Setenv("PROXY_ENCRYPTION_KEYS", "env:"+testKey1)
+	keys, err := loadEncryptionKeys("")
+	if err != nil || keys.primary != "env" {
+		t.Errorf("expected keys from env, got %v (err: %v)", keys, err)
+	}
+
+	keys = testEncryptionKeys(t, "# rotated\nk2:"+testKey2+"\nk1:"+testKey1+"\n")
+	if keys.primary != "k2" || len(keys.keys) != 2 {
+		t.Errorf("expected first key to be primary, got %s of %d keys", keys.primary, len(keys.keys))
+	}
+
+	for _, config := range []string{"k1", ":" + testKey1, "k1:not base64", "k1:" + base64.StdEncoding.EncodeToString([]byte("short")), "k1:" + testKey1 + ",k1:" + testKey2} {
+		path := filepath.Join(t.TempDir(), "keys")
+		_ = os.WriteFile(path, []byte(config), 0o600)
+		if _, err = loadEncryptionKeys(path); err == nil {
+			t.Errorf("expected error loading %q", config)
+		}
+	}
+}
+
+func TestEncryptingStore_AtRest(t *testing.T) {
+	inner := NewInMemStore()
+	s := newEncryptingStore(inner, testEncryptionKeys(t, "k1:"+testKey1), false)
+	content := []byte(`{"request_id": "req1", "output": "sensitive"}`)
+	_ = s.Append(context.Background(), "req1", Record{content: content})
+
+	stored, _ := inner.Get(context.Background(), "req1")
+	if bytes.Contains(stored[0].content, []byte("sensitive")) || stored[0].keyId != "k1" {
+		t.Errorf("expected content encrypted with k1, got %s (key: %s)", stored[0].content, stored[0].keyId)
+	}
+
+	// Rotated keys still decrypt the old records
+	s.keys = testEncryptionKeys(t, "k2:"+testKey2+"\nk1:"+testKey1)
+	_ = s.Append(context.Background(), "req1", Record{content: content})
+	got, err := s.Get(context.Background(), "req1")
+	if err != nil || !bytes.Equal(got[0].content, content) || !bytes.Equal(got[1].content, content) {
+		t.Fatalf("expected decrypted content, got %v (err: %v)", got, err)
+	}
+	if stored, _ = inner.Get(context.Background(), "req1"); stored[1].keyId != "k2" {
+		t.Errorf("expected new records encrypted with the primary key, got %s", stored[1].keyId)
+	}
+
+	// Removed key
+	s.keys = testEncryptionKeys(t, "k2:"+testKey2)
+	if _, err = s.Get(context.Background(), "req1"); !errors.Is(err, errUnknownEncryptionKey) {
+		t.Errorf("expected errUnknownEncryptionKey, got %v", err)
+	}
+
+	// Record moved to another request
+	_ = inner.Append(context.Background(), "req2", stored[1])
+	if _, err = s.Get(context.Background(), "req2"); err == nil {
+		t.Errorf("expected record of another request to fail decryption")
+	}
+}
+
+func TestEncryptingStore_TokenBound(t *testing.T) {
+	s := newEncryptingStore(NewInMemStore(), testEncryptionKeys(t, "k1:"+testKey1), true)
+	ctx := withStreamToken(context.Background(), "a")
+	_ = s.Append(ctx, "req1", Record{content: []byte("content")})
+
+	if got, err := s.Get(ctx, "req1"); err != nil || string(got[0].content) != "content" {
+		t.Errorf("expected decrypted content with the token, got %v (err: %v)", got, err)
+	}
+	if _, err := s.Get(context.Background(), "req1"); !errors.Is(err, errMissingStreamToken) {
+		t.Errorf("expected errMissingStreamToken, got %v", err)
+	}
+	if _, err := s.Get(withStreamToken(context.Background(), "b"), "req1"); !errors.Is(err, errStaleStreamToken) {
+		t.Errorf("expected decryption with another token to fail with errStaleStreamToken, got %v", err)
+	}
+}
+
+func TestHandleClientStream_TokenBoundEncryption(t *testing.T) {
+	resetTestState()
+	store = newEncryptingStore(NewInMemStore(), testEncryptionKeys(t, "k1:"+testKey1), true)
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+
+	if code := postTestWebhook(`{"request_id": "asd"}`); code != http.StatusOK {
+		t.Fatalf("expected webhook to be accepted, got %d", code)
+	}
+	req, _ := http.NewRequest("GET", "/listen/asd", nil)
+	req.SetPathValue("request_id", "asd")
+	req.Header.Add("Authorization", "Bearer a")
+	rr := httptest.NewRecorder()
+	handleClientStream(context.Background())(rr, req)
+
+	expectedBody := "data: {\"request_id\": \"asd\"}\n\ndata: signature=xxx\n\ndata: eot\n\n"
+	if rr.Body.String() != expectedBody {
+		t.Errorf("expected body %q, got %q", expectedBody, rr.Body.String())
+	}
+}
+
+func TestHandleClientStream_TokenBoundEncryptionNewToken(t *testing.T) {
+	resetTestState()
+	store = newEncryptingStore(NewInMemStore(), testEncryptionKeys(t, "k1:"+testKey1), true)
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(-time.Minute).Unix()})
+	postTestWebhook(`{"request_id": "asd"}`)
+
+	// The token expired before the client listened, the new one can't decrypt the result bound to it
+	cleanupTokens()
+	req, _ := http.NewRequest("POST", "/token", bytes.NewBufferString(`{"request_id": "asd"}`))
+	rr := httptest.NewRecorder()
+	handleCreateToken(rr, req)
+	var token struct{ Token string }
+	if err := json.NewDecoder(rr.Body).Decode(&token); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected new token to be created, got %d (err: %v)", rr.Code, err)
+	}
+	if rr = listenWithToken("asd", token.Token, "10.0.0.1:1234"); rr.Code != http.StatusGone {
+		t.Errorf("expected status %d, got %d (response body: %s)", http.StatusGone, rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/flowaicom/webhook-proxy/proxypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcAddr is the address the gRPC API listens on, the gRPC API is disabled when empty
+var grpcAddr string
+
+// grpcServer implements the gRPC API, see proxypb/webhook_proxy.proto. It shares the store, tokens and request
+// lifecycle with the HTTP handlers, so requests can be listened to over either.
+type grpcServer struct {
+	proxypb.UnimplementedWebhookProxyServer
+	// ctx is done on shutdown, ending the streams
+	ctx context.Context
+}
+
+// newGRPCServer returns the gRPC server with the proxy service registered. `ctx` is passed to the streams for
+// graceful closing.
+func newGRPCServer(ctx context.Context) *grpc.Server {
+	s := grpc.NewServer()
+	proxypb.RegisterWebhookProxyServer(s, &grpcServer{ctx: ctx})
+	return s
+}
+
+func startGRPCServer(ctx context.Context) *grpc.Server {
+	lis, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		log.Fatalf("error listening on gRPC address: %v\n", err)
+		return nil
+	}
+	server := newGRPCServer(ctx)
+	go func() {
+		log.Printf("gRPC listening on %s\n", lis.Addr().String())
+		if err := server.Serve(lis); err != nil {
+			log.Fatalf("gRPC server error: %v\n", err)
+		}
+		log.Printf("gRPC stopped accepting new connections\n")
+	}()
+	return server
+}
+
+// grpcRequest returns the HTTP request equivalent of the gRPC call for the shared authorization, lockout and audit
+// logic: the peer address and the `authorization` metadata
+func grpcRequest(ctx context.Context) *http.Request {
+	r := (&http.Request{Header: http.Header{}, URL: &url.URL{}}).WithContext(ctx)
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		r.RemoteAddr = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			r.Header.Set("Authorization", v[0])
+		}
+	}
+	return r
+}
+
+// authorizeGRPC validates the stream token in the `authorization` metadata, returns the token and the request
+// bound to it
+func authorizeGRPC(ctx context.Context, requestId string) (streamToken, *http.Request, error) {
+	if requestId == "" {
+		return streamToken{}, nil, status.Error(codes.InvalidArgument, "field `request_id` is required")
+	}
+	var requiredToken *streamToken
+	if t, ok := streamsTokens.Load(requestId); ok {
+		st := t.(streamToken)
+		requiredToken = &st
+	}
+	r := grpcRequest(ctx)
+	if err := authorizeStream(r, requestId, requiredToken); err != nil {
+		if err.status == http.StatusTooManyRequests {
+			return streamToken{}, nil, status.Error(codes.ResourceExhausted, err.message)
+		}
+		return streamToken{}, nil, status.Error(codes.Unauthenticated, err.message)
+	}
+	return *requiredToken, r.WithContext(withStreamToken(ctx, requiredToken.token)), nil
+}
+
+// CreateToken generates the stream token of the request, like `POST /token`
+func (s *grpcServer) CreateToken(ctx context.Context, req *proxypb.CreateTokenRequest) (*proxypb.Token, error) {
+	if predictOnly {
+		return nil, status.Error(codes.PermissionDenied, predictOnlyMessage)
+	}
+	if req.GetRequestId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "field `request_id` is required")
+	}
+
+	st, err := createStreamToken(req.GetRequestId(), tokenOverrides{
+		Timeout:    int(req.GetTimeout()),
+		Retention:  int(req.GetRetention()),
+		TokenTTL:   int(req.GetTokenTtl()),
+		Projection: req.GetProjection(),
+		Redact:     req.GetRedact(),
+		PublicKey:  req.GetPublicKey(),
+	})
+	switch {
+	case errors.Is(err, errTokenExists):
+		log.Printf("token already exists (request_id: %s)", req.GetRequestId())
+		return nil, status.Error(codes.AlreadyExists, "token already exists")
+	case errors.Is(err, errNegativeOverride):
+		return nil, status.Error(codes.InvalidArgument, negativeOverrideMessage)
+	case errors.Is(err, errInvalidTransform):
+		return nil, status.Error(codes.InvalidArgument, invalidTransformMessage)
+	case errors.Is(err, errInvalidPublicKey):
+		return nil, status.Error(codes.InvalidArgument, invalidPublicKeyMessage)
+	case err != nil:
+		log.Printf("error generating token (request_id: %s): %v", req.GetRequestId(), err)
+		return nil, status.Error(codes.Internal, "cannot generate token")
+	}
+
+	auditRequest(grpcRequest(ctx), auditEntry{Event: auditTokenCreated, RequestId: req.GetRequestId()})
+	return &proxypb.Token{
+		Token:     st.token,
+		ExpiresAt: st.expiresAt,
+		Timeout:   int32(st.streamTimeout().Seconds()),
+		Retention: int32(st.recordRetention().Seconds()),
+	}, nil
+}
+
+// Listen streams the results of the request like `GET /listen/{request_id}`, with the keep-alive messages
+// scheduled on the shared listenerTimers wheel
+func (s *grpcServer) Listen(req *proxypb.ListenRequest, stream grpc.ServerStreamingServer[proxypb.ListenEvent]) error {
+	requestId := req.GetRequestId()
+	log.Printf("new gRPC listener, request_id: %s\n", requestId)
+	token, r, err := authorizeGRPC(stream.Context(), requestId)
+	if err != nil {
+		return err
+	}
+
+	keepAlive := time.Duration(keepAliveInterval) * time.Second
+	if seconds := int(req.GetKeepAlive()); seconds != 0 {
+		if seconds < minKeepAliveInterval || seconds > maxKeepAliveInterval {
+			return status.Errorf(codes.InvalidArgument, "field `keep_alive` must be a number of seconds between %d and %d", minKeepAliveInterval, maxKeepAliveInterval)
+		}
+		keepAlive = time.Duration(seconds) * time.Second
+	}
+
+	ticker := listenerTimers.schedule(keepAlive, true)
+	timeout := listenerTimers.schedule(token.streamTimeout(), false)
+	defer listenerTimers.stop(ticker)
+	defer listenerTimers.stop(timeout)
+
+	promOpenClientConnections.Inc()
+	promTotalClientConnections.Inc()
+	defer promOpenClientConnections.Dec()
+
+	records, updates, unsubscribe, err := store.Subscribe(r.Context(), requestId)
+	if errors.Is(err, errStaleStreamToken) {
+		log.Printf("response bound to the previous token (request_id: %s)\n", requestId)
+		return status.Error(codes.FailedPrecondition, "response bound to the previous token")
+	}
+	if err != nil {
+		log.Printf("failed to retrieve response for (request_id: %s): %v\n", requestId, err)
+		promStoreErrors.WithLabelValues("subscribe").Inc()
+		return status.Error(codes.Unavailable, "failed to retrieve response")
+	}
+	defer unsubscribe()
+
+	sent := 0
+	for {
+		done, err := sendGRPCEvents(stream, r, requestId, records[sent:], token)
+		if err != nil {
+			log.Printf("failed to respond to request %s: %v\n", requestId, err)
+			return err
+		}
+		if done {
+			return nil
+		}
+		sent = len(records)
+
+		select {
+		case <-r.Context().Done():
+			log.Printf("gRPC client %s disconnected\n", requestId)
+			return status.FromContextError(r.Context().Err()).Err()
+		case <-updates:
+			records, err = store.Get(r.Context(), requestId)
+			if errors.Is(err, ErrNotFound) || len(records) < sent {
+				log.Printf("closing gRPC client connection (request_id: %s, reason: delivered to another listener)", requestId)
+				return status.Error(codes.Aborted, "delivered to another listener")
+			}
+			if err != nil {
+				log.Printf("failed to retrieve events for (request_id: %s): %v\n", requestId, err)
+				promStoreErrors.WithLabelValues("get").Inc()
+				return status.Error(codes.Unavailable, "failed to retrieve events")
+			}
+		case <-ticker.C:
+			keepAliveEvent := &proxypb.ListenEvent{Event: &proxypb.ListenEvent_KeepAlive{KeepAlive: &proxypb.KeepAlive{}}}
+			if err := stream.Send(keepAliveEvent); err != nil {
+				log.Printf("failed to ping gRPC client (request_id: %s): %v\n", requestId, err)
+				return err
+			}
+		case <-timeout.C:
+			log.Printf("closing gRPC client connection (request_id: %s, reason: timeout)", requestId)
+			promTimedOutClients.Inc()
+			return status.Error(codes.DeadlineExceeded, "timeout")
+		case <-s.ctx.Done():
+			log.Printf("closing gRPC client connection (request_id: %s, reason: context done)", requestId)
+			return status.Error(codes.Unavailable, "server gone")
+		}
+	}
+}
+
+// sendGRPCEvents streams the events to the client in order like sendClientEvents. The final result is followed by
+// `eot` and completes the delivery.
+func sendGRPCEvents(stream grpc.ServerStreamingServer[proxypb.ListenEvent], r *http.Request, requestId string, records []Record, token streamToken) (bool, error) {
+	if len(records) > 0 && !records[0].cancelled {
+		transitionRequest(requestId, stateStreaming)
+	}
+	for _, record := range records {
+		if record.cancelled {
+			log.Printf("request %s cancelled, closing gRPC client connection\n", requestId)
+			return true, stream.Send(&proxypb.ListenEvent{Event: &proxypb.ListenEvent_Cancelled{Cancelled: &proxypb.Cancelled{}}})
+		}
+		result, err := grpcResult(record, token)
+		if err != nil {
+			return false, err
+		}
+		if err = stream.Send(&proxypb.ListenEvent{Event: &proxypb.ListenEvent_Result{Result: result}}); err != nil {
+			return false, err
+		}
+		if !record.progress {
+			log.Printf("responded to gRPC request %s\n", requestId)
+			if err = stream.Send(&proxypb.ListenEvent{Event: &proxypb.ListenEvent_Eot{Eot: &proxypb.EndOfTransmission{}}}); err != nil {
+				return false, err
+			}
+			return true, completeDelivery(r, requestId)
+		}
+	}
+	return false, nil
+}
+
+// grpcResult returns the webhook payload as delivered to the client with its signature and the prediction error
+// codes
+func grpcResult(record Record, token streamToken) (*proxypb.Result, error) {
+	p, err := deliverPayload(record, token)
+	if errors.Is(err, errTransformFailed) {
+		return nil, status.Error(codes.FailedPrecondition, errTransformFailed.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	result := &proxypb.Result{
+		Payload:     p.content,
+		Signature:   record.signature,
+		Progress:    record.progress,
+		Transformed: p.transformed,
+		Encryption:  p.scheme,
+	}
+	for _, e := range record.predictionErrors {
+		result.Errors = append(result.Errors, &proxypb.PredictionError{Code: e.Code})
+	}
+	return result, nil
+}
+
+// GetResult returns the results of the request received so far without waiting. Returning the final result
+// completes the delivery, like the end of the stream.
+func (s *grpcServer) GetResult(ctx context.Context, req *proxypb.GetResultRequest) (*proxypb.GetResultResponse, error) {
+	requestId := req.GetRequestId()
+	token, r, err := authorizeGRPC(ctx, requestId)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &proxypb.GetResultResponse{}
+	records, err := store.Get(r.Context(), requestId)
+	if errors.Is(err, ErrNotFound) {
+		return res, nil
+	}
+	if errors.Is(err, errStaleStreamToken) {
+		log.Printf("response bound to the previous token (request_id: %s)\n", requestId)
+		return nil, status.Error(codes.FailedPrecondition, "response bound to the previous token")
+	}
+	if err != nil {
+		log.Printf("failed to retrieve events for (request_id: %s): %v\n", requestId, err)
+		promStoreErrors.WithLabelValues("get").Inc()
+		return nil, status.Error(codes.Unavailable, "failed to retrieve events")
+	}
+
+	for _, record := range records {
+		if record.cancelled {
+			res.Done, res.Cancelled = true, true
+			return res, nil
+		}
+		result, err := grpcResult(record, token)
+		if err != nil {
+			return nil, err
+		}
+		res.Results = append(res.Results, result)
+		if !record.progress {
+			res.Done = true
+			if err = completeDelivery(r, requestId); err != nil {
+				log.Printf("failed to respond to request %s: %v\n", requestId, err)
+			}
+			return res, nil
+		}
+	}
+	return res, nil
+}
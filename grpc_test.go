@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/flowaicom/webhook-proxy/proxypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestGRPCClient starts the gRPC API on an in-process listener next to the HTTP test proxy, which receives the
+// webhooks
+func newTestGRPCClient(t *testing.T) (proxypb.WebhookProxyClient, string) {
+	t.Helper()
+	proxy := newTestProxy(t, nil)
+
+	lis := bufconn.Listen(1 << 20)
+	ctx, cancel := context.WithCancel(context.Background())
+	server := newGRPCServer(ctx)
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to create gRPC client: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		_ = conn.Close()
+		server.Stop()
+	})
+	return proxypb.NewWebhookProxyClient(conn), proxy.URL
+}
+
+// withToken returns the context authorizing the gRPC call with the stream token
+func withToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestGRPC_Listen(t *testing.T) {
+	withStatusField(t, "status")
+	requestTimeout = 10
+	c, proxyURL := newTestGRPCClient(t)
+
+	token, err := c.CreateToken(context.Background(), &proxypb.CreateTokenRequest{RequestId: "req1"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if token.GetToken() == "" || token.GetExpiresAt() <= time.Now().Unix() || token.GetTimeout() != 10 {
+		t.Errorf("unexpected token %v", token)
+	}
+
+	postProxyWebhook(t, proxyURL, `{"request_id": "req1", "status": "in_progress"}`)
+	stream, err := c.Listen(withToken(token.GetToken()), &proxypb.ListenRequest{RequestId: "req1", KeepAlive: 1})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		postProxyWebhook(t, proxyURL, `{"request_id": "req1", "data": null, "errors": [{"code": "MODEL_PREDICT_ERROR"}]}`)
+	}()
+
+	var events []*proxypb.ListenEvent
+	for {
+		event, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		events = append(events, event)
+	}
+	if len(events) < 4 {
+		t.Fatalf("expected progress, keep-alive, result and eot, got %v", events)
+	}
+	if r := events[0].GetResult(); r == nil || !r.GetProgress() || string(r.GetPayload()) != `{"request_id": "req1", "status": "in_progress"}` || r.GetSignature() != "xxx" {
+		t.Errorf("expected progress result, got %v", events[0])
+	}
+	if events[1].GetKeepAlive() == nil {
+		t.Errorf("expected keep-alive, got %v", events[1])
+	}
+	final := events[len(events)-2].GetResult()
+	if final == nil || final.GetProgress() || len(final.GetErrors()) != 1 || final.GetErrors()[0].GetCode() != "MODEL_PREDICT_ERROR" {
+		t.Errorf("expected final result with errors, got %v", events[len(events)-2])
+	}
+	if events[len(events)-1].GetEot() == nil {
+		t.Errorf("expected eot, got %v", events[len(events)-1])
+	}
+
+	// Delivered like over HTTP, the token is gone
+	if _, state, _ := requestStatus(t, proxyURL, "req1", token.GetToken()); state != stateDelivered {
+		t.Errorf("expected delivered, got %s", state)
+	}
+	if _, ok := streamsTokens.Load("req1"); ok {
+		t.Errorf("expected token deleted after delivery")
+	}
+}
+
+func TestGRPC_Unauthenticated(t *testing.T) {
+	c, _ := newTestGRPCClient(t)
+	token, _ := c.CreateToken(context.Background(), &proxypb.CreateTokenRequest{RequestId: "req1"})
+
+	for name, ctx := range map[string]context.Context{
+		"missing": context.Background(),
+		"invalid": withToken("invalid"),
+		"other":   withToken(token.GetToken() + "x"),
+	} {
+		stream, err := c.Listen(ctx, &proxypb.ListenRequest{RequestId: "req1"})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected unauthenticated with %s token, got %v", name, err)
+		}
+	}
+	if _, err := c.GetResult(context.Background(), &proxypb.GetResultRequest{RequestId: "req2"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected unauthenticated for unknown request, got %v", err)
+	}
+
+	// Failures count towards the same lockout as over HTTP
+	lockoutAttempts = 2
+	defer func() { lockoutAttempts = 0 }()
+	for n := 0; n < 2; n++ {
+		_, _ = c.GetResult(withToken("invalid"), &proxypb.GetResultRequest{RequestId: "req1"})
+	}
+	if _, err := c.GetResult(withToken(token.GetToken()), &proxypb.GetResultRequest{RequestId: "req1"}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected locked out, got %v", err)
+	}
+}
+
+func TestGRPC_CreateToken(t *testing.T) {
+	c, _ := newTestGRPCClient(t)
+
+	if _, err := c.CreateToken(context.Background(), &proxypb.CreateTokenRequest{RequestId: "req1"}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	tests := []struct {
+		req  *proxypb.CreateTokenRequest
+		code codes.Code
+	}{
+		{&proxypb.CreateTokenRequest{RequestId: "req1"}, codes.AlreadyExists},
+		{&proxypb.CreateTokenRequest{}, codes.InvalidArgument},
+		{&proxypb.CreateTokenRequest{RequestId: "req2", Timeout: -1}, codes.InvalidArgument},
+		{&proxypb.CreateTokenRequest{RequestId: "req2", Projection: []string{""}}, codes.InvalidArgument},
+		{&proxypb.CreateTokenRequest{RequestId: "req2", PublicKey: "invalid"}, codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		if _, err := c.CreateToken(context.Background(), test.req); status.Code(err) != test.code {
+			t.Errorf("expected %v for %v, got %v", test.code, test.req, err)
+		}
+	}
+
+	predictOnly = true
+	defer func() { predictOnly = false }()
+	if _, err := c.CreateToken(context.Background(), &proxypb.CreateTokenRequest{RequestId: "req3"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected permission denied, got %v", err)
+	}
+}
+
+func TestGRPC_GetResult(t *testing.T) {
+	c, proxyURL := newTestGRPCClient(t)
+	token, _ := c.CreateToken(context.Background(), &proxypb.CreateTokenRequest{RequestId: "req1", Projection: []string{"data"}})
+	ctx := withToken(token.GetToken())
+
+	res, err := c.GetResult(ctx, &proxypb.GetResultRequest{RequestId: "req1"})
+	if err != nil || res.GetDone() || len(res.GetResults()) != 0 {
+		t.Fatalf("expected no results yet, got %v %v", res, err)
+	}
+
+	postProxyWebhook(t, proxyURL, `{"request_id": "req1", "data": {"output": "ok"}}`)
+	res, err = c.GetResult(ctx, &proxypb.GetResultRequest{RequestId: "req1"})
+	if err != nil || !res.GetDone() || len(res.GetResults()) != 1 {
+		t.Fatalf("expected final result, got %v %v", res, err)
+	}
+	if r := res.GetResults()[0]; string(r.GetPayload()) != `{"data":{"output":"ok"}}` || !r.GetTransformed() {
+		t.Errorf("expected transformed payload, got %v", r)
+	}
+
+	// Delivered once
+	if _, err = c.GetResult(ctx, &proxypb.GetResultRequest{RequestId: "req1"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected token deleted after delivery, got %v", err)
+	}
+}
+
+func TestGRPC_GetResultTransformFailed(t *testing.T) {
+	c, _ := newTestGRPCClient(t)
+	token, _ := c.CreateToken(context.Background(), &proxypb.CreateTokenRequest{RequestId: "req1", Redact: []string{"data.prompt"}})
+	_ = store.Append(context.Background(), "req1", Record{content: []byte(`{"data": {"prompt": "secret"`)})
+
+	res, err := c.GetResult(withToken(token.GetToken()), &proxypb.GetResultRequest{RequestId: "req1"})
+	if status.Code(err) != codes.FailedPrecondition || res != nil {
+		t.Errorf("expected failed precondition without the payload, got %v %v", res, err)
+	}
+}
+
+func TestGRPC_ListenCancelled(t *testing.T) {
+	c, _ := newTestGRPCClient(t)
+	token, _ := c.CreateToken(context.Background(), &proxypb.CreateTokenRequest{RequestId: "req1"})
+	_ = store.Append(context.Background(), "req1", Record{cancelled: true})
+
+	stream, err := c.Listen(withToken(token.GetToken()), &proxypb.ListenRequest{RequestId: "req1"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if event, err := stream.Recv(); err != nil || event.GetCancelled() == nil {
+		t.Errorf("expected cancelled, got %v %v", event, err)
+	}
+	if _, err = stream.Recv(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected end of stream, got %v", err)
+	}
+
+	res, err := c.GetResult(withToken(token.GetToken()), &proxypb.GetResultRequest{RequestId: "req1"})
+	if err != nil || !res.GetDone() || !res.GetCancelled() {
+		t.Errorf("expected cancelled result, got %v %v", res, err)
+	}
+}
+
+func TestGRPC_ListenTimeout(t *testing.T) {
+	maxRequestTimeout = 600
+	c, _ := newTestGRPCClient(t)
+	token, _ := c.CreateToken(context.Background(), &proxypb.CreateTokenRequest{RequestId: "req1", Timeout: 1})
+
+	stream, err := c.Listen(withToken(token.GetToken()), &proxypb.ListenRequest{RequestId: "req1", KeepAlive: 5})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err = stream.Recv(); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	stream, _ = c.Listen(withToken(token.GetToken()), &proxypb.ListenRequest{RequestId: "req1", KeepAlive: 100})
+	if _, err = stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected invalid keep-alive, got %v", err)
+	}
+}
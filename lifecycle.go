@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request lifecycle states, in order. The request moves only forward, `delivered`, `expired` and `cancelled` are
+// final.
+const (
+	stateRegistered      = "registered"
+	stateWebhookReceived = "webhook_received"
+	stateStreaming       = "streaming"
+	stateDelivered       = "delivered"
+	stateExpired         = "expired"
+	stateCancelled       = "cancelled"
+)
+
+// stateOrder ranks the lifecycle states, the final ones share the rank
+var stateOrder = map[string]int{
+	stateRegistered:      0,
+	stateWebhookReceived: 1,
+	stateStreaming:       2,
+	stateDelivered:       3,
+	stateExpired:         3,
+	stateCancelled:       3,
+}
+
+// stateTransition is the time (unix) the request entered the state
+type stateTransition struct {
+	State string `json:"state"`
+	At    string `json:"at"`
+}
+
+// lifecycle is the state of the request and the history of its transitions
+type lifecycle struct {
+	state   string
+	history []stateTransition
+	// tokenHash is the hash of the stream token the request was registered with, required to query the status
+	tokenHash []byte
+	// errors of the failed prediction, codes only
+	errors    []predictionError
+	updatedAt int64
+}
+
+var (
+	lifecyclesMu sync.Mutex
+	lifecycles   = map[string]*lifecycle{} // map[requestId string]*lifecycle
+)
+
+// transitionRequest moves the request to the state, unless it's already in the same or a later one. States reached
+// out of order (e.g. token created after the webhook was received) are recorded in the history, but don't move the
+// request back.
+func transitionRequest(requestId, state string) {
+	lifecyclesMu.Lock()
+	defer lifecyclesMu.Unlock()
+	transitionLocked(requestId, state)
+}
+
+// transitionLocked moves the request to the state with lifecyclesMu held, returns its lifecycle
+func transitionLocked(requestId, state string) *lifecycle {
+	l, ok := lifecycles[requestId]
+	if !ok {
+		l = &lifecycle{}
+		lifecycles[requestId] = l
+	}
+	if l.state != "" && stateOrder[l.state] == stateOrder[stateDelivered] {
+		return l
+	}
+	for _, t := range l.history {
+		if t.State == state {
+			return l
+		}
+	}
+	now := time.Now().Unix()
+	l.history = append(l.history, stateTransition{State: state, At: strconv.FormatInt(now, 10)})
+	l.updatedAt = now
+	if l.state == "" || stateOrder[state] > stateOrder[l.state] {
+		l.state = state
+	}
+	return l
+}
+
+// registerRequest moves the request to `registered` and binds its status to the stream token
+func registerRequest(requestId, token string) {
+	lifecyclesMu.Lock()
+	defer lifecyclesMu.Unlock()
+	if l, ok := lifecycles[requestId]; ok && l.state == stateExpired {
+		// The new token reopens the request, whose previous token expired waiting for the webhook
+		delete(lifecycles, requestId)
+	}
+	hash := sha256.Sum256([]byte(token))
+	transitionLocked(requestId, stateRegistered).tokenHash = hash[:]
+}
+
+// failRequest records the error codes of the failed prediction, surfaced with the status
+func failRequest(requestId string, errs []predictionError) {
+	lifecyclesMu.Lock()
+	defer lifecyclesMu.Unlock()
+	if l, ok := lifecycles[requestId]; ok {
+		l.errors = errs
+	}
+}
+
+// expireRequest moves the request to `expired`, unless it already reached a final state
+func expireRequest(requestId string) {
+	transitionRequest(requestId, stateExpired)
+}
+
+// handleRequestStatus handles `GET /requests/{request_id}/status` route. Responds with the lifecycle state of the
+// request, its history and the errors of the failed prediction. Requires the stream token the request was registered
+// with, also after the token expires or the result is delivered. Unknown requests, requests without a token and
+// invalid tokens get the same response, so the request IDs can't be probed.
+func handleRequestStatus(w http.ResponseWriter, r *http.Request) {
+	requestId := r.PathValue("request_id")
+	ip := clientIP(r)
+	if remaining := lockedOut(requestId, ip); remaining > 0 {
+		log.Printf("client locked out after failed authorizations: %s (ip: %s)\n", requestId, ip)
+		w.Header().Set("Retry-After", strconv.Itoa(int(remaining.Seconds())))
+		http.Error(w, "too many failed authorizations", http.StatusTooManyRequests)
+		return
+	}
+
+	lifecyclesMu.Lock()
+	l, ok := lifecycles[requestId]
+	var res struct {
+		RequestId string            `json:"request_id"`
+		State     string            `json:"state"`
+		History   []stateTransition `json:"history"`
+		Errors    []predictionError `json:"errors,omitempty"`
+	}
+	var tokenHash []byte
+	if ok {
+		res.RequestId, res.State, tokenHash = requestId, l.state, l.tokenHash
+		res.History = append([]stateTransition(nil), l.history...)
+		res.Errors = l.errors
+	}
+	lifecyclesMu.Unlock()
+
+	hash := sha256.Sum256([]byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")))
+	if tokenHash == nil || subtle.ConstantTimeCompare(hash[:], tokenHash) != 1 {
+		log.Printf("status requested for unknown request or with invalid token: %s\n", requestId)
+		recordAuthFailure(r, requestId, ip)
+		http.Error(w, "unknown request", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("error responding with status (request_id: %s): %v\n", requestId, err)
+	}
+}
+
+// cleanupLifecycles forgets requests which reached a final state longer than the replay window ago
+func cleanupLifecycles() {
+	lifecyclesMu.Lock()
+	defer lifecyclesMu.Unlock()
+	deadline := time.Now().Unix() - int64(replayWindow)
+	for requestId, l := range lifecycles {
+		if stateOrder[l.state] == stateOrder[stateDelivered] && l.updatedAt < deadline {
+			delete(lifecycles, requestId)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/flowaicom/webhook-proxy/client"
+)
+
+// requestStatus queries the request status with the token and returns the response status code, the state and
+// the states in the history
+func requestStatus(t *testing.T, proxyURL, requestId, token string) (int, string, []string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", proxyURL+"/requests/"+requestId+"/status", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("status request failed: %v", err)
+		return 0, "", nil
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		State   string            `json:"state"`
+		History []stateTransition `json:"history"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&res)
+	var history []string
+	for _, h := range res.History {
+		history = append(history, h.State)
+	}
+	return resp.StatusCode, res.State, history
+}
+
+func postProxyWebhook(t *testing.T, proxyURL, body string) {
+	t.Helper()
+	req, _ := http.NewRequest("POST", proxyURL+"/webhook", bytes.NewBufferString(body))
+	req.Header.Set("X-BASETEN-SIGNATURE", "xxx")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("webhook delivery failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected webhook to be accepted, got %d", resp.StatusCode)
+	}
+}
+
+func TestRequestStatus(t *testing.T) {
+	withStatusField(t, "status")
+	requestTimeout = 10
+	proxy := newTestProxy(t, nil)
+
+	if code, _, _ := requestStatus(t, proxy.URL, "req1", ""); code != http.StatusNotFound {
+		t.Errorf("expected unknown request, got %d", code)
+	}
+
+	c := client.New(proxy.URL, client.WithTimeout(5*time.Second), client.WithEventHandler(func(e client.Event) {
+		if _, state, _ := requestStatus(t, proxy.URL, "req1", ""); state != "" {
+			t.Errorf("expected status to require the token, got %s", state)
+		}
+	}))
+	token, err := c.CreateToken(context.Background(), "req1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if code, state, _ := requestStatus(t, proxy.URL, "req1", token.Token); code != http.StatusOK || state != stateRegistered {
+		t.Errorf("expected registered, got %d %s", code, state)
+	}
+	// Invalid token can't tell known requests from unknown ones
+	if code, _, _ := requestStatus(t, proxy.URL, "req1", "invalid"); code != http.StatusNotFound {
+		t.Errorf("expected unknown request, got %d", code)
+	}
+
+	postProxyWebhook(t, proxy.URL, `{"request_id": "req1", "status": "in_progress"}`)
+	if _, state, _ := requestStatus(t, proxy.URL, "req1", token.Token); state != stateWebhookReceived {
+		t.Errorf("expected webhook_received, got %s", state)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		if _, state, _ := requestStatus(t, proxy.URL, "req1", token.Token); state != stateStreaming {
+			t.Errorf("expected streaming, got %s", state)
+		}
+		postProxyWebhook(t, proxy.URL, `{"request_id": "req1", "status": "completed"}`)
+	}()
+	if _, err = c.Listen(context.Background(), "req1", token.Token); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// The token is still required after the result is delivered
+	code, state, history := requestStatus(t, proxy.URL, "req1", token.Token)
+	expected := []string{stateRegistered, stateWebhookReceived, stateStreaming, stateDelivered}
+	if code != http.StatusOK || state != stateDelivered || len(history) != len(expected) {
+		t.Fatalf("expected delivered with history %v, got %d %s %v", expected, code, state, history)
+	}
+	for n := range expected {
+		if history[n] != expected[n] {
+			t.Errorf("expected history %v, got %v", expected, history)
+		}
+	}
+	if code, _, _ = requestStatus(t, proxy.URL, "req1", ""); code != http.StatusNotFound {
+		t.Errorf("expected unknown request, got %d", code)
+	}
+}
+
+func TestRequestStatus_WebhookBeforeToken(t *testing.T) {
+	proxy := newTestProxy(t, nil)
+
+	// Requests without token can't be queried, the same as unknown ones
+	postProxyWebhook(t, proxy.URL, `{"request_id": "req1", "data": null, "errors": [{"code": "MODEL_PREDICT_ERROR"}]}`)
+	if code, state, _ := requestStatus(t, proxy.URL, "req1", ""); code != http.StatusNotFound || state != "" {
+		t.Errorf("expected unknown request, got %d %s", code, state)
+	}
+
+	token, _ := client.New(proxy.URL).CreateToken(context.Background(), "req1")
+	_, state, history := requestStatus(t, proxy.URL, "req1", token.Token)
+	if state != stateWebhookReceived || len(history) != 2 || history[1] != stateRegistered {
+		t.Errorf("expected webhook_received with registration recorded, got %s %v", state, history)
+	}
+}
+
+func TestRequestStatus_Expired(t *testing.T) {
+	proxy := newTestProxy(t, nil)
+	streamsTokens.Store("req1", streamToken{token: "a", expiresAt: time.Now().Unix() - 1})
+	registerRequest("req1", "a")
+
+	cleanupTokens()
+	if _, state, _ := requestStatus(t, proxy.URL, "req1", "a"); state != stateExpired {
+		t.Errorf("expected expired, got %s", state)
+	}
+
+	// New token reopens the request
+	token, _ := client.New(proxy.URL).CreateToken(context.Background(), "req1")
+	if _, state, history := requestStatus(t, proxy.URL, "req1", token.Token); state != stateRegistered || len(history) != 1 {
+		t.Errorf("expected registered again, got %s %v", state, history)
+	}
+
+	// Undelivered payloads past retention
+	postProxyWebhook(t, proxy.URL, `{"request_id": "req2"}`)
+	store.(*InMemStore).store.Store("req2", []Record{{content: []byte(`{}`), createdAt: time.Now().Unix() - 3600}})
+	cleanupStore()
+	if l := lifecycles["req2"]; l == nil || l.state != stateExpired {
+		t.Errorf("expected expired, got %+v", l)
+	}
+}
+
+func TestRequestStatus_Cancelled(t *testing.T) {
+	proxy := newTestProxy(t, nil)
+	c := client.New(proxy.URL)
+	token, _ := c.CreateToken(context.Background(), "req1")
+	if _, err := c.Cancel(context.Background(), "req1", token.Token); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// Final state is kept
+	postProxyWebhook(t, proxy.URL, `{"request_id": "req1"}`)
+	cleanupStore()
+	if _, state, history := requestStatus(t, proxy.URL, "req1", token.Token); state != stateCancelled || len(history) != 2 {
+		t.Errorf("expected cancelled, got %s %v", state, history)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flowaicom/webhook-proxy/client"
+)
+
+// loadTestResult holds the outcome of a single simulated request
+type loadTestResult struct {
+	latency time.Duration
+	err     error
+}
+
+// runLoadTest implements `webhook-proxy loadtest`. Opens N listeners, delivers webhooks for them at the configured
+// rate with random delays and reports delivery latency percentiles along with memory and goroutine counts.
+// When `-proxy-url` is empty the proxy is started in-process, so the reported runtime stats describe the proxy itself.
+func runLoadTest(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	proxyURL := fs.String("proxy-url", "", "webhook proxy base URL, an in-process proxy is started when empty")
+	listeners := fs.Int("listeners", 1000, "number of concurrent listeners (request ids)")
+	rate := fs.Float64("rate", 200, "webhooks delivered per second")
+	maxDelay := fs.Duration("max-delay", time.Second, "maximum random delay added before delivering each webhook")
+	payloadSize := fs.Int("payload-size", 1024, "approximate size of each webhook payload in bytes")
+	timeout := fs.Duration("timeout", 2*time.Minute, "maximum waiting time of every listener")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 || *listeners <= 0 || *rate <= 0 {
+		return exitUsage
+	}
+
+	baseURL := *proxyURL
+	if baseURL == "" {
+		// Per-request logs of the in-process proxy would dominate the run
+		defer log.SetOutput(log.Writer())
+		log.SetOutput(io.Discard)
+		url, stop, err := startInProcessProxy(int((*timeout).Seconds()) + 1)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "failed to start in-process proxy: %v\n", err)
+			return exitError
+		}
+		defer stop()
+		baseURL = url
+	}
+
+	httpClient := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: *listeners}}
+	c := client.New(baseURL, client.WithHTTPClient(httpClient), client.WithTimeout(*timeout))
+	ctx := context.Background()
+	runId, err := generateSecureToken(4)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "failed to generate run id: %v\n", err)
+		return exitError
+	}
+
+	// Open listeners
+	_, _ = fmt.Fprintf(stderr, "opening %d listeners...\n", *listeners)
+	sentAt := make([]atomic.Int64, *listeners)
+	results := make([]loadTestResult, *listeners)
+	var wg sync.WaitGroup
+	for i := 0; i < *listeners; i++ {
+		requestId := fmt.Sprintf("loadtest-%s-%d", runId, i)
+		token, err := c.CreateToken(ctx, requestId)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "failed to create token for %s: %v\n", requestId, err)
+			return exitError
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := c.Listen(ctx, requestId, token.Token)
+			results[i] = loadTestResult{time.Since(time.Unix(0, sentAt[i].Load())), err}
+		}(i)
+	}
+	time.Sleep(500 * time.Millisecond) // let the streams get established
+	peak := sampleRuntime()
+
+	// Deliver webhooks
+	_, _ = fmt.Fprintf(stderr, "delivering %d webhooks at %.1f/s...\n", *listeners, *rate)
+	start := time.Now()
+	body := strings.Repeat("x", *payloadSize)
+	interval := time.Duration(float64(time.Second) / *rate)
+	var sendErrs sync.Map
+	var senders sync.WaitGroup
+	for i := 0; i < *listeners; i++ {
+		time.Sleep(interval)
+		senders.Add(1)
+		go func(i int) {
+			defer senders.Done()
+			time.Sleep(time.Duration(rand.Int63n(int64(*maxDelay) + 1)))
+			requestId := fmt.Sprintf("loadtest-%s-%d", runId, i)
+			payload := []byte(fmt.Sprintf(`{"request_id": %q, "data": {"output": %q}}`, requestId, body))
+			sentAt[i].Store(time.Now().UnixNano())
+			if err := postWebhook(httpClient, baseURL, payload); err != nil {
+				sendErrs.Store(i, err)
+			}
+		}(i)
+	}
+	senders.Wait()
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// Report
+	var latencies []time.Duration
+	failed := 0
+	for i, r := range results {
+		if _, ok := sendErrs.Load(i); ok || r.err != nil {
+			failed++
+			continue
+		}
+		latencies = append(latencies, r.latency)
+	}
+	slices.Sort(latencies)
+
+	_, _ = fmt.Fprintf(stdout, "listeners:       %d\n", *listeners)
+	_, _ = fmt.Fprintf(stdout, "delivered:       %d\n", len(latencies))
+	_, _ = fmt.Fprintf(stdout, "failed:          %d\n", failed)
+	_, _ = fmt.Fprintf(stdout, "duration:        %s\n", elapsed.Round(time.Millisecond))
+	for _, p := range []float64{50, 90, 99, 100} {
+		_, _ = fmt.Fprintf(stdout, "latency p%-3v     %s\n", p, percentile(latencies, p))
+	}
+	_, _ = fmt.Fprintf(stdout, "goroutines:      %d (with all listeners connected)\n", peak.goroutines)
+	_, _ = fmt.Fprintf(stdout, "heap in use:     %.1f MiB (with all listeners connected)\n", float64(peak.heapInUse)/(1<<20))
+	_, _ = fmt.Fprintf(stdout, "total allocated: %.1f MiB\n", float64(sampleRuntime().totalAlloc)/(1<<20))
+
+	if failed > 0 {
+		return exitError
+	}
+	return exitOK
+}
+
+type runtimeSample struct {
+	goroutines int
+	heapInUse  uint64
+	totalAlloc uint64
+}
+
+func sampleRuntime() runtimeSample {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return runtimeSample{runtime.NumGoroutine(), m.HeapInuse, m.TotalAlloc}
+}
+
+// percentile returns the p-th percentile of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	return sorted[max(0, min(i, len(sorted)-1))]
+}
+
+// startInProcessProxy serves the proxy routes on a random local port and returns its URL
+func startInProcessProxy(timeout int) (string, func(), error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+
+	store = NewInMemStore()
+	streamsTokens = sync.Map{}
+	deliveries = map[string]*deliveryLog{}
+	requestTimeout = timeout
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server := &http.Server{Handler: newServeMux(ctx)}
+	go func() {
+		if err := server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			_, _ = fmt.Fprintf(os.Stderr, "in-process proxy error: %v\n", err)
+		}
+	}()
+
+	return "http://" + l.Addr().String(), func() {
+		cancel()
+		_ = server.Close()
+	}, nil
+}
+
+func postWebhook(hc *http.Client, baseURL string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/webhook", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-BASETEN-SIGNATURE", client.Sign("loadtest", payload))
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook rejected with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunLoadTest(t *testing.T) {
+	defer log.SetOutput(os.Stdout)
+
+	stdout, stderr := strings.Builder{}, strings.Builder{}
+	code := runLoadTest([]string{"-listeners", "20", "-rate", "1000", "-max-delay", "10ms", "-timeout", "10s"}, &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("expected exit code %d, got %d (stderr: %s)", exitOK, code, stderr.String())
+	}
+	for _, expected := range []string{"delivered:       20", "failed:          0", "latency p99", "goroutines:"} {
+		if !strings.Contains(stdout.String(), expected) {
+			t.Errorf("expected report to contain %q, got %s", expected, stdout.String())
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	tests := map[float64]time.Duration{50: 5, 90: 9, 99: 10, 100: 10, 0: 1}
+	for p, expected := range tests {
+		if got := percentile(sorted, p); got != expected {
+			t.Errorf("expected p%v to be %d, got %d", p, expected, got)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("expected 0 for empty input, got %d", got)
+	}
+}
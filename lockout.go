@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// lockoutAttempts is the number of failed stream authorizations after which the request ID or the client IP is
+	// locked out. Off (0) by default, anyone knowing the request ID could lock out its token holder.
+	lockoutAttempts = 0
+	// lockoutWindow is the lockout duration (seconds), doubled with every subsequent lockout up to maxLockoutBackoff
+	lockoutWindow = 300
+	// lockoutIPs locks out the client IPs besides the request IDs. Off by default, behind a load balancer without
+	// trustedProxies all the clients share its IP.
+	lockoutIPs bool
+	// trustedProxies are the networks of the load balancers in front of the proxy, the client IP of their requests
+	// is taken from `X-Forwarded-For`
+	trustedProxies []*net.IPNet
+)
+
+// maxLockoutBackoff limits the lockout duration to lockoutWindow * 2^maxLockoutBackoff
+const maxLockoutBackoff = 5
+
+// Kinds of the locked out keys
+const (
+	lockoutRequest = "request_id"
+	lockoutIP      = "ip"
+)
+
+// lockout counts failed stream authorizations of a request ID or client IP
+type lockout struct {
+	failures    int
+	lockouts    int
+	lockedUntil int64
+	updatedAt   int64
+}
+
+var (
+	lockoutsMu sync.Mutex
+	lockouts   = map[string]*lockout{} // map[kind + ":" + key]*lockout
+)
+
+// clientIP returns the IP the request came from. `X-Forwarded-For` is trusted only when the request came from
+// trustedProxies, the client IP is the last address in it which isn't a trusted proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for n := len(forwarded) - 1; n >= 0; n-- {
+		addr := strings.TrimSpace(forwarded[n])
+		if addr == "" {
+			continue
+		}
+		host = addr
+		if !isTrustedProxy(addr) {
+			break
+		}
+	}
+	return host
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses comma separated IPs and CIDR networks
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy network %s: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// lockoutKeys returns the lockout keys of the stream ID and, when lockoutIPs is set, of the client IP
+func lockoutKeys(id, ip string) map[string]string {
+	keys := map[string]string{lockoutRequest: id}
+	if lockoutIPs {
+		keys[lockoutIP] = ip
+	}
+	return keys
+}
+
+// lockedOut returns the remaining lockout of the stream ID or the client IP, zero when not locked out
+func lockedOut(id, ip string) time.Duration {
+	lockoutsMu.Lock()
+	defer lockoutsMu.Unlock()
+	now := time.Now().Unix()
+	until := int64(0)
+	for kind, key := range lockoutKeys(id, ip) {
+		if l, ok := lockouts[kind+":"+key]; ok && l.lockedUntil > now {
+			until = max(until, l.lockedUntil)
+		}
+	}
+	if until == 0 {
+		return 0
+	}
+	return time.Duration(until-now) * time.Second
+}
+
+// recordAuthFailure counts the failed stream authorization, locks the stream ID and the client IP out once they
+// reach lockoutAttempts failures. Anyone knowing the request ID can lock it out, including for its token holder.
+func recordAuthFailure(r *http.Request, id, ip string) {
+	if lockoutAttempts <= 0 {
+		return
+	}
+	lockoutsMu.Lock()
+	now := time.Now().Unix()
+	var locked []string
+	for kind, key := range lockoutKeys(id, ip) {
+		l, ok := lockouts[kind+":"+key]
+		if !ok {
+			l = &lockout{}
+			lockouts[kind+":"+key] = l
+		}
+		l.failures++
+		l.updatedAt = now
+		if l.failures < lockoutAttempts {
+			continue
+		}
+
+		window := int64(lockoutWindow) << min(l.lockouts, maxLockoutBackoff)
+		l.failures, l.lockedUntil = 0, now+window
+		l.lockouts++
+		promLockouts.WithLabelValues(kind).Inc()
+		locked = append(locked, kind+" "+key+" locked out for "+strconv.FormatInt(window, 10)+"s")
+	}
+	lockoutsMu.Unlock()
+
+	// Logged outside the lock, the audit log write would block the other authorizations
+	for _, reason := range locked {
+		log.Printf("too many failed stream authorizations, %s\n", reason)
+		auditRequest(r, streamAuditEntry(r, id, auditLockout, reason))
+	}
+}
+
+// recordAuthSuccess resets the failed authorizations of the stream ID, the client IP keeps its count
+func recordAuthSuccess(id string) {
+	lockoutsMu.Lock()
+	defer lockoutsMu.Unlock()
+	if l, ok := lockouts[lockoutRequest+":"+id]; ok && l.lockedUntil <= time.Now().Unix() {
+		delete(lockouts, lockoutRequest+":"+id)
+	}
+}
+
+// cleanupLockouts forgets the failed authorizations after the lockout window passes without new failures
+func cleanupLockouts() {
+	lockoutsMu.Lock()
+	defer lockoutsMu.Unlock()
+	now := time.Now().Unix()
+	for key, l := range lockouts {
+		if l.lockedUntil <= now && l.updatedAt < now-int64(lockoutWindow)<<maxLockoutBackoff {
+			delete(lockouts, key)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func listenWithToken(requestId, token, remoteAddr string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/listen/"+requestId, nil)
+	req.SetPathValue("request_id", requestId)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.RemoteAddr = remoteAddr
+	rr := httptest.NewRecorder()
+	handleClientStream(context.Background())(rr, req)
+	return rr
+}
+
+func TestHandleClientStream_Lockout(t *testing.T) {
+	lockouts = map[string]*lockout{}
+	lockoutAttempts, lockoutWindow, lockoutIPs = 3, 60, true
+	t.Cleanup(func() {
+		lockouts = map[string]*lockout{}
+		lockoutAttempts, lockoutIPs = 0, false
+	})
+	streamsTokens = sync.Map{}
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+	store = NewInMemStore()
+	store.Append(context.Background(), "asd", Record{content: []byte("content"), signature: "signature"})
+
+	for n := 0; n < 3; n++ {
+		if rr := listenWithToken("asd", "guess", "10.0.0.1:1234"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	}
+
+	// The request ID is locked out even for the right token and other clients
+	rr := listenWithToken("asd", "a", "10.0.0.2:1234")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected status %d with Retry-After, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	// The client IP is locked out for other request IDs
+	if rr = listenWithToken("other", "guess", "10.0.0.1:4321"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	// Unlocked after the window, the next lockout is longer
+	lockoutsMu.Lock()
+	for _, l := range lockouts {
+		l.lockedUntil = time.Now().Unix() - 1
+	}
+	lockoutsMu.Unlock()
+	if rr = listenWithToken("asd", "a", "10.0.0.2:1234"); rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d after the lockout window, got %d", http.StatusOK, rr.Code)
+	}
+	for n := 0; n < 3; n++ {
+		listenWithToken("next", "guess", "10.0.0.1:1234")
+	}
+	if remaining := lockedOut("next", "10.0.0.1"); remaining <= 60*time.Second {
+		t.Errorf("expected subsequent IP lockout longer than the window, got %v", remaining)
+	}
+}
+
+func TestHandleClientStream_LockoutIPDisabled(t *testing.T) {
+	lockoutAttempts, lockoutWindow = 3, 60
+	t.Cleanup(func() { lockoutAttempts = 0 })
+	resetTestState()
+	path := withAuditLog(t)
+	streamsTokens.Store("other", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+	store.Append(context.Background(), "other", Record{content: []byte("content"), signature: "signature"})
+
+	for n := 0; n < 3; n++ {
+		listenWithToken("asd", "guess", "10.0.0.1:1234")
+	}
+	if entries := readAuditLog(t, path); entries[len(entries)-1].Event != auditLockout || entries[len(entries)-1].Reason != "request_id asd locked out for 60s" {
+		t.Errorf("expected the lockout to be audited, got %+v", entries)
+	}
+	// Only the request ID is locked out, clients sharing the IP (eg. a load balancer) can still listen
+	if rr := listenWithToken("asd", "guess", "10.0.0.1:1234"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr := listenWithToken("other", "a", "10.0.0.1:1234"); rr.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestHandleClientStream_LockoutDisabledByDefault(t *testing.T) {
+	resetTestState()
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+	store.Append(context.Background(), "asd", Record{content: []byte("content"), signature: "signature"})
+
+	// Failures of someone guessing don't lock out the token holder
+	for n := 0; n < 20; n++ {
+		listenWithToken("asd", "guess", "10.0.0.1:1234")
+	}
+	if rr := listenWithToken("asd", "a", "10.0.0.2:1234"); rr.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	networks, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatalf("expected trusted proxies to parse, got %v", err)
+	}
+	trustedProxies = networks
+	t.Cleanup(func() { trustedProxies = nil })
+
+	tests := []struct {
+		remoteAddr, forwarded, ip string
+	}{
+		{"198.51.100.1:1234", "203.0.113.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "203.0.113.1", "203.0.113.1"},
+		{"192.0.2.1:1234", "203.0.113.9, 203.0.113.1, 10.0.0.2", "203.0.113.1"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if ip := clientIP(req); ip != test.ip {
+			t.Errorf("expected client IP %s for %s forwarded for %q, got %s", test.ip, test.remoteAddr, test.forwarded, ip)
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "proxy"} {
+		if _, err = parseTrustedProxies(invalid); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestCleanupLockouts(t *testing.T) {
+	lockouts = map[string]*lockout{}
+	lockoutWindow = 60
+	now := time.Now().Unix()
+	lockouts["ip:old"] = &lockout{failures: 1, updatedAt: now - 60<<maxLockoutBackoff - 1}
+	lockouts["ip:recent"] = &lockout{failures: 1, updatedAt: now}
+	lockouts["ip:locked"] = &lockout{lockedUntil: now + 60, updatedAt: now - 60<<maxLockoutBackoff - 1}
+
+	cleanupLockouts()
+	if _, ok := lockouts["ip:old"]; ok {
+		t.Errorf("expected old failures to be forgotten")
+	}
+	if len(lockouts) != 2 {
+		t.Errorf("expected recent failures and active lockouts to be kept, got %v", lockouts)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"flag"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
 	"log"
 	"net"
 	"net/http"
@@ -15,25 +16,110 @@ import (
 	"time"
 )
 
+// storeTimeout limits store operations not bound to a client request
+const storeTimeout = 5 * time.Second
+
 var (
 	store          Store
 	signalCh       chan os.Signal
 	addrStr        string
 	requestTimeout int
+
+	// recordRetention is how long (seconds) the webhook payloads are kept waiting for the client,
+	// 0 means the same as requestTimeout
+	recordRetention int
+	// cleanupInterval is how often (seconds) expired payloads and tokens are removed
+	cleanupInterval int
+
+	// providersFile configures webhook providers other than Baseten, see provider.go
+	providersFile string
+
+	// trustedProxiesList is the comma separated `-trusted-proxies` setting, parsed into trustedProxies
+	trustedProxiesList string
+
+	// Upper bounds (seconds) of the per-request overrides accepted by `POST /token`
+	maxRequestTimeout  int
+	maxRecordRetention int
+	maxTokenTTL        int
 )
 
 func main() {
+	// Subcommands (`wait`, `send`), server mode otherwise
+	if code, ok := runSubcommand(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+
 	// Configure logging
 	log.SetFlags(log.LstdFlags)
 	log.SetOutput(os.Stdout)
 
 	// Settings
 	flag.IntVar(&requestTimeout, "timeout", 120, "maximum waiting time for webhook response in seconds. Client connection gets closed after that.")
+	flag.IntVar(&recordRetention, "retention", 0, "how long in seconds webhook payloads are kept waiting for the client, defaults to -timeout value when 0")
+	flag.IntVar(&tokenTTL, "token-ttl", 900, "stream token lifetime in seconds")
+	flag.IntVar(&maxRequestTimeout, "max-timeout", 600, "maximum client stream timeout in seconds which can be requested in `POST /token`")
+	flag.IntVar(&maxRecordRetention, "max-retention", 3600, "maximum webhook payload retention in seconds which can be requested in `POST /token`")
+	flag.IntVar(&maxTokenTTL, "max-token-ttl", 3600, "maximum stream token lifetime in seconds which can be requested in `POST /token`")
+	flag.IntVar(&maxBatchSize, "max-batch-size", 1000, "maximum number of request IDs in a batch created with `POST /batch` or `POST /tokens`")
+	flag.IntVar(&cleanupInterval, "cleanup-interval", 10, "interval in seconds between removals of expired webhook payloads and tokens")
+	flag.IntVar(&replayWindow, "replay-window", 3600, "how long in seconds delivered webhooks are remembered for detecting duplicates and re-deliveries")
+	flag.IntVar(&lockoutAttempts, "lockout-attempts", 0, "failed stream authorizations after which the request ID (and the client IP with -lockout-ip) is locked out, 0 (default) disables the lockout. Anyone knowing the request ID can lock out its token holder.")
+	flag.BoolVar(&lockoutIPs, "lockout-ip", false, "whether to lock out the client IPs besides the request IDs. Behind a load balancer requires -trusted-proxies, otherwise all clients share its IP.")
+	flag.StringVar(&trustedProxiesList, "trusted-proxies", "", "comma separated IPs and CIDR networks of the load balancers in front of the proxy, the client IP of their requests is taken from `X-Forwarded-For`")
+	flag.IntVar(&lockoutWindow, "lockout-window", 300, "lockout duration in seconds, doubled with every subsequent lockout")
+	flag.IntVar(&keepAliveInterval, "keep-alive", 5, "default interval in seconds between keep-alive events sent to clients. Clients can request a different one with `keep_alive` query parameter.")
+	flag.IntVar(&compressThreshold, "compress-threshold", 0, "minimum size in bytes of webhook payloads compressed (zstd) in the store, 0 disables compression")
+	flag.StringVar(&statusField, "status-field", "", "dotted path of the webhook payload field with the request status, e.g. `status`. Payloads with non-terminal status are streamed as progress events. Every payload ends the stream when empty.")
+	flag.StringVar(&terminalStatuses, "terminal-statuses", "completed,succeeded,failed,error,cancelled,canceled", "comma separated statuses ending the client stream. Payloads without the status field always end it.")
 	flag.BoolVar(&insecureMetrics, "allow-insecure-metrics", false, "whether to expose /metrics endpoint without requiring token")
 	flag.StringVar(&metricsTokenCli, "metrics-token", "", "bearer token required for accessing /metrics endpoint")
 	flag.StringVar(&addrStr, "addr", "0.0.0.0:8000", "address and port to listen on")
+	flag.StringVar(&grpcAddr, "grpc-addr", "", "address and port the gRPC API listens on, the gRPC API is disabled when empty")
+	flag.StringVar(&encryptionKeysFile, "encryption-keys", "", "file with `«key id»:«base64 AES key»` lines encrypting webhook payloads at rest, the first key encrypts new payloads. Defaults to PROXY_ENCRYPTION_KEYS env variable, no encryption when empty.")
+	flag.BoolVar(&encryptionTokenBound, "encryption-token-bound", false, "also derive payload encryption keys from the stream token, protecting the store but not the proxy memory holding the tokens until delivery. Payloads received before the token is created use the key only")
+	flag.IntVar(&accessTokenTTL, "access-token-ttl", 60, "lifetime in seconds of the single-use access tokens issued with `POST /access-token` for browser clients")
+	flag.StringVar(&corsOrigins, "cors-origins", "", "comma separated origins allowed to call the token and stream endpoints from browsers, `*` for any. CORS is disabled when empty.")
+	flag.BoolVar(&corsCredentials, "cors-credentials", false, "whether to allow cookies in cross-origin requests of the allowed origins, can't be combined with the `*` origin")
+	flag.StringVar(&predictURL, "predict-url", "", "upstream `async_predict` URL the `POST /predict` requests are forwarded to, the endpoint is disabled when empty")
+	flag.StringVar(&publicURL, "public-url", "", "base URL the proxy is reachable at by the upstream, its `/webhook` is sent as `webhook_endpoint` by `POST /predict`")
+	flag.StringVar(&cancelURL, "cancel-url", "", "upstream URL template the `DELETE /requests/{request_id}` cancellations are propagated to with `DELETE`, `{request_id}` is replaced with the request ID. Not propagated when empty.")
+	flag.StringVar(&cancelAPIKey, "cancel-api-key", "", "API key authorizing the upstream cancel requests. Defaults to PROXY_CANCEL_API_KEY env variable.")
+	flag.BoolVar(&predictOnly, "predict-only", false, "issue stream tokens only with `POST /predict`, so request IDs can be claimed only by whoever started the prediction")
+	flag.StringVar(&auditLogPath, "audit-log", "", "file the hash chained audit log (JSON lines) is appended to, `-` for stdout. Disabled when empty.")
+	flag.StringVar(&providersFile, "providers", "", "JSON file with webhook providers served on `POST /webhook/{provider}`, in addition to the built-in `baseten`")
 	flag.Parse()
 	setupPrometheusAuth()
+	if providersFile != "" {
+		if err := loadProviders(providersFile); err != nil {
+			log.Fatalf("error loading webhook providers: %v\n", err)
+		}
+	}
+
+	networks, err := parseTrustedProxies(trustedProxiesList)
+	if err != nil {
+		log.Fatalf("error parsing -trusted-proxies: %v\n", err)
+	}
+	trustedProxies = networks
+	if err = validateCORS(); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if cleanupInterval <= 0 {
+		log.Fatalf("-cleanup-interval must be a positive number of seconds\n")
+	}
+	if predictURL != "" && publicURL == "" {
+		log.Fatalf("-predict-url requires -public-url\n")
+	}
+	if predictOnly && predictURL == "" {
+		log.Fatalf("-predict-only requires -predict-url\n")
+	}
+	if cancelAPIKey == "" {
+		cancelAPIKey = os.Getenv("PROXY_CANCEL_API_KEY")
+	}
+	if auditLogPath != "" {
+		if auditLog, err = openAuditLog(auditLogPath); err != nil {
+			log.Fatalf("error opening audit log: %v\n", err)
+		}
+	}
 
 	// Configure graceful signal handling
 	// `ctx` is passed to client stream handling for graceful connection closing
@@ -44,7 +130,20 @@ func main() {
 	defer shutdownRelease()
 
 	// Initialize data store
+	// Payloads are compressed before encryption, so the compressing store wraps the encrypting one
 	store = NewInMemStore()
+	keys, err := loadEncryptionKeys(encryptionKeysFile)
+	if err != nil {
+		log.Fatalf("error loading encryption keys: %v\n", err)
+	}
+	if keys != nil {
+		store = newEncryptingStore(store, keys, encryptionTokenBound)
+	} else if encryptionTokenBound {
+		log.Fatalf("-encryption-token-bound requires encryption keys\n")
+	}
+	if compressThreshold > 0 {
+		store = newCompressingStore(store, compressThreshold)
+	}
 
 	// token.go. Stores webhook's requests_ids and tokens assigned to them.
 	// Tokens are required to connect to `/listen` endpoint and listen to the webhook responses.
@@ -52,6 +151,10 @@ func main() {
 
 	// Start http server
 	server := startServer(ctx)
+	var rpcServer *grpc.Server
+	if grpcAddr != "" {
+		rpcServer = startGRPCServer(ctx)
+	}
 	go cleanup()
 
 	// Wait for interrupt signal
@@ -65,38 +168,60 @@ func main() {
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		log.Fatalf("error shutting down http server: %v\n", err)
 	}
+	if rpcServer != nil {
+		rpcServer.GracefulStop()
+	}
 	log.Println("shutting down")
 }
 
-// cleanup removes webhook responses older than requestTimeout seconds
-// those can only happen when they were delivered after the requestTimeout was exceeded
-// in client stream connection, ie.
-// client connects --> 120s passes --> client timeouts --> webhook delivered --> 120s passes --> delete webhook payload
+// cleanup periodically removes webhook responses past their retention, expired stream tokens and batches.
+// Those payloads can only remain when they were not collected by the client, ie.
+// client connects --> 120s passes --> client timeouts --> webhook delivered --> retention passes --> delete webhook payload
 func cleanup() {
-	t := time.NewTicker(time.Duration(requestTimeout) * time.Second)
+	t := time.NewTicker(time.Duration(cleanupInterval) * time.Second)
 	for {
 		<-t.C
-		// Clean webhook payloads store
-		log.Printf("cleaning up the store from webhook payloads older than %d seconds...", requestTimeout)
-		reqs := store.GetOlderThan(time.Duration(requestTimeout) * time.Second)
-		log.Printf("%d requests older than %d seconds, deleting", len(reqs), requestTimeout)
-		promTimedOutWebhooks.Add(float64(len(reqs)))
-		for _, req := range reqs {
-			store.Delete(req)
-		}
+		cleanupStore()
+		cleanupTokens()
+		cleanupBatches()
+		cleanupDeliveries()
+		cleanupLockouts()
+		cleanupAccessTokens()
+		cleanupLifecycles()
+	}
+}
 
-		// Clean listener tokens
-		n := 0
-		streamsTokens.Range(func(key, value interface{}) bool {
-			token := value.(streamToken)
-			if token.expiresAt < time.Now().Unix() {
-				streamsTokens.Delete(key)
-				n++
-			}
-			return true
-		})
-		log.Printf("%d expired streams tokens, deleting", n)
-		promActiveTokens.Sub(float64(n))
+// defaultRetention returns how long the webhook payloads are kept if the client didn't request otherwise
+func defaultRetention() time.Duration {
+	if recordRetention > 0 {
+		return time.Duration(recordRetention) * time.Second
+	}
+	return time.Duration(requestTimeout) * time.Second
+}
+
+// cleanupStore deletes webhook payloads past their retention
+func cleanupStore() {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	reqs, err := store.GetOlderThan(ctx, defaultRetention())
+	if err != nil {
+		log.Printf("failed to list webhook payloads past retention: %v", err)
+		promStoreErrors.WithLabelValues("get_older_than").Inc()
+		return
+	}
+	if len(reqs) > 0 {
+		log.Printf("%d requests past retention, deleting", len(reqs))
+	}
+	for _, req := range reqs {
+		if err = store.Delete(ctx, req); err != nil {
+			log.Printf("failed to delete webhook payload (request_id: %s): %v", req, err)
+			promStoreErrors.WithLabelValues("delete").Inc()
+			continue
+		}
+		expireRequest(req)
+		auditLog.record(auditEntry{Event: auditExpired, RequestId: req})
+		promTimedOutWebhooks.Inc()
 	}
 }
 
@@ -108,19 +233,9 @@ func startServer(ctx context.Context) *http.Server {
 		return nil
 	}
 	server := &http.Server{
-		Addr: addr.String(),
+		Addr:    addr.String(),
+		Handler: newServeMux(ctx),
 	}
-	mux := http.NewServeMux()
-	mux.HandleFunc("POST /webhook", handleIncomingWebhook)
-	mux.HandleFunc("POST /token", handleCreateToken)
-	mux.HandleFunc("GET /listen/{request_id}", handleClientStream(ctx))
-	mux.Handle("/metrics", prometheusAuthMiddleware(promhttp.Handler()))
-	mux.HandleFunc("GET /health", func(w http.ResponseWriter, _ *http.Request) {
-		w.WriteHeader(200)
-		w.Header().Set("Content-Type", "application/json")
-		_, _ = w.Write([]byte(`{"status": "ok"}`))
-	})
-	server.Handler = mux
 
 	// Start server
 	log.Println("starting server")
@@ -133,3 +248,29 @@ func startServer(ctx context.Context) *http.Server {
 	}()
 	return server
 }
+
+// newServeMux registers all proxy routes. `ctx` is passed to client stream handling for graceful connection closing.
+func newServeMux(ctx context.Context) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /webhook", handleIncomingWebhook)
+	mux.HandleFunc("POST /webhook/{provider}", handleProviderWebhook)
+	mux.HandleFunc("POST /token", cors(handleCreateToken))
+	mux.HandleFunc("POST /tokens", cors(handleCreateTokens))
+	mux.HandleFunc("POST /access-token", cors(handleCreateAccessToken))
+	mux.HandleFunc("POST /predict", cors(handlePredict))
+	mux.HandleFunc("GET /listen/{request_id}", cors(gzipStream(handleClientStream(ctx))))
+	mux.HandleFunc("DELETE /requests/{request_id}", cors(handleCancelRequest))
+	mux.HandleFunc("GET /requests/{request_id}/status", cors(handleRequestStatus))
+	mux.HandleFunc("POST /batch", cors(handleCreateBatch))
+	mux.HandleFunc("GET /listen/batch/{batch_id}", cors(gzipStream(handleBatchStream(ctx))))
+	for _, path := range []string{"/token", "/tokens", "/access-token", "/predict", "/listen/{request_id}", "/requests/{request_id}", "/requests/{request_id}/status", "/batch", "/listen/batch/{batch_id}"} {
+		mux.HandleFunc("OPTIONS "+path, cors(handleCORSPreflight))
+	}
+	mux.Handle("/metrics", prometheusAuthMiddleware(promhttp.Handler()))
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status": "ok"}`))
+	})
+	return mux
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCleanupStore(t *testing.T) {
+	s := NewInMemStore()
+	store = s
+	requestTimeout, recordRetention = 5, 30
+
+	s.store.Store("expired", []Record{{content: []byte("a"), createdAt: time.Now().Unix() - 60}})
+	s.store.Store("retained", []Record{{content: []byte("b"), createdAt: time.Now().Unix() - 10}})
+	s.store.Store("extended", []Record{{content: []byte("c"), createdAt: time.Now().Unix() - 60, retention: time.Hour}})
+
+	cleanupStore()
+	for requestId, expected := range map[string]bool{"expired": false, "retained": true, "extended": true} {
+		if _, err := store.Get(context.Background(), requestId); (err == nil) != expected {
+			t.Errorf("expected %s to be present: %v, got err: %v", requestId, expected, err)
+		}
+	}
+}
+
+func TestDefaultRetention(t *testing.T) {
+	requestTimeout, recordRetention = 120, 0
+	if d := defaultRetention(); d != 120*time.Second {
+		t.Errorf("expected retention to fall back to timeout, got %s", d)
+	}
+	recordRetention = 600
+	if d := defaultRetention(); d != 600*time.Second {
+		t.Errorf("expected configured retention, got %s", d)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// predictURL is the upstream `async_predict` URL the `POST /predict` requests are forwarded to, the endpoint is
+	// disabled when empty
+	predictURL string
+	// publicURL is the base URL the proxy is reachable at by the upstream, its `/webhook` is sent as `webhook_endpoint`
+	publicURL string
+	// predictOnly issues stream tokens only with `POST /predict`, so request IDs can be claimed only by whoever
+	// started the prediction
+	predictOnly bool
+)
+
+// maxPredictResponseSize limits the upstream response read by the proxy
+const maxPredictResponseSize = 1 << 20
+
+var upstreamClient = &http.Client{Timeout: 30 * time.Second}
+
+// predictOnlyMessage is the response body of the token endpoints when tokens are issued only with `POST /predict`
+const predictOnlyMessage = "Forbidden. Stream tokens are issued only with `POST /predict`."
+
+// overridesErrorMessage returns the response body for invalid token overrides, empty for other errors
+func overridesErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, errNegativeOverride):
+		return negativeOverrideMessage
+	case errors.Is(err, errInvalidTransform):
+		return invalidTransformMessage
+	case errors.Is(err, errInvalidPublicKey):
+		return invalidPublicKeyMessage
+	}
+	return ""
+}
+
+// handlePredict handles `POST /predict` route. Forwards the prediction request to the upstream `async_predict` with
+// the proxy webhook as `webhook_endpoint` and responds with the upstream response extended with the stream token
+// of the returned request ID. Token overrides are accepted in the `webhook_proxy` field, which is not forwarded.
+func handlePredict(w http.ResponseWriter, r *http.Request) {
+	if predictURL == "" {
+		http.Error(w, "predict not configured", http.StatusNotFound)
+		return
+	}
+
+	var req map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req == nil {
+		log.Printf("error decoding predict request: %v", err)
+		http.Error(w, "Bad request. JSON object body is required.", http.StatusBadRequest)
+		return
+	}
+	var o tokenOverrides
+	if raw, ok := req["webhook_proxy"]; ok {
+		if err := json.Unmarshal(raw, &o); err != nil {
+			log.Printf("error decoding predict token overrides: %v", err)
+			http.Error(w, "Bad request. Field `webhook_proxy` must be an object with token overrides.", http.StatusBadRequest)
+			return
+		}
+		delete(req, "webhook_proxy")
+	}
+
+	// The token is generated before the upstream call, so the prediction isn't started with invalid overrides
+	st, err := newStreamToken(o)
+	if msg := overridesErrorMessage(err); msg != "" {
+		log.Printf("invalid token overrides for predict: %v", err)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("error generating token for predict: %v", err)
+		http.Error(w, "cannot generate token", http.StatusInternalServerError)
+		return
+	}
+
+	req["webhook_endpoint"], _ = json.Marshal(strings.TrimSuffix(publicURL, "/") + "/webhook")
+	body, err := json.Marshal(req)
+	if err != nil {
+		log.Printf("error encoding predict request: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	upstreamReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, predictURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("error creating upstream predict request: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	upstreamReq.Header.Set("Content-Type", "application/json")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		upstreamReq.Header.Set("Authorization", auth)
+	}
+
+	resp, err := upstreamClient.Do(upstreamReq)
+	if err != nil {
+		log.Printf("upstream predict request failed: %v", err)
+		promPredictRequests.WithLabelValues("unavailable").Inc()
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxPredictResponseSize))
+	if err != nil {
+		log.Printf("failed to read upstream predict response: %v", err)
+		promPredictRequests.WithLabelValues("unavailable").Inc()
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// Upstream errors are relayed as they are
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("upstream predict request rejected with status %d", resp.StatusCode)
+		promPredictRequests.WithLabelValues("upstream_error").Inc()
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		_, _ = w.Write(respBody)
+		return
+	}
+
+	var res map[string]any
+	if err = json.Unmarshal(respBody, &res); err != nil {
+		log.Printf("invalid upstream predict response: %v", err)
+		promPredictRequests.WithLabelValues("upstream_error").Inc()
+		http.Error(w, "invalid upstream response", http.StatusBadGateway)
+		return
+	}
+	requestId, _ := res["request_id"].(string)
+	if requestId == "" {
+		log.Printf("upstream predict response without request id: %s", respBody)
+		promPredictRequests.WithLabelValues("upstream_error").Inc()
+		http.Error(w, "invalid upstream response", http.StatusBadGateway)
+		return
+	}
+
+	// The prediction is started, but its results stay with whoever claimed the request ID first
+	if err = storeStreamToken(requestId, st); errors.Is(err, errTokenExists) {
+		log.Printf("token already exists for the predicted request (request_id: %s)", requestId)
+		promPredictRequests.WithLabelValues("conflict").Inc()
+		http.Error(w, "token already exists", http.StatusConflict)
+		return
+	}
+	promPredictRequests.WithLabelValues("ok").Inc()
+	auditRequest(r, auditEntry{Event: auditTokenCreated, RequestId: requestId, Reason: "predict"})
+	log.Printf("prediction started with token (request_id: %s)", requestId)
+
+	for k, v := range st.response() {
+		res[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("error responding to predict (request_id: %s): %v", requestId, err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flowaicom/webhook-proxy/basetensim"
+	"github.com/flowaicom/webhook-proxy/client"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// withPredict configures the proxy `POST /predict` upstream to the simulator
+func withPredict(t *testing.T, proxyURL string, sim *basetensim.Server) {
+	t.Helper()
+	simSrv := httptest.NewServer(sim.Handler())
+	predictURL, publicURL = simSrv.URL+"/production/async_predict", proxyURL
+	t.Cleanup(func() {
+		simSrv.Close()
+		predictURL, publicURL, predictOnly = "", "", false
+	})
+}
+
+func postPredict(t *testing.T, proxyURL, apiKey, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, proxyURL+"/predict", bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Api-Key "+apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("predict request failed: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestPredict(t *testing.T) {
+	requestTimeout = 10
+	proxy := newTestProxy(t, nil)
+	sim := basetensim.New("secret", 200*time.Millisecond)
+	sim.APIKey = "key"
+	withPredict(t, proxy.URL, sim)
+
+	c := client.New(proxy.URL, client.WithSecret("secret"), client.WithTimeout(5*time.Second))
+	requestId, token, err := c.Predict(context.Background(), "key", map[string]any{"model_input": map[string]string{"prompt": "hi"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if requestId == "" || token.Token == "" {
+		t.Fatalf("expected request id and token, got %q %+v", requestId, token)
+	}
+
+	// The request ID is already claimed
+	if _, err = c.CreateToken(context.Background(), requestId); !errors.Is(err, client.ErrTokenExists) {
+		t.Errorf("expected token to exist, got %v", err)
+	}
+
+	res, err := c.Listen(context.Background(), requestId, token.Token)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var payload basetensim.Payload
+	if err = json.Unmarshal(res.Payload, &payload); err != nil {
+		t.Fatalf("expected Baseten payload, got %s: %v", res.Payload, err)
+	}
+	if payload.RequestId != requestId || string(payload.Data) != `{"output":{"prompt":"hi"}}` {
+		t.Errorf("unexpected payload delivered: %s", res.Payload)
+	}
+
+	sim.Wait()
+	if d := sim.Deliveries(); len(d) != 1 || d[0].Endpoint != proxy.URL+"/webhook" {
+		t.Errorf("expected single delivery to the proxy webhook, got %+v", d)
+	}
+}
+
+func TestPredict_TokenOverrides(t *testing.T) {
+	maxTokenTTL = 1800
+	proxy := newTestProxy(t, nil)
+	sim := basetensim.New("secret", time.Hour)
+	withPredict(t, proxy.URL, sim)
+
+	resp := postPredict(t, proxy.URL, "key", `{"model_input": {}, "webhook_proxy": {"token_ttl": 120}}`)
+	var res struct {
+		RequestId string `json:"request_id"`
+		Token     string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 with JSON body, got %d: %v", resp.StatusCode, err)
+	}
+	v, ok := streamsTokens.Load(res.RequestId)
+	if !ok || v.(streamToken).token != res.Token {
+		t.Fatalf("expected token stored for the predicted request id, got %v", res)
+	}
+	if ttl := v.(streamToken).expiresAt - time.Now().Unix(); ttl > 120 || ttl < 110 {
+		t.Errorf("expected token ttl override of 120s, got %ds", ttl)
+	}
+}
+
+func TestPredict_InvalidOverrides(t *testing.T) {
+	proxy := newTestProxy(t, nil)
+	sim := basetensim.New("secret", 0)
+	withPredict(t, proxy.URL, sim)
+
+	resp := postPredict(t, proxy.URL, "key", `{"model_input": {}, "webhook_proxy": {"token_ttl": -1}}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+	if d := sim.Deliveries(); len(d) != 0 {
+		t.Errorf("expected prediction not started, got %+v", d)
+	}
+}
+
+func TestPredict_UpstreamError(t *testing.T) {
+	proxy := newTestProxy(t, nil)
+	sim := basetensim.New("secret", 0)
+	sim.APIKey = "key"
+	withPredict(t, proxy.URL, sim)
+
+	resp := postPredict(t, proxy.URL, "wrong", `{"model_input": {}}`)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected upstream 401 relayed, got %d", resp.StatusCode)
+	}
+	n := 0
+	streamsTokens.Range(func(any, any) bool { n++; return true })
+	if n != 0 {
+		t.Errorf("expected no tokens issued, got %d", n)
+	}
+}
+
+func TestPredict_MissingRequestId(t *testing.T) {
+	proxy := newTestProxy(t, nil)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+	predictURL, publicURL = upstream.URL, proxy.URL
+	t.Cleanup(func() { predictURL, publicURL = "", "" })
+
+	resp := postPredict(t, proxy.URL, "key", `{"model_input": {}}`)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected 502, got %d", resp.StatusCode)
+	}
+}
+
+func TestPredict_TokenExists(t *testing.T) {
+	proxy := newTestProxy(t, nil)
+	var authorization []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Values("Authorization")
+		w.Write([]byte(`{"request_id": "req1"}`))
+	}))
+	defer upstream.Close()
+	predictURL, publicURL = upstream.URL, proxy.URL
+	t.Cleanup(func() { predictURL, publicURL = "", "" })
+	streamsTokens.Store("req1", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+	activeTokens := testutil.ToFloat64(promActiveTokens)
+
+	// Without the Authorization header, which isn't forwarded empty
+	resp, err := http.Post(proxy.URL+"/predict", "application/json", bytes.NewBufferString(`{"model_input": {}}`))
+	if err != nil {
+		t.Fatalf("predict request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected 409, got %d", resp.StatusCode)
+	}
+	if len(authorization) != 0 {
+		t.Errorf("expected no Authorization header forwarded, got %q", authorization)
+	}
+	if st, _ := streamsTokens.Load("req1"); st.(streamToken).token != "a" {
+		t.Errorf("expected existing token kept, got %v", st)
+	}
+	if n := testutil.ToFloat64(promActiveTokens); n != activeTokens {
+		t.Errorf("expected active tokens unchanged, got %v (was %v)", n, activeTokens)
+	}
+}
+
+func TestPredict_NotConfigured(t *testing.T) {
+	proxy := newTestProxy(t, nil)
+	resp := postPredict(t, proxy.URL, "key", `{"model_input": {}}`)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestPredictOnly(t *testing.T) {
+	proxy := newTestProxy(t, nil)
+	sim := basetensim.New("secret", time.Hour)
+	withPredict(t, proxy.URL, sim)
+	predictOnly = true
+
+	c := client.New(proxy.URL)
+	var statusErr *client.StatusError
+	if _, err := c.CreateToken(context.Background(), "req1"); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403, got %v", err)
+	}
+	resp, err := http.Post(proxy.URL+"/tokens", "application/json", bytes.NewBufferString(`{"request_ids": ["req1"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", resp.StatusCode)
+	}
+
+	if _, _, err = c.Predict(context.Background(), "key", map[string]any{"model_input": map[string]any{}}); err != nil {
+		t.Errorf("expected predict allowed, got %v", err)
+	}
+}
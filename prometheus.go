@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/subtle"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"log"
@@ -42,6 +43,42 @@ var (
 		Name: "webhook_proxy_active_tokens",
 		Help: "Number of currently active stream tokens",
 	})
+
+	promStoreErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_proxy_store_errors_total",
+		Help: "The total number of failed store operations",
+	}, []string{"operation"})
+
+	promDuplicateWebhooks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_proxy_duplicate_webhooks_total",
+		Help: "The total number of webhook re-deliveries, either duplicates of received payloads or deliveries after the result was consumed or the request cancelled",
+	}, []string{"reason"})
+
+	promLockouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_proxy_lockouts_total",
+		Help: "The total number of request IDs and client IPs locked out after too many failed stream authorizations",
+	}, []string{"kind"})
+
+	promPredictRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_proxy_predict_requests_total",
+		Help: "The total number of predictions forwarded to the upstream with `POST /predict`, by result",
+	}, []string{"result"})
+
+	promCancelledRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_proxy_cancelled_requests_total",
+		Help: "The total number of requests cancelled with `DELETE /requests/{request_id}`, by the upstream cancellation outcome",
+	}, []string{"upstream"})
+
+	promPredictionResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_proxy_prediction_results_total",
+		Help: "The total number of final Baseten webhooks received, by the prediction result (success or failure)",
+	}, []string{"result"})
+
+	promCompressionRatio = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webhook_proxy_compression_ratio",
+		Help:    "Ratio of uncompressed to compressed size of webhook payloads in the store, gzip encoded webhooks and gzip encoded client streams",
+		Buckets: []float64{1, 1.5, 2, 3, 5, 10, 20, 50},
+	}, []string{"kind"})
 )
 
 func setupPrometheusAuth() {
@@ -80,7 +117,7 @@ func prometheusAuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		if r.Header.Get("Authorization") != "Bearer "+metricsToken {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+metricsToken)) != 1 {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// provider describes how webhooks of an async inference service are correlated with requests and verified
+type provider struct {
+	Name string `json:"name"`
+
+	// RequestId defines where the correlation (request) ID is taken from
+	RequestId struct {
+		// From is one of `json` (dotted path in the body), `header` or `query` (parameter)
+		From string `json:"from"`
+		Key  string `json:"key"`
+	} `json:"request_id"`
+
+	// StatusField overrides `-status-field` for this provider
+	StatusField string `json:"status_field"`
+
+	Signature struct {
+		// Header holds the signature, forwarded to the clients as is. Webhooks without it are rejected.
+		Header string `json:"header"`
+
+		// Verification on the proxy, only when the secret is set. Clients can verify the signatures on their own.
+		Secret    string `json:"secret"`
+		SecretEnv string `json:"secret_env"`
+		// Algorithm is one of `hmac-sha256` (default), `hmac-sha1` or `hmac-sha512`
+		Algorithm string `json:"algorithm"`
+		// Encoding of the digest, `hex` (default) or `base64`
+		Encoding string `json:"encoding"`
+		// Prefix preceding the digest, eg. `v1=` or `sha256=`
+		Prefix string `json:"prefix"`
+		// TimestampHeader holds unix timestamp of the delivery. When set, `«timestamp».«body»` is signed
+		// and deliveries older than Tolerance (seconds, 300 by default) are rejected.
+		TimestampHeader string `json:"timestamp_header"`
+		Tolerance       int    `json:"tolerance"`
+	} `json:"signature"`
+}
+
+// basetenProvider is the built-in default, served on `POST /webhook`
+var basetenProvider = func() *provider {
+	p := &provider{Name: "baseten"}
+	p.RequestId.From, p.RequestId.Key = "json", "request_id"
+	p.Signature.Header = "X-BASETEN-SIGNATURE"
+	p.Signature.Prefix = "v1="
+	return p
+}()
+
+// providers served on `POST /webhook/{provider}`, by name
+var providers = map[string]*provider{"baseten": basetenProvider}
+
+var (
+	errMissingRequestId = errors.New("missing request id")
+	errInvalidSignature = errors.New("invalid signature")
+)
+
+// loadProviders reads JSON array of providers from the file, they are added to the built-in ones. Provider named
+// `baseten` replaces the default one.
+func loadProviders(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var loaded []*provider
+	if err = json.Unmarshal(b, &loaded); err != nil {
+		return fmt.Errorf("failed to parse providers: %w", err)
+	}
+	for _, p := range loaded {
+		if err = p.validate(); err != nil {
+			return fmt.Errorf("provider %q: %w", p.Name, err)
+		}
+		if p.Signature.SecretEnv != "" && p.Signature.Secret == "" {
+			p.Signature.Secret = os.Getenv(p.Signature.SecretEnv)
+		}
+		providers[p.Name] = p
+		if p.Name == "baseten" {
+			basetenProvider = p
+		}
+	}
+	return nil
+}
+
+func (p *provider) validate() error {
+	switch {
+	case p.Name == "":
+		return errors.New("name is required")
+	case p.RequestId.From != "json" && p.RequestId.From != "header" && p.RequestId.From != "query":
+		return errors.New("request_id.from must be one of json, header, query")
+	case p.RequestId.Key == "":
+		return errors.New("request_id.key is required")
+	case p.Signature.Header == "":
+		return errors.New("signature.header is required")
+	}
+	if _, err := p.hash(); err != nil {
+		return err
+	}
+	if e := p.Signature.Encoding; e != "" && e != "hex" && e != "base64" {
+		return errors.New("signature.encoding must be hex or base64")
+	}
+	return nil
+}
+
+// statusField returns the payload field with the request status
+func (p *provider) statusField() string {
+	if p.StatusField != "" {
+		return p.StatusField
+	}
+	return statusField
+}
+
+// requestId extracts the correlation ID of the webhook
+func (p *provider) requestId(r *http.Request, body []byte) (string, error) {
+	var id string
+	switch p.RequestId.From {
+	case "header":
+		id = r.Header.Get(p.RequestId.Key)
+	case "query":
+		id = r.URL.Query().Get(p.RequestId.Key)
+	default:
+		var doc any
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return "", fmt.Errorf("failed to unmarshal json body: %w", err)
+		}
+		v, _ := lookupJSONPath(doc, p.RequestId.Key)
+		id, _ = v.(string)
+	}
+	if id == "" {
+		return "", errMissingRequestId
+	}
+	return id, nil
+}
+
+func (p *provider) hash() (func() hash.Hash, error) {
+	switch p.Signature.Algorithm {
+	case "", "hmac-sha256":
+		return sha256.New, nil
+	case "hmac-sha1":
+		return sha1.New, nil
+	case "hmac-sha512":
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported signature algorithm %q", p.Signature.Algorithm)
+}
+
+// verify checks the signature of the webhook when the provider has a secret configured. The header may contain
+// several signatures separated by commas or spaces (eg. during secret rotation), any of them matching is sufficient.
+func (p *provider) verify(r *http.Request, body []byte, signature string) error {
+	if p.Signature.Secret == "" {
+		return nil
+	}
+
+	signed := body
+	if p.Signature.TimestampHeader != "" {
+		ts := r.Header.Get(p.Signature.TimestampHeader)
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: missing or malformed timestamp", errInvalidSignature)
+		}
+		tolerance := time.Duration(p.Signature.Tolerance) * time.Second
+		if tolerance <= 0 {
+			tolerance = 5 * time.Minute
+		}
+		if age := time.Since(time.Unix(sec, 0)); age > tolerance || age < -tolerance {
+			return fmt.Errorf("%w: timestamp outside of tolerance", errInvalidSignature)
+		}
+		signed = append([]byte(ts+"."), body...)
+	}
+
+	h, _ := p.hash()
+	mac := hmac.New(h, []byte(p.Signature.Secret))
+	mac.Write(signed)
+	var expected string
+	if p.Signature.Encoding == "base64" {
+		expected = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	} else {
+		expected = hex.EncodeToString(mac.Sum(nil))
+	}
+
+	candidates := strings.FieldsFunc(signature, func(r rune) bool { return r == ',' || r == ' ' })
+	for _, s := range candidates {
+		if hmac.Equal([]byte(strings.TrimPrefix(s, p.Signature.Prefix)), []byte(expected)) {
+			return nil
+		}
+	}
+	return errInvalidSignature
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// withProviders loads the providers config for the test and restores the built-in ones after it
+func withProviders(t *testing.T, config string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "providers.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	prevProviders, prevBaseten := providers, basetenProvider
+	providers = map[string]*provider{"baseten": basetenProvider}
+	t.Cleanup(func() { providers, basetenProvider = prevProviders, prevBaseten })
+	if err := loadProviders(path); err != nil {
+		t.Fatalf("expected providers to load, got %v", err)
+	}
+}
+
+func TestLoadProviders_Invalid(t *testing.T) {
+	configs := []string{
+		`not json`,
+		`[{"request_id": {"from": "json", "key": "id"}, "signature": {"header": "X-Sig"}}]`,
+		`[{"name": "p", "request_id": {"from": "cookie", "key": "id"}, "signature": {"header": "X-Sig"}}]`,
+		`[{"name": "p", "request_id": {"from": "json", "key": "id"}, "signature": {}}]`,
+		`[{"name": "p", "request_id": {"from": "json", "key": "id"}, "signature": {"header": "X-Sig", "algorithm": "md5"}}]`,
+	}
+	for _, config := range configs {
+		path := filepath.Join(t.TempDir(), "providers.json")
+		_ = os.WriteFile(path, []byte(config), 0o600)
+		if err := loadProviders(path); err == nil {
+			t.Errorf("expected error loading %s", config)
+		}
+	}
+}
+
+func TestHandleProviderWebhook(t *testing.T) {
+	t.Setenv("ACME_SECRET", "acme-secret")
+	withProviders(t, `[
+		{"name": "replicate", "request_id": {"from": "json", "key": "prediction.id"}, "signature": {"header": "X-Signature"}},
+		{"name": "acme", "request_id": {"from": "query", "key": "job"}, "signature": {"header": "Webhook-Signature",
+			"secret_env": "ACME_SECRET", "encoding": "base64", "prefix": "v1,", "timestamp_header": "Webhook-Timestamp"}}
+	]`)
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	oldTs := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	body := `{"status": "succeeded"}`
+	sign := func(ts string) string {
+		mac := hmac.New(sha256.New, []byte("acme-secret"))
+		mac.Write([]byte(ts + "." + body))
+		return "v1,invalid v1," + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	tests := []struct {
+		name          string
+		url           string
+		body          string
+		headers       map[string]string
+		expectedCode  int
+		expectedStore string
+	}{
+		{"json path", "/webhook/replicate", `{"prediction": {"id": "req1"}}`, map[string]string{"X-Signature": "sig"}, http.StatusOK, "req1"},
+		{"missing id", "/webhook/replicate", `{"id": "req1"}`, map[string]string{"X-Signature": "sig"}, http.StatusBadRequest, ""},
+		{"baseten header ignored", "/webhook/replicate", `{"prediction": {"id": "req1"}}`, map[string]string{"X-BASETEN-SIGNATURE": "sig"}, http.StatusBadRequest, ""},
+		{"unknown provider", "/webhook/unknown", `{}`, nil, http.StatusNotFound, ""},
+		{"verified", "/webhook/acme?job=req2", body, map[string]string{"Webhook-Signature": sign(ts), "Webhook-Timestamp": ts}, http.StatusOK, "req2"},
+		{"invalid signature", "/webhook/acme?job=req2", body, map[string]string{"Webhook-Signature": "v1,invalid", "Webhook-Timestamp": ts}, http.StatusUnauthorized, ""},
+		{"missing timestamp", "/webhook/acme?job=req2", body, map[string]string{"Webhook-Signature": sign(ts)}, http.StatusUnauthorized, ""},
+		{"stale timestamp", "/webhook/acme?job=req2", body, map[string]string{"Webhook-Signature": sign(oldTs), "Webhook-Timestamp": oldTs}, http.StatusUnauthorized, ""},
+	}
+
+	mux := newServeMux(context.Background())
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetTestState()
+			req, _ := http.NewRequest("POST", test.url, bytes.NewBufferString(test.body))
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Fatalf("expected status %d, got %d (response body: %s)", test.expectedCode, rr.Code, rr.Body.String())
+			}
+			if test.expectedStore == "" {
+				return
+			}
+			records, err := store.Get(context.Background(), test.expectedStore)
+			if err != nil || string(records[0].content) != test.body || records[0].signature == "" {
+				t.Errorf("expected webhook stored for %s, got %v (err: %v)", test.expectedStore, records, err)
+			}
+		})
+	}
+}
+
+func TestHandleIncomingWebhook_BasetenSecret(t *testing.T) {
+	withProviders(t, `[{"name": "baseten", "request_id": {"from": "json", "key": "request_id"},
+		"signature": {"header": "X-BASETEN-SIGNATURE", "prefix": "v1=", "secret": "s"}}]`)
+	resetTestState()
+
+	body := []byte(`{"request_id": "asd"}`)
+	mac := hmac.New(sha256.New, []byte("s"))
+	mac.Write(body)
+	for signature, expectedCode := range map[string]int{
+		"v1=invalid": http.StatusUnauthorized,
+		"v1=old,v1=" + hex.EncodeToString(mac.Sum(nil)):                 http.StatusOK,
+		"v1=" + hex.EncodeToString(mac.Sum(nil)) + ",v1=" + "rotated00": http.StatusOK,
+	} {
+		req, _ := http.NewRequest("POST", "/webhook", bytes.NewReader(body))
+		req.Header.Set("X-BASETEN-SIGNATURE", signature)
+		rr := httptest.NewRecorder()
+		handleIncomingWebhook(rr, req)
+		if rr.Code != expectedCode {
+			t.Errorf("expected status %d for signature %s, got %d", expectedCode, signature, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// replayWindow is how long (seconds) delivered webhooks are remembered for detecting duplicates and re-deliveries
+var replayWindow = 3600
+
+var (
+	errDuplicateWebhook  = errors.New("duplicate webhook delivery")
+	errConsumedWebhook   = errors.New("webhook re-delivered after the result was consumed by the client")
+	errCancelledWebhook  = errors.New("webhook delivered after the request was cancelled")
+	errCancellingWebhook = errors.New("webhook delivered while the request is being cancelled")
+	errCompletedDelivery = errors.New("final result of the request already received")
+)
+
+// deliveryLog holds hashes of the webhook bodies received for the request, the final result webhooks being stored
+// and whether the final result was already stored, consumed by a client or the request cancelled
+type deliveryLog struct {
+	hashes     map[[sha256.Size]byte]struct{}
+	pending    int
+	completed  bool
+	consumed   bool
+	cancelling bool
+	cancelled  bool
+	updatedAt  int64
+}
+
+var (
+	deliveriesMu sync.Mutex
+	deliveries   = map[string]*deliveryLog{} // map[requestId string]*deliveryLog
+)
+
+// deliveryLogOf returns the delivery log of the request, creating it when missing. Must be called with deliveriesMu
+// held.
+func deliveryLogOf(requestId string) *deliveryLog {
+	d, ok := deliveries[requestId]
+	if !ok {
+		d = &deliveryLog{hashes: map[[sha256.Size]byte]struct{}{}}
+		deliveries[requestId] = d
+	}
+	return d
+}
+
+// claimDelivery registers the webhook body for the request. Fails with errDuplicateWebhook if the same body was
+// already received, with errConsumedWebhook if the request result was consumed by a client, with errCancelledWebhook
+// if the request was cancelled, or with errCancellingWebhook while the cancellation is in progress. The returned
+// function completes the claim once the webhook was stored, or releases it when it could not be, so the retried
+// delivery is accepted. Cancellation is refused while the final result is claimed.
+func claimDelivery(requestId string, body []byte, final bool) (func(stored bool), error) {
+	hash := sha256.Sum256(body)
+
+	deliveriesMu.Lock()
+	defer deliveriesMu.Unlock()
+	d := deliveryLogOf(requestId)
+	if _, ok := d.hashes[hash]; ok {
+		return nil, errDuplicateWebhook
+	}
+	if d.consumed {
+		return nil, errConsumedWebhook
+	}
+	if d.cancelled {
+		return nil, errCancelledWebhook
+	}
+	if d.cancelling {
+		return nil, errCancellingWebhook
+	}
+	d.hashes[hash] = struct{}{}
+	if final {
+		d.pending++
+	}
+	d.updatedAt = time.Now().Unix()
+
+	return func(stored bool) {
+		deliveriesMu.Lock()
+		defer deliveriesMu.Unlock()
+		if final {
+			d.pending--
+			d.completed = d.completed || stored
+		}
+		if !stored {
+			delete(d.hashes, hash)
+		}
+		d.updatedAt = time.Now().Unix()
+	}, nil
+}
+
+// markConsumed records that the final result of the request was delivered to a client
+func markConsumed(requestId string) {
+	deliveriesMu.Lock()
+	defer deliveriesMu.Unlock()
+	d := deliveryLogOf(requestId)
+	d.consumed = true
+	d.updatedAt = time.Now().Unix()
+}
+
+// cancelDelivery starts the cancellation of the request. Fails with errCancelledWebhook if it was already cancelled,
+// with errConsumedWebhook if the result was consumed by a client, or with errCompletedDelivery if the final result
+// was stored or is being stored. The webhooks received until the returned function is called are refused to be
+// retried by the provider, the ones received after the cancellation completed are discarded.
+func cancelDelivery(requestId string) (func(cancelled bool), error) {
+	deliveriesMu.Lock()
+	defer deliveriesMu.Unlock()
+	d := deliveryLogOf(requestId)
+	if d.consumed {
+		return nil, errConsumedWebhook
+	}
+	if d.cancelled || d.cancelling {
+		return nil, errCancelledWebhook
+	}
+	if d.completed || d.pending > 0 {
+		return nil, errCompletedDelivery
+	}
+	d.cancelling = true
+	d.updatedAt = time.Now().Unix()
+
+	return func(cancelled bool) {
+		deliveriesMu.Lock()
+		defer deliveriesMu.Unlock()
+		d.cancelling, d.cancelled = false, cancelled
+		d.updatedAt = time.Now().Unix()
+	}, nil
+}
+
+// cleanupDeliveries forgets deliveries older than the replay window
+func cleanupDeliveries() {
+	deliveriesMu.Lock()
+	defer deliveriesMu.Unlock()
+	n := 0
+	deadline := time.Now().Unix() - int64(replayWindow)
+	for requestId, d := range deliveries {
+		if d.updatedAt < deadline {
+			delete(deliveries, requestId)
+			n++
+		}
+	}
+	if n > 0 {
+		log.Printf("%d deliveries past replay window, forgetting", n)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func postTestWebhook(body string) int {
+	req, _ := http.NewRequest("POST", "/webhook", bytes.NewBufferString(body))
+	req.Header.Set("X-BASETEN-SIGNATURE", "xxx")
+	rr := httptest.NewRecorder()
+	handleIncomingWebhook(rr, req)
+	return rr.Code
+}
+
+func TestHandleIncomingWebhook_Duplicate(t *testing.T) {
+	withStatusField(t, "status")
+	resetTestState()
+
+	for _, body := range []string{
+		`{"request_id": "asd", "status": "in_progress"}`,
+		`{"request_id": "asd", "status": "in_progress"}`,
+		`{"request_id": "asd", "status": "completed"}`,
+		`{"request_id": "asd", "status": "completed"}`,
+	} {
+		if code := postTestWebhook(body); code != http.StatusOK {
+			t.Errorf("expected duplicate to be acknowledged with %d, got %d", http.StatusOK, code)
+		}
+	}
+
+	records, _ := store.Get(context.Background(), "asd")
+	if len(records) != 2 {
+		t.Errorf("expected duplicates not to be stored, got %d records", len(records))
+	}
+}
+
+func TestHandleIncomingWebhook_AfterConsumed(t *testing.T) {
+	resetTestState()
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+
+	postTestWebhook(`{"request_id": "asd"}`)
+	req, _ := http.NewRequest("GET", "/listen/asd", nil)
+	req.SetPathValue("request_id", "asd")
+	req.Header.Add("Authorization", "Bearer a")
+	handleClientStream(context.Background())(httptest.NewRecorder(), req)
+
+	// Exact copy of the consumed webhook is still a duplicate, other payloads are refused
+	if code := postTestWebhook(`{"request_id": "asd"}`); code != http.StatusOK {
+		t.Errorf("expected duplicate to be acknowledged with %d, got %d", http.StatusOK, code)
+	}
+	if code := postTestWebhook(`{"request_id": "asd", "replayed": true}`); code != http.StatusConflict {
+		t.Errorf("expected re-delivery after consumption to be refused with %d, got %d", http.StatusConflict, code)
+	}
+	if _, err := store.Get(context.Background(), "asd"); err == nil {
+		t.Errorf("expected re-delivered webhook not to be stored")
+	}
+}
+
+func TestHandleIncomingWebhook_RetryAfterStoreFailure(t *testing.T) {
+	resetTestState()
+	store = failingStore{}
+	if code := postTestWebhook(`{"request_id": "asd"}`); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	store = NewInMemStore()
+	if code := postTestWebhook(`{"request_id": "asd"}`); code != http.StatusOK {
+		t.Fatalf("expected retried delivery to be accepted, got %d", code)
+	}
+	if _, err := store.Get(context.Background(), "asd"); err != nil {
+		t.Errorf("expected retried delivery to be stored, got %v", err)
+	}
+}
+
+func TestCleanupDeliveries(t *testing.T) {
+	resetTestState()
+	replayWindow = 60
+	_, _ = claimDelivery("old", []byte("a"), false)
+	_, _ = claimDelivery("recent", []byte("a"), false)
+	deliveries["old"].updatedAt = time.Now().Unix() - 120
+
+	cleanupDeliveries()
+	if _, ok := deliveries["old"]; ok {
+		t.Errorf("expected delivery past replay window to be forgotten")
+	}
+	if _, err := claimDelivery("recent", []byte("a"), false); err != errDuplicateWebhook {
+		t.Errorf("expected recent delivery to be remembered, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// keepAliveInterval is the default interval between keep-alive events sent to the listeners
+	keepAliveInterval = 5
+	// Bounds of the keep-alive interval negotiated by the client with the `keep_alive` query parameter (seconds)
+	minKeepAliveInterval = 1
+	maxKeepAliveInterval = 60
+
+	// listenerTimers schedules keep-alive and timeout events of all client streams
+	listenerTimers = newTimingWheel(100*time.Millisecond, 512)
+)
+
+// wheelTimer is a single timer scheduled on the timingWheel. Expirations are delivered on C, if the previous
+// expiration wasn't received yet the new one is dropped (same as time.Ticker).
+type wheelTimer struct {
+	C chan struct{}
+
+	at       int64 // absolute tick of the next expiration
+	interval int64 // ticks between expirations of periodic timer, 0 for one-shot timer
+}
+
+// timingWheel is a hashed timing wheel driving all timers from a single goroutine, replacing a ticker
+// and a timer per listener. Timers are bucketed into slots by their expiration tick and every tick all
+// due timers of the slot are fired at once. Expirations are accurate to the wheel resolution.
+type timingWheel struct {
+	resolution time.Duration
+	slots      []map[*wheelTimer]struct{}
+
+	mu      sync.Mutex
+	now     int64 // ticks since the wheel start
+	started time.Time
+	once    sync.Once
+}
+
+func newTimingWheel(resolution time.Duration, slots int) *timingWheel {
+	w := &timingWheel{
+		resolution: resolution,
+		slots:      make([]map[*wheelTimer]struct{}, slots),
+	}
+	for i := range w.slots {
+		w.slots[i] = map[*wheelTimer]struct{}{}
+	}
+	return w
+}
+
+// schedule creates a timer expiring after d, and then every d again if periodic. Non-positive d expires immediately
+// (and is never repeated).
+func (w *timingWheel) schedule(d time.Duration, periodic bool) *wheelTimer {
+	w.once.Do(func() {
+		w.started = time.Now()
+		go w.run()
+	})
+
+	t := &wheelTimer{C: make(chan struct{}, 1)}
+	if d <= 0 {
+		t.C <- struct{}{}
+		return t
+	}
+
+	ticks := int64((d + w.resolution - 1) / w.resolution)
+	if periodic {
+		t.interval = ticks
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t.at = w.now + ticks
+	w.slots[t.at%int64(len(w.slots))][t] = struct{}{}
+	return t
+}
+
+// stop removes the timer from the wheel, it won't expire anymore
+func (w *timingWheel) stop(t *wheelTimer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.slots[t.at%int64(len(w.slots))], t)
+}
+
+func (w *timingWheel) run() {
+	ticker := time.NewTicker(w.resolution)
+	defer ticker.Stop()
+	for range ticker.C {
+		// Catch up with the wall clock, ticks get dropped when the goroutine is delayed
+		w.advanceTo(int64(time.Since(w.started) / w.resolution))
+	}
+}
+
+// advanceTo moves the wheel to the target tick firing all timers due on the way
+func (w *timingWheel) advanceTo(target int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.now < target {
+		w.now++
+		slot := w.slots[w.now%int64(len(w.slots))]
+		for t := range slot {
+			if t.at > w.now {
+				continue // expires in one of the next rounds
+			}
+			delete(slot, t)
+			select {
+			case t.C <- struct{}{}:
+			default:
+			}
+			if t.interval > 0 {
+				t.at = w.now + t.interval
+				w.slots[t.at%int64(len(w.slots))][t] = struct{}{}
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimingWheel_OneShot(t *testing.T) {
+	w := newTimingWheel(10*time.Millisecond, 8)
+	start := time.Now()
+	timer := w.schedule(150*time.Millisecond, false)
+
+	select {
+	case <-timer.C:
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+			t.Errorf("timer expired too early, after %s", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timer didn't expire")
+	}
+
+	select {
+	case <-timer.C:
+		t.Error("one-shot timer expired twice")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestTimingWheel_Periodic(t *testing.T) {
+	w := newTimingWheel(10*time.Millisecond, 8)
+	timer := w.schedule(30*time.Millisecond, true)
+	defer w.stop(timer)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-timer.C:
+		case <-time.After(time.Second):
+			t.Fatalf("periodic timer didn't expire %d. time", i+1)
+		}
+	}
+}
+
+func TestTimingWheel_Immediate(t *testing.T) {
+	w := newTimingWheel(10*time.Millisecond, 8)
+	select {
+	case <-w.schedule(0, false).C:
+	default:
+		t.Error("expected timer with zero duration to expire immediately")
+	}
+}
+
+func TestTimingWheel_Stop(t *testing.T) {
+	w := newTimingWheel(10*time.Millisecond, 8)
+	timer := w.schedule(50*time.Millisecond, true)
+	w.stop(timer)
+
+	select {
+	case <-timer.C:
+		t.Error("stopped timer expired")
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+func TestTimingWheel_ManyTimers(t *testing.T) {
+	w := newTimingWheel(time.Millisecond, 4)
+	timers := make([]*wheelTimer, 1000)
+	for i := range timers {
+		timers[i] = w.schedule(time.Duration(i%50)*time.Millisecond, false)
+	}
+
+	deadline := time.After(2 * time.Second)
+	for i, timer := range timers {
+		select {
+		case <-timer.C:
+		case <-deadline:
+			t.Fatalf("timer %d didn't expire", i)
+		}
+	}
+}
@@ -1,77 +1,178 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 )
 
+// ErrNotFound is returned (wrapped) by Store.Get when there is no record for the request
+var ErrNotFound = errors.New("record not found")
+
+// Record is a single webhook payload (event) received for the request
 type Record struct {
 	content   []byte
 	signature string
 	createdAt int64
+	// retention overrides the retention passed to GetOlderThan for this record, when non-zero
+	retention time.Duration
+	// progress marks partial/progress results, more records are expected for the request.
+	// The stream is ended after a record without this flag.
+	progress bool
+	// compressed marks content compressed by compressingStore
+	compressed bool
+	// keyId is the ID of the key the content was encrypted with by encryptingStore, empty when not encrypted
+	keyId string
+	// tokenBound marks content encrypted with the key derived from the stream token
+	tokenBound bool
+	// sealed marks content sealed to the client public key on receipt, see client.Seal
+	sealed bool
+	// cancelled marks the request cancellation, it has no content and ends the stream
+	cancelled bool
+	// predictionErrors of the failed prediction parsed from the Baseten webhook payload, codes only
+	predictionErrors []predictionError
 }
 
-// Store Stores webhook payloads until they can be transferred to client
+// Store Stores webhook payloads until they can be transferred to client. Every request has a log of records
+// appended in order of arrival.
+// Every method accepts a context and returns an error, so the implementations can be backed by network services.
+// Implementations must pass the conformance tests in store_conformance_test.go.
 type Store interface {
-	Put(requestId string, record Record)
-	Get(requestId string) (Record, error)
-	Await(requestId string) chan struct{}
-	Delete(requestId string)
-	GetOlderThan(time.Duration) []string
+	// Append adds the record to the request log and notifies subscribed listeners, never blocks on the listeners
+	Append(ctx context.Context, requestId string, record Record) error
+	// Get returns the request log, or an error wrapping ErrNotFound if there is none
+	Get(ctx context.Context, requestId string) ([]Record, error)
+	// Subscribe atomically returns the current request log (possibly empty) and registers a listener. The returned
+	// channel is notified when new records are appended, they can be retrieved with Get. Notifications are
+	// coalesced, one notification may stand for several records. The returned function unregisters the listener
+	// and must always be called when no error is returned.
+	Subscribe(ctx context.Context, requestId string) ([]Record, <-chan struct{}, func(), error)
+	// Delete removes the request log, deleting non-existent log is not an error
+	Delete(ctx context.Context, requestId string) error
+	// GetOlderThan returns IDs of requests whose last record is older than its own retention, or than duration
+	// if it has none
+	GetOlderThan(ctx context.Context, duration time.Duration) ([]string, error)
 }
 
 type InMemStore struct {
-	store     sync.Map
-	listeners sync.Map
+	store sync.Map // map[requestId string][]Record
+
+	// mu serializes Append and Subscribe, so the record can't be appended between reading the log and
+	// the listener registration
+	mu        sync.Mutex
+	listeners map[string]map[chan struct{}]struct{}
 }
 
 func NewInMemStore() *InMemStore {
 	return &InMemStore{
 		store:     sync.Map{},
-		listeners: sync.Map{},
+		listeners: map[string]map[chan struct{}]struct{}{},
 	}
 }
 
-func (i *InMemStore) Put(requestId string, record Record) {
-	i.store.Store(requestId, Record{record.content, record.signature, time.Now().Unix()})
+func (i *InMemStore) Append(ctx context.Context, requestId string, record Record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	record.createdAt = time.Now().Unix()
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// Copy on write, logs returned earlier by Get or Subscribe stay untouched
+	var records []Record
+	if v, ok := i.store.Load(requestId); ok {
+		records = slices.Clip(v.([]Record))
+	}
+	i.store.Store(requestId, append(records, record))
 
-	// Notify any listening clients
-	if ch, ok := i.listeners.Load(requestId); ok {
-		chx, _ := ch.(chan struct{})
-		chx <- struct{}{}
+	// Notify any listening clients. Channels are buffered, if the listener didn't receive the previous
+	// notification yet, it's going to pick up this record with it.
+	for ch := range i.listeners[requestId] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
 	}
+	return nil
 }
 
-func (i *InMemStore) Get(requestId string) (Record, error) {
-	if record, ok := i.store.Load(requestId); ok {
-		return record.(Record), nil
+func (i *InMemStore) Get(ctx context.Context, requestId string) ([]Record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if records, ok := i.store.Load(requestId); ok {
+		return records.([]Record), nil
 	}
 
-	return Record{}, fmt.Errorf("no response for request %s", requestId)
+	return nil, fmt.Errorf("no response for request %s: %w", requestId, ErrNotFound)
 }
 
-func (i *InMemStore) Await(requestId string) chan struct{} {
-	ch := make(chan struct{})
-	i.listeners.Store(requestId, ch)
-	return ch
+func (i *InMemStore) Subscribe(ctx context.Context, requestId string) ([]Record, <-chan struct{}, func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var records []Record
+	if v, ok := i.store.Load(requestId); ok {
+		records = v.([]Record)
+	}
+
+	ch := make(chan struct{}, 1)
+	if i.listeners[requestId] == nil {
+		i.listeners[requestId] = map[chan struct{}]struct{}{}
+	}
+	i.listeners[requestId][ch] = struct{}{}
+
+	return records, ch, func() {
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		delete(i.listeners[requestId], ch)
+		if len(i.listeners[requestId]) == 0 {
+			delete(i.listeners, requestId)
+		}
+	}, nil
 }
 
-func (i *InMemStore) Delete(requestId string) {
-	i.listeners.Delete(requestId)
+func (i *InMemStore) Delete(ctx context.Context, requestId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Serialized with Append, so the records loaded by it are not stored back after the delete
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	i.store.Delete(requestId)
+	return nil
 }
 
-func (i *InMemStore) GetOlderThan(duration time.Duration) []string {
+func (i *InMemStore) GetOlderThan(ctx context.Context, duration time.Duration) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	var requestsIds []string
 
-	olderThanTimestamp := time.Now().Unix() - int64(duration.Seconds())
+	now := time.Now().Unix()
 	i.store.Range(func(key, value interface{}) bool {
-		if value.(Record).createdAt < olderThanTimestamp {
+		records := value.([]Record)
+		if len(records) == 0 {
+			return true
+		}
+		last := records[len(records)-1]
+		retention := duration
+		if last.retention > 0 {
+			retention = last.retention
+		}
+		if last.createdAt < now-int64(retention.Seconds()) {
 			requestsIds = append(requestsIds, key.(string))
 		}
 		return true
 	})
 
-	return requestsIds
+	return requestsIds, nil
 }
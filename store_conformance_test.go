@@ -0,0 +1,292 @@
+package main
+
+// Conformance tests every Store implementation must pass. Run them from the implementation tests with:
+//
+//	testStoreConformance(t, func() Store { return NewMyStore(...) })
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testStoreConformance(t *testing.T, newStore func() Store) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s Store)
+	}{
+		{"AppendAndGet", conformanceAppendAndGet},
+		{"GetNotFound", conformanceGetNotFound},
+		{"AppendKeepsOrder", conformanceAppendKeepsOrder},
+		{"Delete", conformanceDelete},
+		{"SubscribeExisting", conformanceSubscribeExisting},
+		{"SubscribeThenAppend", conformanceSubscribeThenAppend},
+		{"AppendNeverBlocks", conformanceAppendNeverBlocks},
+		{"ConcurrentAppendSubscribe", conformanceConcurrentAppendSubscribe},
+		{"ConcurrentAppendDelete", conformanceConcurrentAppendDelete},
+		{"GetOlderThan", conformanceGetOlderThan},
+		{"GetOlderThanRecordRetention", conformanceGetOlderThanRecordRetention},
+		{"CancelledContext", conformanceCancelledContext},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, newStore())
+		})
+	}
+}
+
+func conformanceAppendAndGet(t *testing.T, s Store) {
+	ctx := context.Background()
+	if err := s.Append(ctx, "request1", Record{content: []byte("response1"), signature: "signature1", progress: true}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	records, err := s.Get(ctx, "request1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+	got := records[0]
+	if !got.progress {
+		t.Errorf("expected progress flag to be kept")
+	}
+	if string(got.content) != "response1" || got.signature != "signature1" {
+		t.Errorf("expected response1 with signature1, got %s with %s", got.content, got.signature)
+	}
+	if got.createdAt == 0 {
+		t.Errorf("expected creation time to be set")
+	}
+}
+
+func conformanceGetNotFound(t *testing.T, s Store) {
+	if _, err := s.Get(context.Background(), "non_existent_request"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func conformanceAppendKeepsOrder(t *testing.T, s Store) {
+	ctx := context.Background()
+	_ = s.Append(ctx, "request1", Record{content: []byte("response1"), progress: true})
+	before, _ := s.Get(ctx, "request1")
+	_ = s.Append(ctx, "request1", Record{content: []byte("response2"), progress: true})
+	_ = s.Append(ctx, "request1", Record{content: []byte("response3")})
+
+	got, err := s.Get(ctx, "request1")
+	if err != nil || len(got) != 3 {
+		t.Fatalf("expected 3 records, got %d (err: %v)", len(got), err)
+	}
+	for n, record := range got {
+		if expected := "response" + strconv.Itoa(n+1); string(record.content) != expected {
+			t.Errorf("expected %s at position %d, got %s", expected, n, record.content)
+		}
+	}
+	if len(before) != 1 {
+		t.Errorf("expected previously returned log to stay unchanged, got %d records", len(before))
+	}
+}
+
+func conformanceDelete(t *testing.T, s Store) {
+	ctx := context.Background()
+	_ = s.Append(ctx, "request1", Record{content: []byte("response1")})
+	if err := s.Delete(ctx, "request1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := s.Get(ctx, "request1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+	if err := s.Delete(ctx, "request1"); err != nil {
+		t.Errorf("expected no error deleting non-existent record, got %v", err)
+	}
+}
+
+func conformanceSubscribeExisting(t *testing.T, s Store) {
+	ctx := context.Background()
+	_ = s.Append(ctx, "request1", Record{content: []byte("response1"), progress: true})
+	_ = s.Append(ctx, "request1", Record{content: []byte("response2")})
+
+	got, _, unsubscribe, err := s.Subscribe(ctx, "request1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer unsubscribe()
+	if len(got) != 2 || string(got[0].content) != "response1" || string(got[1].content) != "response2" {
+		t.Errorf("expected existing records response1 and response2, got %v", got)
+	}
+}
+
+func conformanceSubscribeThenAppend(t *testing.T, s Store) {
+	ctx := context.Background()
+	got, updates, unsubscribe, err := s.Subscribe(ctx, "request1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer unsubscribe()
+	if len(got) != 0 {
+		t.Fatal("expected no records before they are appended")
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = s.Append(ctx, "request1", Record{content: []byte("response1")})
+	}()
+
+	select {
+	case <-updates:
+		got, err = s.Get(ctx, "request1")
+		if err != nil || len(got) != 1 || string(got[0].content) != "response1" {
+			t.Errorf("expected response1, got %v (err: %v)", got, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription timed out")
+	}
+}
+
+func conformanceAppendNeverBlocks(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	// Listener which doesn't receive and one which already left
+	_, _, unsubscribe, _ := s.Subscribe(ctx, "request1")
+	defer unsubscribe()
+	_, _, leave, _ := s.Subscribe(ctx, "request1")
+	leave()
+
+	done := make(chan struct{})
+	go func() {
+		_ = s.Append(ctx, "request1", Record{content: []byte("response1"), progress: true})
+		_ = s.Append(ctx, "request1", Record{content: []byte("response2")})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("append blocked on listeners")
+	}
+}
+
+// conformanceConcurrentAppendSubscribe races Append with Subscribe for many requests, every subscriber must get
+// the record either immediately or after the notification. Run with -race.
+func conformanceConcurrentAppendSubscribe(t *testing.T, s Store) {
+	ctx := context.Background()
+	var wg sync.WaitGroup
+
+	for n := 0; n < 1000; n++ {
+		requestId := strconv.Itoa(n)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = s.Append(ctx, requestId, Record{content: []byte(requestId)})
+		}()
+		go func() {
+			defer wg.Done()
+			got, updates, unsubscribe, err := s.Subscribe(ctx, requestId)
+			if err != nil {
+				t.Errorf("expected no error, got %v", err)
+				return
+			}
+			defer unsubscribe()
+			if len(got) == 0 {
+				select {
+				case <-updates:
+					got, _ = s.Get(ctx, requestId)
+				case <-time.After(time.Second):
+					t.Errorf("lost notification for request %s", requestId)
+					return
+				}
+			}
+			if len(got) != 1 || string(got[0].content) != requestId {
+				t.Errorf("expected record %s, got %v", requestId, got)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// conformanceConcurrentAppendDelete races Append with Delete for many requests, the deleted record must never come
+// back with the appended one
+func conformanceConcurrentAppendDelete(t *testing.T, s Store) {
+	ctx := context.Background()
+	var wg sync.WaitGroup
+
+	for n := 0; n < 1000; n++ {
+		requestId := strconv.Itoa(n)
+		_ = s.Append(ctx, requestId, Record{content: []byte("deleted")})
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = s.Delete(ctx, requestId)
+		}()
+		go func() {
+			defer wg.Done()
+			_ = s.Append(ctx, requestId, Record{content: []byte("appended")})
+		}()
+	}
+	wg.Wait()
+
+	for n := 0; n < 1000; n++ {
+		records, err := s.Get(ctx, strconv.Itoa(n))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil || len(records) != 1 || string(records[0].content) != "appended" {
+			t.Errorf("expected no records or only the appended one for request %d, got %v (err: %v)", n, records, err)
+		}
+	}
+}
+
+func conformanceGetOlderThan(t *testing.T, s Store) {
+	ctx := context.Background()
+	_ = s.Append(ctx, "request1", Record{content: []byte("response1")})
+	time.Sleep(1100 * time.Millisecond)
+	_ = s.Append(ctx, "request2", Record{content: []byte("response2")})
+
+	ids, err := s.GetOlderThan(ctx, 0)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(ids) != 1 || ids[0] != "request1" {
+		t.Errorf("expected only request1 to be older, got %v", ids)
+	}
+}
+
+func conformanceGetOlderThanRecordRetention(t *testing.T, s Store) {
+	ctx := context.Background()
+	_ = s.Append(ctx, "request1", Record{content: []byte("response1"), retention: time.Hour})
+	_ = s.Append(ctx, "request2", Record{content: []byte("response2")})
+	time.Sleep(1100 * time.Millisecond)
+
+	ids, err := s.GetOlderThan(ctx, 0)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(ids) != 1 || ids[0] != "request2" {
+		t.Errorf("expected only request2 to be past retention, got %v", ids)
+	}
+}
+
+func conformanceCancelledContext(t *testing.T, s Store) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := s.Append(ctx, "request1", Record{}); err == nil {
+		t.Error("expected Append to fail with cancelled context")
+	}
+	if _, err := s.Get(ctx, "request1"); err == nil {
+		t.Error("expected Get to fail with cancelled context")
+	}
+	if _, _, _, err := s.Subscribe(ctx, "request1"); err == nil {
+		t.Error("expected Subscribe to fail with cancelled context")
+	}
+	if err := s.Delete(ctx, "request1"); err == nil {
+		t.Error("expected Delete to fail with cancelled context")
+	}
+	if _, err := s.GetOlderThan(ctx, time.Second); err == nil {
+		t.Error("expected GetOlderThan to fail with cancelled context")
+	}
+}
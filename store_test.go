@@ -3,56 +3,50 @@ package main
 // Test InMem store
 
 import (
+	"context"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func TestInMemStorePutAndGet(t *testing.T) {
+func TestInMemStoreAppendAndGet(t *testing.T) {
 	store := NewInMemStore()
 	requestId := "request1"
 	response := []byte("response1")
 
-	store.Put(requestId, Record{content: response})
+	store.Append(context.Background(), requestId, Record{content: response})
 
-	got, err := store.Get(requestId)
+	got, err := store.Get(context.Background(), requestId)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
-	if string(got.content) != string(response) {
-		t.Fatalf("expected %s, got %s", response, got.content)
+	if len(got) != 1 || string(got[0].content) != string(response) {
+		t.Fatalf("expected %s, got %v", response, got)
 	}
 }
 
 func TestInMemStoreGetNonExistent(t *testing.T) {
 	store := NewInMemStore()
-	_, err := store.Get("non_existent_request")
+	_, err := store.Get(context.Background(), "non_existent_request")
 	if err == nil {
 		t.Fatal("expected error for non-existent request")
 	}
 }
 
-func TestInMemStoreAwait(t *testing.T) {
+func TestInMemStoreUnsubscribe(t *testing.T) {
 	store := NewInMemStore()
-	awaitChannel := store.Await("request2")
+	_, _, unsubscribe1, _ := store.Subscribe(context.Background(), "request1")
+	_, _, unsubscribe2, _ := store.Subscribe(context.Background(), "request1")
 
-	go func() {
-		time.Sleep(time.Millisecond * 500) // Simulating delay
-		store.Put("request2", Record{content: []byte("response2")})
-	}()
-
-	select {
-	case <-awaitChannel: // Successfully received signal
-		// No action needed
-	case <-time.After(time.Second):
-		t.Fatal("await timed out")
-	}
-
-	got, err := store.Get("request2")
-	if err != nil {
-		t.Fatalf("expected no error, got %v", err)
+	unsubscribe1()
+	if len(store.listeners["request1"]) != 1 {
+		t.Fatalf("expected 1 listener left, got %d", len(store.listeners["request1"]))
 	}
-	if string(got.content) != "response2" {
-		t.Fatalf("expected 'response2', got %s", got.content)
+	unsubscribe2()
+	unsubscribe2() // Idempotent
+	if len(store.listeners) != 0 {
+		t.Fatalf("expected no listeners left, got %d", len(store.listeners))
 	}
 }
 
@@ -61,14 +55,14 @@ func TestInMemStoreDelete(t *testing.T) {
 	requestId := "request1"
 	response := []byte("response1")
 
-	store.Put(requestId, Record{content: response})
-	_, err := store.Get("request1")
+	store.Append(context.Background(), requestId, Record{content: response})
+	_, err := store.Get(context.Background(), "request1")
 	if err != nil {
 		t.Fatal("put request failed before deleting")
 	}
-	store.Delete(requestId)
+	store.Delete(context.Background(), requestId)
 
-	_, err = store.Get(requestId)
+	_, err = store.Get(context.Background(), requestId)
 	if err == nil {
 		t.Fatal("expected error when getting after delete")
 	}
@@ -77,12 +71,12 @@ func TestInMemStoreDelete(t *testing.T) {
 func TestInMemStoreGetOlderThan(t *testing.T) {
 	store := NewInMemStore()
 
-	store.store.Store("request1", Record{[]byte("response1"), "", time.Now().Unix() - 15})
-	store.store.Store("request2", Record{[]byte("response2"), "", time.Now().Unix() - 10})
-	store.store.Store("request3", Record{[]byte("response3"), "", time.Now().Unix() - 5})
-	store.store.Store("request4", Record{[]byte("response4"), "", time.Now().Unix()})
+	store.store.Store("request1", []Record{{content: []byte("response1"), signature: "", createdAt: time.Now().Unix() - 15}})
+	store.store.Store("request2", []Record{{content: []byte("response2"), signature: "", createdAt: time.Now().Unix() - 10}})
+	store.store.Store("request3", []Record{{content: []byte("response3"), signature: "", createdAt: time.Now().Unix() - 5}})
+	store.store.Store("request4", []Record{{content: []byte("response4"), signature: "", createdAt: time.Now().Unix()}})
 
-	keys := store.GetOlderThan(time.Second * 5)
+	keys, _ := store.GetOlderThan(context.Background(), time.Second*5)
 	if len(keys) != 2 {
 		t.Fatalf("expected 2 requests ids to be returned")
 	}
@@ -90,3 +84,81 @@ func TestInMemStoreGetOlderThan(t *testing.T) {
 		t.Fatalf("returned requestIds expected to be request1 and request2, got %s and %s", keys[0], keys[1])
 	}
 }
+
+func TestInMemStoreGetOlderThan_RecordRetention(t *testing.T) {
+	store := NewInMemStore()
+
+	store.store.Store("request1", []Record{{content: []byte("response1"), createdAt: time.Now().Unix() - 15, retention: time.Minute}})
+	store.store.Store("request2", []Record{{content: []byte("response2"), createdAt: time.Now().Unix() - 15, retention: 10 * time.Second}})
+	store.store.Store("request3", []Record{{content: []byte("response3"), createdAt: time.Now().Unix() - 15}})
+
+	keys, _ := store.GetOlderThan(context.Background(), 20*time.Second)
+	if len(keys) != 1 || keys[0] != "request2" {
+		t.Fatalf("expected only request2 past its own retention, got %v", keys)
+	}
+}
+
+func TestInMemStoreGetOlderThan_LastRecord(t *testing.T) {
+	store := NewInMemStore()
+
+	store.store.Store("request1", []Record{{content: []byte("progress"), createdAt: time.Now().Unix() - 15, progress: true}, {content: []byte("response1"), createdAt: time.Now().Unix()}})
+	store.store.Store("request2", []Record{{content: []byte("progress"), createdAt: time.Now().Unix() - 15, progress: true}})
+
+	keys, _ := store.GetOlderThan(context.Background(), 10*time.Second)
+	if len(keys) != 1 || keys[0] != "request2" {
+		t.Fatalf("expected only request2 with no recent records, got %v", keys)
+	}
+}
+
+func TestInMemStoreConformance(t *testing.T) {
+	testStoreConformance(t, func() Store { return NewInMemStore() })
+}
+
+func BenchmarkInMemStoreAppend(b *testing.B) {
+	store := NewInMemStore()
+	record := Record{content: []byte(`{"request_id": "request1"}`), signature: "signature"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.Append(context.Background(), strconv.Itoa(i), record)
+	}
+}
+
+func BenchmarkInMemStoreGet(b *testing.B) {
+	store := NewInMemStore()
+	for i := 0; i < 10000; i++ {
+		store.Append(context.Background(), strconv.Itoa(i), Record{content: []byte("response")})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = store.Get(context.Background(), strconv.Itoa(i%10000))
+	}
+}
+
+func BenchmarkInMemStoreParallel(b *testing.B) {
+	store := NewInMemStore()
+	record := Record{content: []byte(`{"request_id": "request1"}`), signature: "signature"}
+	var n atomic.Int64
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			requestId := strconv.FormatInt(n.Add(1), 10)
+			store.Append(context.Background(), requestId, record)
+			_, _ = store.Get(context.Background(), requestId)
+			store.Delete(context.Background(), requestId)
+		}
+	})
+}
+
+func BenchmarkInMemStoreGetOlderThan(b *testing.B) {
+	store := NewInMemStore()
+	for i := 0; i < 10000; i++ {
+		store.Append(context.Background(), strconv.Itoa(i), Record{content: []byte("response")})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.GetOlderThan(context.Background(), time.Minute)
+	}
+}
@@ -1,29 +1,176 @@
 package main
 
 import (
+	"crypto"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"sync"
 	"time"
+
+	"github.com/flowaicom/webhook-proxy/client"
 )
 
-var streamTokenExpiration = 15 * time.Minute
+// tokenTTL is the default stream token lifetime in seconds
+var tokenTTL = 900
 
-// streamToken holds the token required for connecting to /listen endpoint and it's expiration
+// streamToken holds the token required for connecting to /listen endpoint, it's expiration and the per-request
+// overrides of server settings (zero when not overridden)
 type streamToken struct {
 	token     string
 	expiresAt int64
+	timeout   time.Duration
+	retention time.Duration
+	transform payloadTransform
+	// publicKey of the client, payloads are sealed to it when set
+	publicKey crypto.PublicKey
+}
+
+// streamTimeout returns the maximum waiting time of the client stream
+func (t streamToken) streamTimeout() time.Duration {
+	if t.timeout > 0 {
+		return t.timeout
+	}
+	return time.Duration(requestTimeout) * time.Second
+}
+
+// recordRetention returns how long the webhook payload is kept waiting for the client
+func (t streamToken) recordRetention() time.Duration {
+	if t.retention > 0 {
+		return t.retention
+	}
+	return defaultRetention()
 }
 
 var streamsTokens sync.Map // map[requestId string]streamToken -
 
+// claimMu serializes claiming the request IDs by tokens and batches, so claims of several request IDs are atomic
+var claimMu sync.Mutex
+
+// tokenOverrides are the optional per-request overrides of server settings (seconds) accepted when creating tokens
+type tokenOverrides struct {
+	Timeout   int `json:"timeout"`
+	Retention int `json:"retention"`
+	TokenTTL  int `json:"token_ttl"`
+
+	// Payload fields (dotted paths) selected or removed before delivery to the client
+	Projection []string `json:"projection"`
+	Redact     []string `json:"redact"`
+
+	// PEM encoded client public key for end-to-end payload encryption
+	PublicKey string `json:"public_key"`
+}
+
+var (
+	errNegativeOverride = errors.New("negative duration requested")
+	errInvalidPublicKey = errors.New("invalid public key")
+	errTokenExists      = errors.New("token already exists")
+)
+
+// Response bodies of requests with errNegativeOverride, errInvalidTransform and errInvalidPublicKey
+const (
+	negativeOverrideMessage = "Bad request. Fields `timeout`, `retention` and `token_ttl` must be positive numbers of seconds."
+	invalidTransformMessage = "Bad request. Fields `projection` and `redact` must be arrays of dotted field paths."
+	invalidPublicKeyMessage = "Bad request. Field `public_key` must be PEM encoded X25519 or RSA (2048 bits at least) public key and can't be combined with `projection` or `redact`."
+)
+
+// publicKey parses the client public key, nil when not requested. Sealed payloads can't be transformed.
+func (o tokenOverrides) publicKey() (crypto.PublicKey, error) {
+	if o.PublicKey == "" {
+		return nil, nil
+	}
+	if len(o.Projection) > 0 || len(o.Redact) > 0 {
+		return nil, errInvalidPublicKey
+	}
+	key, err := client.ParsePublicKey([]byte(o.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidPublicKey, err)
+	}
+	return key, nil
+}
+
+// newStreamToken generates a stream token with the overrides bounded by the server maximums
+func newStreamToken(o tokenOverrides) (streamToken, error) {
+	if o.Timeout < 0 || o.Retention < 0 || o.TokenTTL < 0 {
+		return streamToken{}, errNegativeOverride
+	}
+	transform, err := newPayloadTransform(o.Projection, o.Redact)
+	if err != nil {
+		return streamToken{}, err
+	}
+	publicKey, err := o.publicKey()
+	if err != nil {
+		return streamToken{}, err
+	}
+
+	token, err := generateSecureToken(16)
+	if err != nil {
+		return streamToken{}, err
+	}
+
+	st := streamToken{
+		token:     token,
+		timeout:   time.Duration(min(o.Timeout, maxRequestTimeout)) * time.Second,
+		retention: time.Duration(min(o.Retention, maxRecordRetention)) * time.Second,
+		transform: transform,
+		publicKey: publicKey,
+	}
+	ttl := tokenTTL
+	if o.TokenTTL > 0 {
+		ttl = min(o.TokenTTL, maxTokenTTL)
+	}
+	st.expiresAt = time.Now().Add(time.Duration(ttl) * time.Second).Unix()
+	return st, nil
+}
+
+// createStreamToken generates and stores the stream token of the request, fails with errTokenExists when the
+// request already has one or belongs to a batch
+func createStreamToken(requestId string, o tokenOverrides) (streamToken, error) {
+	st, err := newStreamToken(o)
+	if err != nil {
+		return st, err
+	}
+	return st, storeStreamToken(requestId, st)
+}
+
+// storeStreamToken stores the generated stream token of the request, fails with errTokenExists when the request
+// already has one or belongs to a batch
+func storeStreamToken(requestId string, st streamToken) error {
+	claimMu.Lock()
+	defer claimMu.Unlock()
+	if _, exists := streamsTokens.Load(requestId); exists || inBatch(requestId) {
+		return errTokenExists
+	}
+	streamsTokens.Store(requestId, st)
+	promActiveTokens.Inc()
+	registerRequest(requestId, st.token)
+	return nil
+}
+
+// response returns the token and the effective settings as sent to the client
+func (t streamToken) response() map[string]any {
+	return map[string]any{
+		"token":      t.token,
+		"expires_at": strconv.FormatInt(t.expiresAt, 10),
+		"timeout":    int(t.streamTimeout().Seconds()),
+		"retention":  int(t.recordRetention().Seconds()),
+	}
+}
+
 // handleCreateToken handles `POST /token` route. Accepts `request_id` field in JSON body, generates and stores token
-// for accessing the stream for that request_id.
+// for accessing the stream for that request_id. Optional `timeout`, `retention` and `token_ttl` fields (seconds)
+// override the server defaults for this request, bounded by the server maximums.
 func handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	if predictOnly {
+		http.Error(w, predictOnlyMessage, http.StatusForbidden)
+		return
+	}
 	var req struct {
 		RequestId string `json:"request_id"`
+		tokenOverrides
 	}
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil || req.RequestId == "" {
@@ -32,27 +179,199 @@ func handleCreateToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := generateSecureToken(16)
+	st, err := createStreamToken(req.RequestId, req.tokenOverrides)
+	if errors.Is(err, errTokenExists) {
+		log.Printf("token already exists (request_id: %s)", req.RequestId)
+		http.Error(w, "token already exists", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errNegativeOverride) {
+		log.Printf("negative duration requested (request_id: %s)", req.RequestId)
+		http.Error(w, negativeOverrideMessage, http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errInvalidTransform) {
+		log.Printf("invalid payload transformation requested (request_id: %s)", req.RequestId)
+		http.Error(w, invalidTransformMessage, http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errInvalidPublicKey) {
+		log.Printf("%v (request_id: %s)", err, req.RequestId)
+		http.Error(w, invalidPublicKeyMessage, http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		log.Printf("error generating token (request_id: %s): %v", req.RequestId, err)
 		http.Error(w, "cannot generate token", http.StatusInternalServerError)
 		return
 	}
 
-	if _, ok := streamsTokens.Load(req.RequestId); ok {
-		log.Printf("token already exists (request_id: %s)", req.RequestId)
-		http.Error(w, "token already exists", http.StatusConflict)
-		return
-	}
-
-	expiresAt := time.Now().Add(streamTokenExpiration).Unix()
-	streamsTokens.Store(req.RequestId, streamToken{token, expiresAt})
-	promActiveTokens.Inc()
+	auditRequest(r, auditEntry{Event: auditTokenCreated, RequestId: req.RequestId})
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(map[string]string{"token": token, "expires_at": strconv.FormatInt(expiresAt, 10)})
+	err = json.NewEncoder(w).Encode(st.response())
 	if err != nil {
 		log.Printf("error responding with token (request_id: %s): %v", err, req.RequestId)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 }
+
+// tokenResult is the outcome of a single request ID in `POST /tokens`, either the token or the error
+type tokenResult struct {
+	RequestId string `json:"request_id"`
+	Token     string `json:"token,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Timeout   int    `json:"timeout,omitempty"`
+	Retention int    `json:"retention,omitempty"`
+	Status    int    `json:"status,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleCreateTokens handles `POST /tokens` route. Accepts `request_ids` array in JSON body and generates a stream
+// token for every request ID, same as `POST /token`. Request IDs which fail (conflict, invalid) are reported
+// per ID. With `atomic` set, either all tokens are issued or none.
+func handleCreateTokens(w http.ResponseWriter, r *http.Request) {
+	if predictOnly {
+		http.Error(w, predictOnlyMessage, http.StatusForbidden)
+		return
+	}
+	var req struct {
+		RequestIds []string `json:"request_ids"`
+		Atomic     bool     `json:"atomic"`
+		tokenOverrides
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.RequestIds) == 0 {
+		log.Printf("error decoding create stream tokens request or request ids are empty: %v", err)
+		http.Error(w, "Bad request. Field `request_ids` (array of strings) is required.", http.StatusBadRequest)
+		return
+	}
+	if len(req.RequestIds) > maxBatchSize {
+		log.Printf("%d tokens requested, exceeds the limit", len(req.RequestIds))
+		http.Error(w, fmt.Sprintf("Bad request. At most %d `request_ids` are allowed.", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+	if req.Timeout < 0 || req.Retention < 0 || req.TokenTTL < 0 {
+		log.Printf("negative duration requested for %d tokens", len(req.RequestIds))
+		http.Error(w, negativeOverrideMessage, http.StatusBadRequest)
+		return
+	}
+	if _, err = newPayloadTransform(req.Projection, req.Redact); err != nil {
+		log.Printf("invalid payload transformation requested for %d tokens", len(req.RequestIds))
+		http.Error(w, invalidTransformMessage, http.StatusBadRequest)
+		return
+	}
+	if _, err = req.publicKey(); err != nil {
+		log.Printf("%v, requested for %d tokens", err, len(req.RequestIds))
+		http.Error(w, invalidPublicKeyMessage, http.StatusBadRequest)
+		return
+	}
+
+	// All request IDs are checked before any token is stored in atomic mode, the claims are held meanwhile
+	results := make([]tokenResult, len(req.RequestIds))
+	tokens := make([]streamToken, len(req.RequestIds))
+	var issued []string
+	seen := map[string]bool{}
+	failed := 0
+	claimMu.Lock()
+	for n, requestId := range req.RequestIds {
+		results[n], tokens[n] = issueToken(requestId, req.tokenOverrides, seen)
+		if results[n].Error != "" {
+			failed++
+			continue
+		}
+		issued = append(issued, requestId)
+		if !req.Atomic {
+			streamsTokens.Store(requestId, tokens[n])
+		}
+	}
+	if req.Atomic && failed == 0 {
+		for n, requestId := range req.RequestIds {
+			streamsTokens.Store(requestId, tokens[n])
+		}
+	}
+	claimMu.Unlock()
+
+	status := http.StatusOK
+	if req.Atomic && failed > 0 {
+		// Nothing was stored, report only the failures
+		issued = nil
+		status = http.StatusConflict
+		for n, res := range results {
+			if res.Status == http.StatusBadRequest {
+				status = http.StatusBadRequest
+			}
+			if res.Error == "" {
+				results[n] = tokenResult{RequestId: res.RequestId, Status: http.StatusFailedDependency, Error: "not issued, other request ids failed"}
+			}
+		}
+	}
+
+	promActiveTokens.Add(float64(len(issued)))
+	for _, res := range results {
+		if res.Token != "" {
+			registerRequest(res.RequestId, res.Token)
+		}
+	}
+	if len(issued) > 0 {
+		auditRequest(r, auditEntry{Event: auditTokenCreated, RequestIds: issued})
+	}
+	log.Printf("issued %d of %d requested tokens", len(issued), len(req.RequestIds))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err = json.NewEncoder(w).Encode(map[string]any{"results": results}); err != nil {
+		log.Printf("error responding with tokens: %v", err)
+	}
+}
+
+// issueToken generates the token for single request ID of `POST /tokens`, the caller holds claimMu and stores the
+// token
+func issueToken(requestId string, o tokenOverrides, seen map[string]bool) (tokenResult, streamToken) {
+	res := tokenResult{RequestId: requestId}
+	switch {
+	case requestId == "":
+		res.Status, res.Error = http.StatusBadRequest, "invalid request_id"
+		return res, streamToken{}
+	case seen[requestId]:
+		res.Status, res.Error = http.StatusBadRequest, "duplicate request_id"
+		return res, streamToken{}
+	}
+	seen[requestId] = true
+
+	st, err := newStreamToken(o)
+	if err != nil {
+		log.Printf("error generating token (request_id: %s): %v", requestId, err)
+		res.Status, res.Error = http.StatusInternalServerError, "cannot generate token"
+		return res, streamToken{}
+	}
+	if _, exists := streamsTokens.Load(requestId); exists || inBatch(requestId) {
+		log.Printf("token already exists (request_id: %s)", requestId)
+		res.Status, res.Error = http.StatusConflict, "token already exists"
+		return res, streamToken{}
+	}
+
+	res.Token = st.token
+	res.ExpiresAt = strconv.FormatInt(st.expiresAt, 10)
+	res.Timeout = int(st.streamTimeout().Seconds())
+	res.Retention = int(st.recordRetention().Seconds())
+	return res, st
+}
+
+// cleanupTokens deletes expired stream tokens
+func cleanupTokens() {
+	n := 0
+	streamsTokens.Range(func(key, value interface{}) bool {
+		token := value.(streamToken)
+		if token.expiresAt < time.Now().Unix() {
+			streamsTokens.Delete(key)
+			expireRequest(key.(string))
+			auditLog.record(auditEntry{Event: auditTokenExpired, RequestId: key.(string)})
+			n++
+		}
+		return true
+	})
+	if n > 0 {
+		log.Printf("%d expired streams tokens, deleting", n)
+	}
+	promActiveTokens.Sub(float64(n))
+}
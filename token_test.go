@@ -2,9 +2,14 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestHandleCreateToken(t *testing.T) {
@@ -16,6 +21,7 @@ func TestHandleCreateToken(t *testing.T) {
 		{`{"request_id": ""}`, http.StatusBadRequest},
 	}
 
+	resetTestState()
 	for _, test := range tests {
 		req, _ := http.NewRequest("POST", "/token", bytes.NewBuffer([]byte(test.body)))
 
@@ -31,6 +37,7 @@ func TestHandleCreateToken(t *testing.T) {
 }
 
 func TestHandleCreateToken_TokenAlreadyExists(t *testing.T) {
+	resetTestState()
 	streamsTokens.Store("req1", streamToken{})
 	req, _ := http.NewRequest("POST", "/token", bytes.NewBufferString(`{"request_id":"req1"}`))
 
@@ -43,3 +50,154 @@ func TestHandleCreateToken_TokenAlreadyExists(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
 	}
 }
+
+func TestHandleCreateToken_Overrides(t *testing.T) {
+	resetTestState()
+	requestTimeout, recordRetention, tokenTTL = 120, 300, 900
+	maxRequestTimeout, maxRecordRetention, maxTokenTTL = 600, 3600, 1800
+
+	req, _ := http.NewRequest("POST", "/token", bytes.NewBufferString(`{"request_id": "req1", "timeout": 60, "retention": 7200, "token_ttl": 3600}`))
+	rr := httptest.NewRecorder()
+	handleCreateToken(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var resp struct {
+		Timeout   int    `json:"timeout"`
+		Retention int    `json:"retention"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Timeout != 60 || resp.Retention != 3600 {
+		t.Errorf("expected timeout 60 and retention bounded to 3600, got %d and %d", resp.Timeout, resp.Retention)
+	}
+	expiresAt, _ := strconv.ParseInt(resp.ExpiresAt, 10, 64)
+	if ttl := expiresAt - time.Now().Unix(); ttl < 1790 || ttl > 1800 {
+		t.Errorf("expected token ttl bounded to 1800, got %d", ttl)
+	}
+
+	v, _ := streamsTokens.Load("req1")
+	if token := v.(streamToken); token.streamTimeout() != time.Minute || token.recordRetention() != time.Hour {
+		t.Errorf("expected stored overrides, got timeout %s and retention %s", token.streamTimeout(), token.recordRetention())
+	}
+}
+
+func TestHandleCreateToken_Defaults(t *testing.T) {
+	resetTestState()
+	requestTimeout, recordRetention = 120, 0
+
+	req, _ := http.NewRequest("POST", "/token", bytes.NewBufferString(`{"request_id": "req1"}`))
+	rr := httptest.NewRecorder()
+	handleCreateToken(rr, req)
+
+	body := rr.Body.String()
+	if !strings.Contains(body, `"timeout":120`) || !strings.Contains(body, `"retention":120`) {
+		t.Errorf("expected default timeout and retention (same as timeout) in response, got %s", body)
+	}
+}
+
+func TestHandleCreateToken_NegativeOverride(t *testing.T) {
+	resetTestState()
+	req, _ := http.NewRequest("POST", "/token", bytes.NewBufferString(`{"request_id": "req1", "timeout": -1}`))
+	rr := httptest.NewRecorder()
+	handleCreateToken(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCleanupTokens(t *testing.T) {
+	resetTestState()
+	streamsTokens.Store("expired", streamToken{token: "a", expiresAt: time.Now().Add(-time.Minute).Unix()})
+	streamsTokens.Store("valid", streamToken{token: "b", expiresAt: time.Now().Add(time.Minute).Unix()})
+
+	cleanupTokens()
+	if _, ok := streamsTokens.Load("expired"); ok {
+		t.Errorf("expected expired token to be deleted")
+	}
+	if _, ok := streamsTokens.Load("valid"); !ok {
+		t.Errorf("expected valid token to be kept")
+	}
+}
+
+func TestHandleCreateTokens(t *testing.T) {
+	tests := []struct {
+		name             string
+		body             string
+		expectedCode     int
+		expectedStatuses []int // per request ID, 0 when the token is issued
+	}{
+		{"all issued", `{"request_ids": ["req1", "req2"]}`, http.StatusOK, []int{0, 0}},
+		{"best effort", `{"request_ids": ["req1", "taken", "", "req1"]}`, http.StatusOK,
+			[]int{0, http.StatusConflict, http.StatusBadRequest, http.StatusBadRequest}},
+		{"atomic conflict", `{"request_ids": ["req1", "taken"], "atomic": true}`, http.StatusConflict,
+			[]int{http.StatusFailedDependency, http.StatusConflict}},
+		{"atomic invalid", `{"request_ids": ["req1", ""], "atomic": true}`, http.StatusBadRequest,
+			[]int{http.StatusFailedDependency, http.StatusBadRequest}},
+		{"empty", `{"request_ids": []}`, http.StatusBadRequest, nil},
+		{"negative override", `{"request_ids": ["req1"], "token_ttl": -5}`, http.StatusBadRequest, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetTestState()
+			streamsTokens.Store("taken", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+
+			req, _ := http.NewRequest("POST", "/tokens", bytes.NewBufferString(test.body))
+			rr := httptest.NewRecorder()
+			handleCreateTokens(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Fatalf("expected status %d, got %d (response body: %s)", test.expectedCode, rr.Code, rr.Body.String())
+			}
+			if test.expectedStatuses == nil {
+				return
+			}
+
+			var resp struct {
+				Results []tokenResult `json:"results"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil || len(resp.Results) != len(test.expectedStatuses) {
+				t.Fatalf("expected %d results, got %s (err: %v)", len(test.expectedStatuses), rr.Body.String(), err)
+			}
+			for n, res := range resp.Results {
+				if res.Status != test.expectedStatuses[n] {
+					t.Errorf("expected status %d for %q, got %d (%s)", test.expectedStatuses[n], res.RequestId, res.Status, res.Error)
+				}
+				v, ok := streamsTokens.Load(res.RequestId)
+				if res.Token != "" && (!ok || v.(streamToken).token != res.Token) {
+					t.Errorf("expected token for %s to be stored", res.RequestId)
+				}
+				if res.Status == http.StatusFailedDependency && ok {
+					t.Errorf("expected token for %s to be revoked after atomic failure", res.RequestId)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleCreateTokens_AtomicFailureNotVisible(t *testing.T) {
+	resetTestState()
+	streamsTokens.Store("taken", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix()})
+
+	// Request IDs of the failed atomic request are never claimed, so concurrent `POST /token` always succeeds
+	for n := 0; n < 200; n++ {
+		requestId := "req" + strconv.Itoa(n)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", "/tokens", bytes.NewBufferString(`{"request_ids": ["`+requestId+`", "taken"], "atomic": true}`))
+			handleCreateTokens(httptest.NewRecorder(), req)
+		}()
+		req, _ := http.NewRequest("POST", "/token", bytes.NewBufferString(`{"request_id": "`+requestId+`"}`))
+		rr := httptest.NewRecorder()
+		handleCreateToken(rr, req)
+		wg.Wait()
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected token for %s, got %d (response body: %s)", requestId, rr.Code, rr.Body.String())
+		}
+	}
+}
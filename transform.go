@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// payloadTransform selects and redacts payload fields at delivery time, as requested when creating the token.
+// Fields are dotted paths, eg. `data.output`.
+type payloadTransform struct {
+	// projection keeps only the listed fields (with their parents), all fields when empty
+	projection []string
+	// redact removes the listed fields
+	redact []string
+}
+
+var errInvalidTransform = errors.New("invalid payload transformation")
+
+// errTransformFailed is returned when the payload can't be transformed on delivery, eg. it isn't JSON
+var errTransformFailed = errors.New("failed to transform payload")
+
+// transformFailedCode is the `error` event code sent instead of the payload which can't be transformed
+const transformFailedCode = "TRANSFORM_FAILED"
+
+// newPayloadTransform validates the requested field paths
+func newPayloadTransform(projection, redact []string) (payloadTransform, error) {
+	for _, path := range append(projection, redact...) {
+		if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+			return payloadTransform{}, errInvalidTransform
+		}
+	}
+	return payloadTransform{projection: projection, redact: redact}, nil
+}
+
+func (t payloadTransform) empty() bool {
+	return len(t.projection) == 0 && len(t.redact) == 0
+}
+
+// apply returns the transformed JSON payload. Fields missing in the payload are skipped.
+func (t payloadTransform) apply(content []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(content))
+	d.UseNumber()
+	var doc any
+	if err := d.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	if len(t.projection) > 0 {
+		projected := map[string]any{}
+		for _, path := range t.projection {
+			if v, ok := lookupJSONPath(doc, path); ok {
+				setJSONPath(projected, path, v)
+			}
+		}
+		doc = projected
+	}
+	for _, path := range t.redact {
+		deleteJSONPath(doc, path)
+	}
+	return json.Marshal(doc)
+}
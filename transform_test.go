@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPayloadTransform(t *testing.T) {
+	payload := []byte(`{"request_id": "req1", "status": "completed", "data": {"output": "ok", "prompt": "secret", "tokens": 12345678901234567890}}`)
+	tests := []struct {
+		name       string
+		projection []string
+		redact     []string
+		expected   string
+	}{
+		{"projection", []string{"request_id", "data.output", "missing.field"}, nil, `{"data":{"output":"ok"},"request_id":"req1"}`},
+		{"redaction", nil, []string{"data.prompt", "missing.field"}, `{"data":{"output":"ok","tokens":12345678901234567890},"request_id":"req1","status":"completed"}`},
+		{"projection and redaction", []string{"data"}, []string{"data.prompt"}, `{"data":{"output":"ok","tokens":12345678901234567890}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transform, err := newPayloadTransform(test.projection, test.redact)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			got, err := transform.apply(payload)
+			if err != nil || string(got) != test.expected {
+				t.Errorf("expected %s, got %s (err: %v)", test.expected, got, err)
+			}
+		})
+	}
+
+	for _, path := range []string{"", ".a", "a.", "a..b"} {
+		if _, err := newPayloadTransform(nil, []string{path}); err != errInvalidTransform {
+			t.Errorf("expected path %q to be rejected, got %v", path, err)
+		}
+	}
+}
+
+func TestHandleClientStream_Transformed(t *testing.T) {
+	transform, _ := newPayloadTransform([]string{"data.output"}, nil)
+	streamsTokens = sync.Map{}
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix(), transform: transform})
+	store = NewInMemStore()
+	store.Append(context.Background(), "asd", Record{content: []byte(`[1, 2]`), signature: "s1", progress: true})
+	store.Append(context.Background(), "asd", Record{content: []byte(`{"data": {"output": "ok", "prompt": "secret"}}`), signature: "s2"})
+
+	req, _ := http.NewRequest("GET", "/listen/asd", nil)
+	req.SetPathValue("request_id", "asd")
+	req.Header.Add("Authorization", "Bearer a")
+	rr := httptest.NewRecorder()
+	handleClientStream(context.Background())(rr, req)
+
+	expectedBody := "data: {}\n\ndata: transformed=true\n\ndata: signature=s1\n\n" +
+		"data: {\"data\":{\"output\":\"ok\"}}\n\ndata: transformed=true\n\ndata: signature=s2\n\ndata: eot\n\n"
+	if rr.Body.String() != expectedBody {
+		t.Errorf("expected body %q, got %q", expectedBody, rr.Body.String())
+	}
+}
+
+func TestHandleClientStream_TransformFailed(t *testing.T) {
+	transform, _ := newPayloadTransform(nil, []string{"data.prompt"})
+	resetTestState()
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix(), transform: transform})
+	store.Append(context.Background(), "asd", Record{content: []byte(`{"data": {"prompt": "secret"`), signature: "s1"})
+
+	req, _ := http.NewRequest("GET", "/listen/asd", nil)
+	req.SetPathValue("request_id", "asd")
+	req.Header.Add("Authorization", "Bearer a")
+	rr := httptest.NewRecorder()
+	handleClientStream(context.Background())(rr, req)
+
+	// The payload is withheld, not sent untransformed
+	expectedBody := "event: error\ndata: {\"errors\":[{\"code\":\"TRANSFORM_FAILED\"}]}\n\n"
+	if rr.Body.String() != expectedBody {
+		t.Errorf("expected body %q, got %q", expectedBody, rr.Body.String())
+	}
+	if _, ok := streamsTokens.Load("asd"); !ok {
+		t.Errorf("expected token kept, the payload wasn't delivered")
+	}
+}
+
+func TestHandleCreateToken_InvalidTransform(t *testing.T) {
+	streamsTokens = sync.Map{}
+	req, _ := http.NewRequest("POST", "/token", strings.NewReader(`{"request_id": "asd", "redact": ["data..prompt"]}`))
+	rr := httptest.NewRecorder()
+	handleCreateToken(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+	if _, ok := streamsTokens.Load("asd"); ok {
+		t.Errorf("expected no token to be created")
+	}
+}
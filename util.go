@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"strings"
 )
 
 func generateSecureToken(length int) (string, error) {
@@ -12,3 +13,48 @@ func generateSecureToken(length int) (string, error) {
 	}
 	return hex.EncodeToString(bytes), nil
 }
+
+// lookupJSONPath returns the value at the dotted path (eg. `data.status`) of the decoded JSON document
+func lookupJSONPath(doc any, path string) (any, bool) {
+	for _, key := range strings.Split(path, ".") {
+		m, ok := doc.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if doc, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// setJSONPath sets the value at the dotted path of the decoded JSON object, creating the missing parents
+func setJSONPath(doc map[string]any, path string, value any) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := doc[key].(map[string]any)
+		if !ok {
+			child = map[string]any{}
+			doc[key] = child
+		}
+		doc = child
+	}
+	doc[keys[len(keys)-1]] = value
+}
+
+// deleteJSONPath removes the value at the dotted path of the decoded JSON document, if present
+func deleteJSONPath(doc any, path string) {
+	parent, key := "", path
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		parent, key = path[:i], path[i+1:]
+	}
+	if parent != "" {
+		var ok bool
+		if doc, ok = lookupJSONPath(doc, parent); !ok {
+			return
+		}
+	}
+	if m, ok := doc.(map[string]any); ok {
+		delete(m, key)
+	}
+}
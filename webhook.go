@@ -1,48 +1,198 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"io"
+	"errors"
 	"log"
 	"net/http"
+	"strings"
+
+	"github.com/flowaicom/webhook-proxy/client"
+)
+
+var (
+	// statusField is the dotted path of the payload field holding the request status, eg. `data.status`. Every
+	// payload is final when empty.
+	statusField = ""
+	// terminalStatuses is a comma separated list of statuses which end the client stream
+	terminalStatuses = "completed,succeeded,failed,error,cancelled,canceled"
 )
 
-// handleIncomingWebhook validates and stores webhook payloads received from Baseten to be forwarded to the client
+// isTerminalPayload returns whether the webhook payload is the last one for the request. Payloads with no status
+// field (dotted path) are terminal, other statuses mark partial or progress results.
+func isTerminalPayload(b []byte, field string) bool {
+	if field == "" {
+		return true
+	}
+	var doc any
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return true
+	}
+	v, ok := lookupJSONPath(doc, field)
+	if !ok {
+		return true
+	}
+	status, ok := v.(string)
+	if !ok {
+		return true
+	}
+	for _, s := range strings.Split(terminalStatuses, ",") {
+		if strings.EqualFold(strings.TrimSpace(s), status) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleIncomingWebhook handles `POST /webhook` route, receives webhooks from Baseten
 func handleIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	handleWebhook(w, r, basetenProvider)
+}
+
+// handleProviderWebhook handles `POST /webhook/{provider}` route, receives webhooks from the configured providers
+func handleProviderWebhook(w http.ResponseWriter, r *http.Request) {
+	p, ok := providers[r.PathValue("provider")]
+	if !ok {
+		log.Printf("webhook received for unknown provider %s\n", r.PathValue("provider"))
+		http.Error(w, "unknown provider", http.StatusNotFound)
+		return
+	}
+	handleWebhook(w, r, p)
+}
+
+// handleWebhook validates and appends webhook payloads received from the provider to the request event log,
+// to be forwarded to the client
+func handleWebhook(w http.ResponseWriter, r *http.Request, p *provider) {
 	// Drop requests without signature header
-	signature := r.Header.Get("X-BASETEN-SIGNATURE")
+	signature := r.Header.Get(p.Signature.Header)
 	if signature == "" {
 		log.Println("webhook request received with no signature, dropping")
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
 
-	b, err := io.ReadAll(r.Body)
+	b, err := readWebhookBody(r)
 	defer r.Body.Close()
+	if errors.Is(err, errInvalidEncoding) {
+		log.Printf("failed to decompress body: %v\n", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errBodyTooLarge) {
+		log.Printf("decompressed body exceeds %d bytes, rejecting\n", gzipBodyLimit)
+		http.Error(w, "request entity too large", http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		log.Printf("failed to read body: %v\n", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	decoded := struct {
-		RequestId string `json:"request_id"`
-	}{}
+	if err = p.verify(r, b, signature); err != nil {
+		log.Printf("webhook from %s rejected: %v\n", p.Name, err)
+		bodyHash := sha256.Sum256(b)
+		auditRequest(r, auditEntry{Event: auditWebhookRejected, Provider: p.Name, Reason: "invalid signature", BodyHash: hex.EncodeToString(bodyHash[:])})
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
 
-	if err = json.Unmarshal(b, &decoded); err != nil {
-		log.Printf("failed to unmarshal json body: %s\n", string(b))
+	requestId, err := p.requestId(r, b)
+	if errors.Is(err, errMissingRequestId) {
+		log.Printf("webhook delivered but missing request id (%s): %s\n", p.RequestId.Key, string(b))
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-
-	if decoded.RequestId == "" {
-		log.Printf("webhook delivered but missing request_id: %s\n", string(b))
+	if err != nil {
+		log.Printf("%v: %s\n", err, string(b))
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("received webhook request with id=%s\n", decoded.RequestId)
+	// Idempotency, duplicates are acknowledged without storing them again
+	progress := !isTerminalPayload(b, p.statusField())
+	done, err := claimDelivery(requestId, b, !progress)
+	if errors.Is(err, errDuplicateWebhook) {
+		log.Printf("duplicate webhook delivery (request_id: %s), ignoring\n", requestId)
+		promDuplicateWebhooks.WithLabelValues("duplicate").Inc()
+		return
+	}
+	if errors.Is(err, errConsumedWebhook) {
+		log.Printf("webhook re-delivered after the result was consumed (request_id: %s), refusing\n", requestId)
+		promDuplicateWebhooks.WithLabelValues("consumed").Inc()
+		http.Error(w, "already delivered", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errCancelledWebhook) {
+		// Acknowledged, so the provider doesn't retry the delivery
+		log.Printf("webhook delivered after the request was cancelled (request_id: %s), discarding\n", requestId)
+		promDuplicateWebhooks.WithLabelValues("cancelled").Inc()
+		return
+	}
+	if errors.Is(err, errCancellingWebhook) {
+		// Kept by the provider, the retry is discarded or stored depending on the outcome of the cancellation
+		log.Printf("webhook delivered while the request is being cancelled (request_id: %s), retry later\n", requestId)
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	log.Printf("received webhook request with id=%s (provider: %s)\n", requestId, p.Name)
 	promWebhooksReceived.Inc()
 
-	store.Put(decoded.RequestId, Record{content: b, signature: signature})
+	// Retention requested by the client, if the token was already created
+	// and the token for binding the encryption key
+	ctx := r.Context()
+	record := Record{content: b, signature: signature, progress: progress}
+	var token streamToken
+	if t, ok := streamsTokens.Load(requestId); ok {
+		token = t.(streamToken)
+	} else if owner, ok := batchOf(requestId); ok {
+		token = owner.token
+	}
+	if token.token != "" {
+		record.retention = token.recordRetention()
+		ctx = withStreamToken(ctx, token.token)
+	}
+
+	// Failed Baseten predictions are signalled to the client with the `error` event. Only the error codes are kept
+	// outside the payload, the messages may carry model output and stay encrypted or transformed with it.
+	errs, known := []predictionError(nil), false
+	if p == basetenProvider && !record.progress {
+		errs, known = predictionErrors(b)
+		record.predictionErrors = withoutMessages(errs)
+	}
+
+	// End-to-end encryption, the plaintext is not kept once sealed to the client public key
+	if token.publicKey != nil {
+		sealed, err := client.Seal(token.publicKey, b)
+		if err != nil {
+			done(false)
+			log.Printf("failed to seal webhook payload (request_id: %s): %v\n", requestId, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		record.content, record.sealed = sealed, true
+	}
+
+	// Respond with 503 on store failure, so the provider retries the delivery
+	if err = store.Append(ctx, requestId, record); err != nil {
+		done(false)
+		log.Printf("failed to store webhook payload (request_id: %s): %v\n", requestId, err)
+		promStoreErrors.WithLabelValues("put").Inc()
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	done(true)
+	transitionRequest(requestId, stateWebhookReceived)
+	if known && len(errs) > 0 {
+		log.Printf("prediction failed (request_id: %s): %+v\n", requestId, record.predictionErrors)
+		promPredictionResults.WithLabelValues("failure").Inc()
+		failRequest(requestId, record.predictionErrors)
+	} else if known {
+		promPredictionResults.WithLabelValues("success").Inc()
+	}
+	bodyHash := sha256.Sum256(b)
+	auditRequest(r, auditEntry{Event: auditWebhookReceived, RequestId: requestId, Provider: p.Name, BodyHash: hex.EncodeToString(bodyHash[:])})
 }
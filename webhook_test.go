@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestHandleIncomingWebhook_NoSignatureHeader(t *testing.T) {
@@ -48,7 +51,7 @@ func TestHandleIncomingWebhook_Valid(t *testing.T) {
 	req, _ := http.NewRequest("POST", "/webhook", bytes.NewBufferString(`{"request_id": "asd"}`))
 	req.Header.Set("X-BASETEN-SIGNATURE", "xxx")
 
-	store = NewInMemStore()
+	resetTestState()
 
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(handleIncomingWebhook)
@@ -59,11 +62,15 @@ func TestHandleIncomingWebhook_Valid(t *testing.T) {
 	}
 
 	// Assert record inserted to the store
-	record, err := store.Get("asd")
-	if err != nil {
-		t.Errorf("expected request stored, got err: %v", err)
+	records, err := store.Get(context.Background(), "asd")
+	if err != nil || len(records) != 1 {
+		t.Fatalf("expected request stored, got %d records (err: %v)", len(records), err)
 	}
 
+	record := records[0]
+	if record.progress {
+		t.Errorf("expected payload without status to be terminal")
+	}
 	if record.signature != "xxx" || string(record.content) != `{"request_id": "asd"}` {
 		t.Errorf(
 			"expected stored request to be signature=%s and content=%s, got signature=%s and body=%s",
@@ -71,3 +78,82 @@ func TestHandleIncomingWebhook_Valid(t *testing.T) {
 		)
 	}
 }
+
+// failingStore is a Store whose every operation fails, as a network-backed store could
+type failingStore struct{}
+
+var errStoreUnavailable = errors.New("store unavailable")
+
+func (failingStore) Append(context.Context, string, Record) error { return errStoreUnavailable }
+func (failingStore) Get(context.Context, string) ([]Record, error) {
+	return nil, errStoreUnavailable
+}
+func (failingStore) Subscribe(context.Context, string) ([]Record, <-chan struct{}, func(), error) {
+	return nil, nil, nil, errStoreUnavailable
+}
+func (failingStore) Delete(context.Context, string) error { return errStoreUnavailable }
+func (failingStore) GetOlderThan(context.Context, time.Duration) ([]string, error) {
+	return nil, errStoreUnavailable
+}
+
+func TestHandleIncomingWebhook_StoreFailure(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/webhook", bytes.NewBufferString(`{"request_id": "asd"}`))
+	req.Header.Set("X-BASETEN-SIGNATURE", "xxx")
+
+	resetTestState()
+	store = failingStore{}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(handleIncomingWebhook)
+
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v (response body: %s)", rr.Code, http.StatusServiceUnavailable, rr.Body.String())
+	}
+}
+
+func TestHandleIncomingWebhook_RetentionFromToken(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/webhook", bytes.NewBufferString(`{"request_id": "asd"}`))
+	req.Header.Set("X-BASETEN-SIGNATURE", "xxx")
+
+	resetTestState()
+	streamsTokens.Store("asd", streamToken{token: "a", expiresAt: time.Now().Add(time.Minute).Unix(), retention: time.Hour})
+
+	rr := httptest.NewRecorder()
+	handleIncomingWebhook(rr, req)
+
+	records, err := store.Get(context.Background(), "asd")
+	if err != nil || records[0].retention != time.Hour {
+		t.Errorf("expected record with client requested retention, got %+v (err: %v)", records, err)
+	}
+}
+
+// withStatusField enables progress events with the status field for the test
+func withStatusField(t *testing.T, field string) {
+	t.Helper()
+	statusField = field
+	t.Cleanup(func() { statusField = "" })
+}
+
+func TestIsTerminalPayload(t *testing.T) {
+	tests := []struct {
+		field    string
+		payload  string
+		expected bool
+	}{
+		{"", `{"request_id": "asd", "status": "in_progress"}`, true},
+		{"status", `{"request_id": "asd"}`, true},
+		{"status", `{"request_id": "asd", "status": "in_progress"}`, false},
+		{"status", `{"request_id": "asd", "status": "COMPLETED"}`, true},
+		{"status", `{"request_id": "asd", "status": 3}`, true},
+		{"data.status", `{"request_id": "asd", "data": {"status": "running"}}`, false},
+		{"data.status", `{"request_id": "asd", "data": {"status": "failed"}}`, true},
+		{"data.status", `{"request_id": "asd", "data": "running"}`, true},
+	}
+
+	for _, test := range tests {
+		if got := isTerminalPayload([]byte(test.payload), test.field); got != test.expected {
+			t.Errorf("expected %s terminal=%v with field %s, got %v", test.payload, test.expected, test.field, got)
+		}
+	}
+}